@@ -17,8 +17,26 @@ var (
 )
 
 const (
-	readTimeout    = 5 * time.Minute
-	maxConnections = 512
+	tokenFile            = "/var/run/secrets/kubernetes.io/serviceaccount/token" //nolint:gosec // path of the token
+	readTimeout          = 5 * time.Minute
+	shutdownDelay        = 5 * time.Second
+	shutdownTimeout      = 25 * time.Second
+	maxConnections       = 512
+	maxConcurrentQueries = 0
+	cardinalityCacheTTL  = 30 * time.Second
+	auditFileMaxSize     = 100
+	auditFileMaxBackups  = 5
+
+	upstreamHealthCheckInterval = 5 * time.Second
+	upstreamDialTimeout         = 30 * time.Second
+	upstreamIdleConnTimeout     = 5 * time.Minute
+	grpcKeepAliveTime           = 5 * time.Minute
+	grpcKeepAliveTimeout        = 20 * time.Second
+
+	reviewCacheTTL        = 5 * time.Minute
+	reviewCacheSize       = 1024
+	secretResyncPeriod    = 2 * time.Hour
+	namespaceResyncPeriod = 10 * time.Minute
 )
 
 func main() {
@@ -38,42 +56,286 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
-			Name:  "log.json",
-			Usage: "[optional] Log as JSON",
+			Name:   "log.json",
+			EnvVar: "PROMETHEUS_AUTH_LOG_JSON",
+			Usage:  "[optional] Log as JSON",
 		},
 		cli.BoolFlag{
-			Name:  "log.debug",
-			Usage: "[optional] Log debug info",
+			Name:   "log.debug",
+			EnvVar: "PROMETHEUS_AUTH_LOG_DEBUG",
+			Usage:  "[optional] Log debug info",
+		},
+		cli.StringFlag{
+			Name:   "config-file",
+			EnvVar: "PROMETHEUS_AUTH_CONFIG_FILE",
+			Usage:  "[optional] Path to the versioned YAML config file, whose settings are overridden by the flags and their environment variables",
+		},
+		cli.StringFlag{
+			Name:   "listen-address",
+			EnvVar: "PROMETHEUS_AUTH_LISTEN_ADDRESS",
+			Usage:  "[optional] Address to listening",
+			Value:  ":9090",
+		},
+		cli.StringFlag{
+			Name:   "admin-listen-address",
+			EnvVar: "PROMETHEUS_AUTH_ADMIN_LISTEN_ADDRESS",
+			Usage:  "[optional] Address to listening for the metrics, health, config and profiling endpoints, which are not served to the tenants",
+			Value:  ":9091",
+		},
+		cli.BoolFlag{
+			Name:   "enable-profiling",
+			EnvVar: "PROMETHEUS_AUTH_ENABLE_PROFILING",
+			Usage:  "[optional] Serve the pprof profiles on '/debug/pprof/' of the admin address",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert-file",
+			EnvVar: "PROMETHEUS_AUTH_TLS_CERT_FILE",
+			Usage:  "[optional] Path to the TLS certificate of the listener, which serves HTTP/1.1, HTTP/2 and gRPC over TLS if set",
+		},
+		cli.StringFlag{
+			Name:   "tls-key-file",
+			EnvVar: "PROMETHEUS_AUTH_TLS_KEY_FILE",
+			Usage:  "[optional] Path to the TLS private key of the listener",
+		},
+		cli.StringFlag{
+			Name:   "proxy-url",
+			EnvVar: "PROMETHEUS_AUTH_PROXY_URL",
+			Usage:  "[optional] URL to proxy, or a comma-separated list of URLs to fail over between",
+			Value:  "http://localhost:9999",
+		},
+		cli.DurationFlag{
+			Name:   "upstream-health-check-interval",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_HEALTH_CHECK_INTERVAL",
+			Usage:  "[optional] Interval of checking '/-/ready' of the upstreams with several URLs, disabled if 0",
+			Value:  upstreamHealthCheckInterval,
+		},
+		cli.StringFlag{
+			Name:   "upstream-client-config",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_CLIENT_CONFIG",
+			Usage:  "[optional] Path to the HTTP client config of the upstreams, in the format of Prometheus' 'http_config' with TLS, basic auth, authorization and HTTP/2 settings",
+		},
+		cli.DurationFlag{
+			Name:   "upstream-dial-timeout",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_DIAL_TIMEOUT",
+			Usage:  "[optional] Maximum duration of connecting to an upstream",
+			Value:  upstreamDialTimeout,
+		},
+		cli.DurationFlag{
+			Name:   "upstream-idle-conn-timeout",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_IDLE_CONN_TIMEOUT",
+			Usage:  "[optional] Maximum duration of keeping an idle connection to an upstream open",
+			Value:  upstreamIdleConnTimeout,
+		},
+		cli.BoolFlag{
+			Name:   "upstream-disable-keep-alives",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_DISABLE_KEEP_ALIVES",
+			Usage:  "[optional] Use a new connection for each request to an upstream",
+		},
+		cli.StringSliceFlag{
+			Name:   "grpc-upstream",
+			EnvVar: "PROMETHEUS_AUTH_GRPC_UPSTREAM",
+			Usage:  "[optional] Target of the gRPC upstream, like a Thanos sidecar, repeat to fail over between several targets, defaults to the hosts of the proxy URLs",
+			Value:  &cli.StringSlice{},
+		},
+		cli.DurationFlag{
+			Name:   "grpc-keepalive-time",
+			EnvVar: "PROMETHEUS_AUTH_GRPC_KEEPALIVE_TIME",
+			Usage:  "[optional] Interval of pinging the gRPC upstream on idle connections",
+			Value:  grpcKeepAliveTime,
+		},
+		cli.DurationFlag{
+			Name:   "grpc-keepalive-timeout",
+			EnvVar: "PROMETHEUS_AUTH_GRPC_KEEPALIVE_TIMEOUT",
+			Usage:  "[optional] Maximum duration of waiting for the ping response of the gRPC upstream before closing the connection",
+			Value:  grpcKeepAliveTimeout,
+		},
+		cli.StringSliceFlag{
+			Name:   "upstream-route",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_ROUTE",
+			Usage:  "[optional] Route the requests of a project, of namespaces matching a regex or of a path prefix to another URL, in the form of '<project|namespace|path>:<value>=<url>'",
+			Value:  &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:   "upstream-fan-out",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_FAN_OUT",
+			Usage:  "[optional] Fan out the requests to the upstreams of all matching routes and merge their responses",
+		},
+		cli.StringSliceFlag{
+			Name:   "upstream-replica",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_REPLICA",
+			Usage:  "[optional] Query an HA replica together with an upstream and deduplicate their responses, in the form of '<upstream url>=<replica url>'",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:   "dedup-replica-label",
+			EnvVar: "PROMETHEUS_AUTH_DEDUP_REPLICA_LABEL",
+			Usage:  "[optional] Label which distinguishes the series of HA replicas, dropped when deduplicating their responses",
+			Value:  "prometheus_replica",
+		},
+		cli.StringFlag{
+			Name:   "partial-response",
+			EnvVar: "PROMETHEUS_AUTH_PARTIAL_RESPONSE",
+			Usage:  "[optional] How to handle failing upstreams when fanning out, either 'warn' to respond with warnings, or 'abort' to fail the request",
+			Value:  "warn",
+		},
+		cli.StringFlag{
+			Name:   "upstream-mode",
+			EnvVar: "PROMETHEUS_AUTH_UPSTREAM_MODE",
+			Usage:  "[optional] How to enforce the tenancy on the upstream, either 'rewrite' to inject the namespaces into the queries, or 'tenant-header' to set the tenant header on the same read APIs, which does not support '--upstream-fan-out'",
+			Value:  "rewrite",
 		},
 		cli.StringFlag{
-			Name:  "listen-address",
-			Usage: "[optional] Address to listening",
-			Value: ":9090",
+			Name:   "tenant-header",
+			EnvVar: "PROMETHEUS_AUTH_TENANT_HEADER",
+			Usage:  "[optional] Header to pass the tenant ID with in 'tenant-header' upstream mode",
+			Value:  "X-Scope-OrgID",
 		},
 		cli.StringFlag{
-			Name:  "proxy-url",
-			Usage: "[optional] URL to proxy",
-			Value: "http://localhost:9999",
+			Name:   "tenant-id",
+			EnvVar: "PROMETHEUS_AUTH_TENANT_ID",
+			Usage:  "[optional] Tenant ID to pass in 'tenant-header' upstream mode, either 'project' for the project ID, or 'namespaces' for the '|'-joined namespaces",
+			Value:  "project",
+		},
+		cli.DurationFlag{
+			Name:   "read-timeout",
+			EnvVar: "PROMETHEUS_AUTH_READ_TIMEOUT",
+			Usage:  "[optional] Maximum duration before timing out read of the request, and closing idle connections",
+			Value:  readTimeout,
 		},
 		cli.DurationFlag{
-			Name:  "read-timeout",
-			Usage: "[optional] Maximum duration before timing out read of the request, and closing idle connections",
-			Value: readTimeout,
+			Name:   "shutdown-delay",
+			EnvVar: "PROMETHEUS_AUTH_SHUTDOWN_DELAY",
+			Usage:  "[optional] Duration to keep serving after SIGTERM while failing the readiness, until the clients stopped sending new requests",
+			Value:  shutdownDelay,
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			EnvVar: "PROMETHEUS_AUTH_SHUTDOWN_TIMEOUT",
+			Usage:  "[optional] Maximum duration to drain the in-flight HTTP and gRPC requests on shutdown, after the shutdown delay",
+			Value:  shutdownTimeout,
 		},
 		cli.IntFlag{
-			Name:  "max-connections",
-			Usage: "[optional] Maximum number of simultaneous connections",
-			Value: maxConnections,
+			Name:   "max-connections",
+			EnvVar: "PROMETHEUS_AUTH_MAX_CONNECTIONS",
+			Usage:  "[optional] Maximum number of simultaneous connections, as backstop of the query limits, disabled if 0",
+			Value:  maxConnections,
+		},
+		cli.IntFlag{
+			Name:   "max-concurrent-queries",
+			EnvVar: "PROMETHEUS_AUTH_MAX_CONCURRENT_QUERIES",
+			Usage:  "[optional] Maximum number of queries of all tenants in flight to the upstreams, the excess queries wait in the tenant queues which are served round-robin, disabled if 0, then the queries are only scheduled fairly if the limits config sets concurrency limits",
+			Value:  maxConcurrentQueries,
 		},
 		cli.StringSliceFlag{
-			Name:  "filter-reader-labels",
-			Usage: "[optional] Filter out the configured labels when calling '/api/v1/read'",
-			Value: &cli.StringSlice{},
+			Name:   "filter-reader-labels",
+			EnvVar: "PROMETHEUS_AUTH_FILTER_READER_LABELS",
+			Usage:  "[optional] Filter out the configured labels when calling '/api/v1/read'",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:   "oidc-issuer",
+			EnvVar: "PROMETHEUS_AUTH_OIDC_ISSUER",
+			Usage:  "[optional] OIDC issuer URL, used to validate JWT tokens",
+			Value:  "",
 		},
 		cli.StringFlag{
-			Name:  "oidc-issuer",
-			Usage: "[optional] OIDC issuer URL, used to validate JWT tokens",
-			Value: "",
+			Name:   "token-file",
+			EnvVar: "PROMETHEUS_AUTH_TOKEN_FILE",
+			Usage:  "[optional] Path to the service account token of the agent, which is proxied unchanged",
+			Value:  tokenFile,
+		},
+		cli.DurationFlag{
+			Name:   "review-cache-ttl",
+			EnvVar: "PROMETHEUS_AUTH_REVIEW_CACHE_TTL",
+			Usage:  "[optional] Duration of caching the results of the token and access reviews",
+			Value:  reviewCacheTTL,
+		},
+		cli.IntFlag{
+			Name:   "review-cache-size",
+			EnvVar: "PROMETHEUS_AUTH_REVIEW_CACHE_SIZE",
+			Usage:  "[optional] Maximum number of cached results of the token reviews, and of the access reviews",
+			Value:  reviewCacheSize,
+		},
+		cli.DurationFlag{
+			Name:   "secret-resync-period",
+			EnvVar: "PROMETHEUS_AUTH_SECRET_RESYNC_PERIOD",
+			Usage:  "[optional] Interval of resyncing the secrets of the tokens from Kubernetes, disabled if 0",
+			Value:  secretResyncPeriod,
+		},
+		cli.DurationFlag{
+			Name:   "namespace-resync-period",
+			EnvVar: "PROMETHEUS_AUTH_NAMESPACE_RESYNC_PERIOD",
+			Usage:  "[optional] Interval of resyncing the namespaces from Kubernetes, disabled if 0",
+			Value:  namespaceResyncPeriod,
+		},
+		cli.DurationFlag{
+			Name:   "metric-names-cache-ttl",
+			EnvVar: "PROMETHEUS_AUTH_METRIC_NAMES_CACHE_TTL",
+			Usage:  "[optional] Cache the metric names owned by a project for the given duration, disabled if 0",
+			Value:  0,
+		},
+		cli.DurationFlag{
+			Name:   "cardinality-cache-ttl",
+			EnvVar: "PROMETHEUS_AUTH_CARDINALITY_CACHE_TTL",
+			Usage:  "[optional] Cache the series counts of the cardinality pre-check for the given duration, disabled if 0",
+			Value:  cardinalityCacheTTL,
+		},
+		cli.StringFlag{
+			Name:   "limits-config",
+			EnvVar: "PROMETHEUS_AUTH_LIMITS_CONFIG",
+			Usage:  "[optional] Path to the YAML file of the default and per-tenant limits, like the rate limits per endpoint class",
+		},
+		cli.StringFlag{
+			Name:   "namespaces-config",
+			EnvVar: "PROMETHEUS_AUTH_NAMESPACES_CONFIG",
+			Usage:  "[optional] Path to the YAML file of the candidate namespaces of the tenants, by 'projects' and 'users', which replace the resolved namespaces of the listed tenants unless the 'namespaces' rule is shadowed",
+		},
+		cli.StringSliceFlag{
+			Name:   "shadow-rule",
+			EnvVar: "PROMETHEUS_AUTH_SHADOW_RULE",
+			Usage:  "[optional] Only log, count and audit the denials of a rule of the limits for all tenants, either 'rate_limits', 'query_limits', 'query_cost', 'max_series', 'denied_metrics', 'namespaces' or 'all', repeat for several rules",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:   "audit-sink",
+			EnvVar: "PROMETHEUS_AUTH_AUDIT_SINK",
+			Usage:  "[optional] Write an audit event of each tenant request to 'stdout', to a rotating file with 'file:<path>', or post it to a webhook URL, repeat for several sinks",
+			Value:  &cli.StringSlice{},
+		},
+		cli.IntFlag{
+			Name:   "audit-file-max-size",
+			EnvVar: "PROMETHEUS_AUTH_AUDIT_FILE_MAX_SIZE",
+			Usage:  "[optional] Size in MiB of rotating the audit file, disabled if 0",
+			Value:  auditFileMaxSize,
+		},
+		cli.IntFlag{
+			Name:   "audit-file-max-backups",
+			EnvVar: "PROMETHEUS_AUTH_AUDIT_FILE_MAX_BACKUPS",
+			Usage:  "[optional] Number of rotated audit files to keep",
+			Value:  auditFileMaxBackups,
+		},
+		cli.Float64Flag{
+			Name:   "audit-sample-rate",
+			EnvVar: "PROMETHEUS_AUTH_AUDIT_SAMPLE_RATE",
+			Usage:  "[optional] Ratio between 0 and 1 of the successful requests to audit, the failed requests are always audited",
+			Value:  1,
+		},
+		cli.StringSliceFlag{
+			Name:   "audit-redact",
+			EnvVar: "PROMETHEUS_AUTH_AUDIT_REDACT",
+			Usage:  "[optional] Hide 'user', 'client_ip' or 'queries' in the audit events, or mask the values of a label in the queries with 'label:<name>'",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:   "tracing-endpoint",
+			EnvVar: "PROMETHEUS_AUTH_TRACING_ENDPOINT",
+			Usage:  "[optional] OTLP/HTTP URL to export the traces to, e.g. 'http://otel-collector:4318/v1/traces'",
+		},
+		cli.Float64Flag{
+			Name:   "tracing-sample-ratio",
+			EnvVar: "PROMETHEUS_AUTH_TRACING_SAMPLE_RATIO",
+			Usage:  "[optional] Ratio between 0 and 1 of the traces to sample, unless the client decided by its 'traceparent'",
+			Value:  1,
 		},
 	}
 
@@ -85,6 +347,10 @@ func main() {
 	}()
 
 	app.Before = func(context *cli.Context) error {
+		if err := agent.ApplyConfigFile(context); err != nil {
+			return err
+		}
+
 		if context.Bool("log.json") {
 			log.SetFormatter(&log.JSONFormatter{})
 		} else {
@@ -103,6 +369,34 @@ func main() {
 	}
 
 	app.Action = agent.Run
+	app.Commands = []cli.Command{
+		{
+			Name:      "replay",
+			Usage:     "Replay recorded audit events against a candidate policy and report the requests it would break",
+			UsageText: "prometheus-auth replay --events audit.log [--namespaces mapping.yaml] [--limits-config limits.yaml]",
+			Action:    agent.Replay,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "events",
+					Usage: "[optional] Path to a file of audit events as written by the 'stdout' and 'file:<path>' sinks, repeat for several files, '-' or none for the standard input",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringFlag{
+					Name:  "namespaces",
+					Usage: "[optional] Path to the YAML file of the candidate namespaces of the tenants, by 'projects' and 'users', the others keep the recorded namespaces",
+				},
+				cli.StringFlag{
+					Name:  "limits-config",
+					Usage: "[optional] Path to the YAML file of the candidate limits, in the format of the agent's '--limits-config'",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter-reader-labels",
+					Usage: "[optional] Filter out the configured labels when rewriting the '/api/v1/read' queries",
+					Value: &cli.StringSlice{},
+				},
+			},
+		},
+	}
 
 	if err := app.Run(os.Args); err != nil {
 		log.Panic(err)
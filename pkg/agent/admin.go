@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+// adminBackend serves the metrics, the probes, the config and the profiles of the agent itself,
+// which are not reachable through the tenant listener.
+func (a *agent) adminBackend() http.Handler {
+	router := mux.NewRouter()
+
+	// enable metrics
+	router.Path("/_/metrics").Methods("GET").Handler(promhttp.HandlerFor(
+		a.registry,
+		promhttp.HandlerOpts{
+			Registry: a.registry,
+		},
+	))
+
+	// health of the agent itself
+	router.Path("/_/healthz").Methods("GET").HandlerFunc(a.healthz)
+	router.Path("/_/readyz").Methods("GET").HandlerFunc(a.readyz)
+
+	router.Path("/_/config").Methods("GET").HandlerFunc(a.config)
+
+	// enable profiler only if asked, since the profiles are expensive to take
+	if a.cfg.profiling {
+		router.Path("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
+		router.Path("/debug/pprof/profile").HandlerFunc(pprof.Profile)
+		router.Path("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
+		router.Path("/debug/pprof/trace").HandlerFunc(pprof.Trace)
+		// the index serves the named profiles like heap or goroutine too
+		router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+
+	return router
+}
+
+// config reports the effective configuration in the format of the config file, with the secrets redacted.
+func (a *agent) config(w http.ResponseWriter, _ *http.Request) {
+	content, err := yaml.Marshal(a.cfg.effectiveConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(content)
+}
+
+func (a *agent) createAdminServer() *http.Server {
+	return &http.Server{
+		Handler:     a.adminBackend(),
+		ReadTimeout: a.cfg.readTimeout,
+	}
+}
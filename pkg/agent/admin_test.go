@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_adminBackend(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/-/ready": "ready",
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.effectiveConfig = &configFile{Version: configFileVersion}
+
+	doRequest := func(handler http.Handler, token string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090"+path, nil)
+		if len(token) != 0 {
+			req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	adminBackend := agt.adminBackend()
+	require.Equal(t, http.StatusOK, doRequest(adminBackend, "", "/_/metrics").Code)
+	require.Equal(t, http.StatusOK, doRequest(adminBackend, "", "/_/healthz").Code)
+	require.Equal(t, http.StatusOK, doRequest(adminBackend, "", "/_/readyz").Code)
+	res := doRequest(adminBackend, "", "/_/config")
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, "version: v1\n", res.Body.String())
+
+	// profiling is opt-in
+	require.Equal(t, http.StatusNotFound, doRequest(adminBackend, "", "/debug/pprof/").Code)
+	agt.cfg.profiling = true
+	adminBackend = agt.adminBackend()
+	require.Equal(t, http.StatusOK, doRequest(adminBackend, "", "/debug/pprof/").Code)
+	require.Equal(t, http.StatusOK, doRequest(adminBackend, "", "/debug/pprof/goroutine?debug=1").Code)
+
+	// none of the admin paths are served to the tenants
+	httpBackend := agt.httpBackend()
+	for _, path := range []string{"/_/metrics", "/_/healthz", "/_/readyz", "/_/config", "/debug/pprof/"} {
+		require.Equal(t, http.StatusUnauthorized, doRequest(httpBackend, "", path).Code, path)
+		require.Equal(t, http.StatusUnauthorized, doRequest(httpBackend, "someNamespacesToken", path).Code, path)
+	}
+}
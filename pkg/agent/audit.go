@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+)
+
+// audited starts the audit event of a request, the returned function logs the event once the request is served,
+// with the status and size of the response from the recorder.
+func (a *agent) audited(recorder *responseRecorder, r *http.Request, tag string) (*audit.Event, func()) {
+	if a.auditLogger == nil {
+		return nil, func() {}
+	}
+
+	start := time.Now()
+	event := &audit.Event{
+		Time:         start,
+		ID:           tag,
+		Method:       r.Method,
+		Endpoint:     r.URL.Path,
+		ClientIP:     clientIP(r),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+	}
+
+	return event, func() {
+		event.Status = recorder.status
+		event.Bytes = recorder.bytes
+		event.Latency = time.Since(start).Seconds()
+		a.auditLogger.Log(event)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_accessControlAudit(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query": map[string]interface{}{"resultType": "vector", "result": []interface{}{}},
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLogger, err := audit.New(audit.Config{Sinks: []string{audit.SinkFilePrefix + auditPath}, SampleRate: 1}, agt.registry)
+	require.NoError(t, err)
+	agt.auditLogger = auditLogger
+	httpBackend := agt.httpBackend()
+
+	for token, query := range map[string]string{
+		"someNamespacesToken": "sum(up)",
+		"unknownToken":        "up",
+		"noneNamespacesToken": "sum(",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		httpBackend.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	require.NoError(t, auditLogger.Close())
+
+	file, err := os.Open(auditPath)
+	require.NoError(t, err)
+	defer file.Close()
+
+	events := make(map[int]*audit.Event)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e audit.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events[e.Status] = &e
+	}
+	require.Len(t, events, 3)
+
+	e := events[http.StatusOK]
+	require.Regexp(t, "^[0-9a-f]{32}$", e.ID)
+	require.Equal(t, "someNamespacesUser", e.User)
+	require.Equal(t, "project-member", e.UID)
+	require.Equal(t, "p-some", e.ProjectID)
+	require.Equal(t, []string{"ns-a", "ns-b"}, e.Namespaces)
+	require.Equal(t, "/api/v1/query", e.Endpoint)
+	require.Equal(t, []audit.Query{{Raw: "sum(up)", Hijacked: `sum(up{namespace=~"ns-a|ns-b"})`}}, e.Queries)
+	require.Equal(t, "192.0.2.1", e.ForwardedFor)
+	require.NotEmpty(t, e.ClientIP)
+	require.Positive(t, e.Bytes)
+
+	e = events[http.StatusUnauthorized]
+	require.Empty(t, e.User)
+	require.Equal(t, "user is not authenticated", e.Error)
+
+	e = events[http.StatusBadRequest]
+	require.Equal(t, "noneNamespacesUser", e.User)
+	require.NotEmpty(t, e.Error)
+}
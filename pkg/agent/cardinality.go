@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	cardinalityCacheSize = 4096
+	// the default lookback delta of Prometheus, which the instant selectors look back
+	cardinalityLookbackDelta = 5 * time.Minute
+
+	maxSeriesActionReject = "reject"
+	maxSeriesActionWarn   = "warn"
+)
+
+// cardinalityMetrics records the queries which exceeded the series budget.
+type cardinalityMetrics struct {
+	exceeded *prometheus.CounterVec
+}
+
+func newCardinalityMetrics(reg prometheus.Registerer) *cardinalityMetrics {
+	m := &cardinalityMetrics{
+		exceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_cardinality_exceeded_total",
+				Help: "The total number of tenant queries whose selectors exceeded the series budget by action.",
+			},
+			[]string{"action"},
+		),
+	}
+	reg.MustRegister(m.exceeded)
+
+	return m
+}
+
+// checkCardinality asks the upstreams for the series of the rewritten selectors in the queried time range,
+// and rejects or warns if they exceed the series budget of the tenant.
+// The counts are cached, so that repeated dashboard refreshes do not double the load.
+func (c *apiContext) checkCardinality(hjkValue string, start, end time.Time) error {
+	if c.queryLimits == nil || c.queryLimits.MaxSeries <= 0 {
+		return nil
+	}
+	maxSeries := c.queryLimits.MaxSeries
+
+	hjkExpr, err := parser.ParseExpr(hjkValue)
+	if err != nil {
+		return errors.Annotate(err, "unable to parse rewritten query")
+	}
+
+	selectors := make(map[string]struct{})
+	parser.Inspect(hjkExpr, func(node parser.Node, _ []parser.Node) error {
+		if n, ok := node.(*parser.VectorSelector); ok {
+			selectors[(&parser.VectorSelector{LabelMatchers: n.LabelMatchers}).String()] = struct{}{}
+		}
+		return nil
+	})
+	if len(selectors) == 0 {
+		return nil
+	}
+	matches := make([]string, 0, len(selectors))
+	for selector := range selectors {
+		matches = append(matches, selector)
+	}
+	sort.Strings(matches)
+
+	// round the time range to share the counts between refreshes
+	minT, maxT := promql.FindMinMaxTime(&parser.EvalStmt{Expr: hjkExpr, Start: start, End: end, LookbackDelta: cardinalityLookbackDelta})
+	seriesStart := timestamp.Time(minT).Truncate(time.Minute)
+	seriesEnd := timestamp.Time(maxT).Truncate(time.Minute).Add(time.Minute)
+
+	ctx, span := startSpan(c.request.Context(), "check cardinality")
+	defer span.End()
+
+	cacheKey := fmt.Sprintf("%d-%d-%s", seriesStart.Unix(), seriesEnd.Unix(), strings.Join(matches, ","))
+	count, cached := c.cachedCardinality(cacheKey)
+	if !cached {
+		count = 0
+		failed := false
+		for _, up := range c.upstreams {
+			series, _, sErr := up.api.Series(ctx, matches, seriesStart, seriesEnd, promapiv1.WithLimit(uint64(maxSeries)+1))
+			if sErr != nil {
+				// the pre-check is best effort, the query itself reports the failures
+				log.Debugf("failed to check cardinality on upstream %s[%s]: %v", up.name, c.tag, sErr)
+				failed = true
+				continue
+			}
+			count += len(series)
+		}
+		// the partial counts are not cached, so that the next refresh checks again
+		if c.cardinalityCache != nil && !failed {
+			c.cardinalityCache.Add(cacheKey, count, c.cardinalityCacheTTL)
+		}
+	}
+	log.Debugf("cardinality[%s] => %d series (cached: %v)", c.tag, count, cached)
+	span.SetAttributes(attribute.Int("series", count), attribute.Bool("cached", cached))
+
+	if count <= maxSeries {
+		return nil
+	}
+
+	action := c.queryLimits.maxSeriesAction()
+	if c.cardinalityMetrics != nil {
+		c.cardinalityMetrics.exceeded.WithLabelValues(action).Inc()
+	}
+	msg := fmt.Sprintf("the query selects more than %d series, which exceeds the series budget", maxSeries)
+	if action == maxSeriesActionReject {
+		return c.shadow.deny(ruleMaxSeries, errors.New(msg+", try narrowing the selectors or the time range"))
+	}
+
+	c.warnings = append(c.warnings, msg)
+	return nil
+}
+
+func (c *apiContext) cachedCardinality(cacheKey string) (int, bool) {
+	if c.cardinalityCache == nil {
+		return 0, false
+	}
+
+	cached, exist := c.cardinalityCache.Get(cacheKey)
+	if !exist {
+		return 0, false
+	}
+	count, _ := cached.(int)
+	return count, true
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+func Test_checkCardinality(t *testing.T) {
+	var seriesCalls atomic.Int32
+	var seriesLimit atomic.Value
+	var seriesFailing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/series":
+			seriesCalls.Add(1)
+			if seriesFailing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "error", ErrorType: "unavailable", Error: "unavailable"})))
+				return
+			}
+			_ = r.ParseForm()
+			seriesLimit.Store(r.Form.Get("limit"))
+			_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "success", Data: []map[string]string{
+				{"__name__": "up", "namespace": "ns-a", "pod": "a"},
+				{"__name__": "up", "namespace": "ns-a", "pod": "b"},
+				{"__name__": "up", "namespace": "ns-a", "pod": "c"},
+			}})))
+		default:
+			_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "success", Data: map[string]interface{}{
+				"resultType": "vector", "result": []interface{}{},
+			}})))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	limits := &queryLimits{MaxSeries: 2}
+	agt.cfg.tenantLimits = &tenantLimitsConfig{Defaults: tenantLimits{QueryLimits: limits}}
+	agt.cfg.cardinalityCacheTTL = time.Minute
+	agt.cardinalityCache = cache.NewLRUExpireCache(cardinalityCacheSize)
+	agt.cardinalityMetrics = newCardinalityMetrics(agt.registry)
+	httpBackend := agt.httpBackend()
+
+	doQuery := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res
+	}
+	doRequest := func() *httptest.ResponseRecorder {
+		return doQuery("sum(rate(up[5m]))")
+	}
+
+	res := doRequest()
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	require.Contains(t, res.Body.String(), "exceeds the series budget")
+	require.Equal(t, "3", seriesLimit.Load())
+
+	// the repeated query is checked against the cached count
+	require.Equal(t, http.StatusBadRequest, doRequest().Code)
+	require.Equal(t, int32(1), seriesCalls.Load())
+	require.InDelta(t, 2, testutil.ToFloat64(agt.cardinalityMetrics.exceeded.WithLabelValues(maxSeriesActionReject)), 0)
+
+	t.Run("failed counts are not cached", func(t *testing.T) {
+		seriesCalls.Store(0)
+		seriesFailing.Store(true)
+		require.Equal(t, http.StatusOK, doQuery("sum(down)").Code)
+
+		seriesFailing.Store(false)
+		require.Equal(t, http.StatusBadRequest, doQuery("sum(down)").Code)
+		require.Equal(t, int32(2), seriesCalls.Load())
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		limits.MaxSeriesAction = maxSeriesActionWarn
+		res := doRequest()
+		require.Equal(t, http.StatusOK, res.Code)
+		var body jsonResponseData
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+		require.Equal(t, "success", body.Status)
+		require.Len(t, body.Warnings, 1)
+		require.Contains(t, body.Warnings[0], "exceeds the series budget")
+	})
+
+	t.Run("within budget", func(t *testing.T) {
+		limits.MaxSeries = 3
+		res := doRequest()
+		require.Equal(t, http.StatusOK, res.Code)
+		var body jsonResponseData
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+		require.Empty(t, body.Warnings)
+	})
+}
@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// configFileVersion is the only supported version of the config file.
+const configFileVersion = "v1"
+
+// urlPasswordRegexp matches the password in the user info of the URLs, including the ones within routes and sinks.
+var urlPasswordRegexp = regexp.MustCompile(`(://[^/@:\s,=]*):[^/@\s,=]*@`) //nolint:gochecknoglobals // compiled once
+
+// configFile is the content of the config file, in which each setting maps to the flag of its 'flag' tag.
+// The settings are pointers, so that the ones left out keep the values of the flags, even if they are zero.
+type configFile struct {
+	Version string          `yaml:"version"`
+	Log     logConfigFile   `yaml:"log,omitempty"`
+	Agent   agentConfigFile `yaml:"agent,omitempty"`
+	Kube    kubeConfigFile  `yaml:"kube,omitempty"`
+	Prom    promConfigFile  `yaml:"prom,omitempty"`
+}
+
+type logConfigFile struct {
+	JSON  *bool `yaml:"json,omitempty"  flag:"log.json"`
+	Debug *bool `yaml:"debug,omitempty" flag:"log.debug"`
+}
+
+type agentConfigFile struct {
+	ListenAddress        *string           `yaml:"listen_address,omitempty"         flag:"listen-address"`
+	AdminListenAddress   *string           `yaml:"admin_listen_address,omitempty"   flag:"admin-listen-address"`
+	EnableProfiling      *bool             `yaml:"enable_profiling,omitempty"       flag:"enable-profiling"`
+	TLSCertFile          *string           `yaml:"tls_cert_file,omitempty"          flag:"tls-cert-file"`
+	TLSKeyFile           *string           `yaml:"tls_key_file,omitempty"           flag:"tls-key-file"`
+	ReadTimeout          *time.Duration    `yaml:"read_timeout,omitempty"           flag:"read-timeout"`
+	ShutdownDelay        *time.Duration    `yaml:"shutdown_delay,omitempty"         flag:"shutdown-delay"`
+	ShutdownTimeout      *time.Duration    `yaml:"shutdown_timeout,omitempty"       flag:"shutdown-timeout"`
+	MaxConnections       *int              `yaml:"max_connections,omitempty"        flag:"max-connections"`
+	MaxConcurrentQueries *int              `yaml:"max_concurrent_queries,omitempty" flag:"max-concurrent-queries"`
+	FilterReaderLabels   []string          `yaml:"filter_reader_labels,omitempty"   flag:"filter-reader-labels"`
+	MetricNamesCacheTTL  *time.Duration    `yaml:"metric_names_cache_ttl,omitempty" flag:"metric-names-cache-ttl"`
+	CardinalityCacheTTL  *time.Duration    `yaml:"cardinality_cache_ttl,omitempty"  flag:"cardinality-cache-ttl"`
+	LimitsConfig         *string           `yaml:"limits_config,omitempty"          flag:"limits-config"`
+	NamespacesConfig     *string           `yaml:"namespaces_config,omitempty"      flag:"namespaces-config"`
+	ShadowRules          []string          `yaml:"shadow_rules,omitempty"           flag:"shadow-rule"`
+	Audit                auditConfigFile   `yaml:"audit,omitempty"`
+	Tracing              tracingConfigFile `yaml:"tracing,omitempty"`
+}
+
+type auditConfigFile struct {
+	Sinks          []string `yaml:"sinks,omitempty"            flag:"audit-sink"        redact:"url"`
+	FileMaxSize    *int     `yaml:"file_max_size,omitempty"    flag:"audit-file-max-size"`
+	FileMaxBackups *int     `yaml:"file_max_backups,omitempty" flag:"audit-file-max-backups"`
+	SampleRate     *float64 `yaml:"sample_rate,omitempty"      flag:"audit-sample-rate"`
+	Redact         []string `yaml:"redact,omitempty"           flag:"audit-redact"`
+}
+
+type tracingConfigFile struct {
+	Endpoint    *string  `yaml:"endpoint,omitempty"     flag:"tracing-endpoint"     redact:"url"`
+	SampleRatio *float64 `yaml:"sample_ratio,omitempty" flag:"tracing-sample-ratio"`
+}
+
+type kubeConfigFile struct {
+	TokenFile             *string        `yaml:"token_file,omitempty"              flag:"token-file"`
+	OIDCIssuer            *string        `yaml:"oidc_issuer,omitempty"             flag:"oidc-issuer"             redact:"url"`
+	ReviewCacheTTL        *time.Duration `yaml:"review_cache_ttl,omitempty"        flag:"review-cache-ttl"`
+	ReviewCacheSize       *int           `yaml:"review_cache_size,omitempty"       flag:"review-cache-size"`
+	SecretResyncPeriod    *time.Duration `yaml:"secret_resync_period,omitempty"    flag:"secret-resync-period"`
+	NamespaceResyncPeriod *time.Duration `yaml:"namespace_resync_period,omitempty" flag:"namespace-resync-period"`
+}
+
+type promConfigFile struct {
+	ProxyURL                    *string        `yaml:"proxy_url,omitempty"                      flag:"proxy-url"                      redact:"url"`
+	UpstreamMode                *string        `yaml:"upstream_mode,omitempty"                  flag:"upstream-mode"`
+	TenantHeader                *string        `yaml:"tenant_header,omitempty"                  flag:"tenant-header"`
+	TenantID                    *string        `yaml:"tenant_id,omitempty"                      flag:"tenant-id"`
+	UpstreamHealthCheckInterval *time.Duration `yaml:"upstream_health_check_interval,omitempty" flag:"upstream-health-check-interval"`
+	UpstreamClientConfig        *string        `yaml:"upstream_client_config,omitempty"         flag:"upstream-client-config"`
+	UpstreamDialTimeout         *time.Duration `yaml:"upstream_dial_timeout,omitempty"          flag:"upstream-dial-timeout"`
+	UpstreamIdleConnTimeout     *time.Duration `yaml:"upstream_idle_conn_timeout,omitempty"     flag:"upstream-idle-conn-timeout"`
+	UpstreamDisableKeepAlives   *bool          `yaml:"upstream_disable_keep_alives,omitempty"   flag:"upstream-disable-keep-alives"`
+	UpstreamRoutes              []string       `yaml:"upstream_routes,omitempty"                flag:"upstream-route"                 redact:"url"`
+	UpstreamFanOut              *bool          `yaml:"upstream_fan_out,omitempty"               flag:"upstream-fan-out"`
+	UpstreamReplicas            []string       `yaml:"upstream_replicas,omitempty"              flag:"upstream-replica"               redact:"url"`
+	DedupReplicaLabel           *string        `yaml:"dedup_replica_label,omitempty"            flag:"dedup-replica-label"`
+	PartialResponse             *string        `yaml:"partial_response,omitempty"               flag:"partial-response"`
+	GRPCUpstreams               []string       `yaml:"grpc_upstreams,omitempty"                 flag:"grpc-upstream"`
+	GRPCKeepAliveTime           *time.Duration `yaml:"grpc_keepalive_time,omitempty"            flag:"grpc-keepalive-time"`
+	GRPCKeepAliveTimeout        *time.Duration `yaml:"grpc_keepalive_timeout,omitempty"         flag:"grpc-keepalive-timeout"`
+}
+
+// ApplyConfigFile loads the config file of the '--config-file' flag if it is set, and applies its settings
+// to the flags which are set neither on the command line nor by their environment variables.
+func ApplyConfigFile(cliContext *cli.Context) error {
+	path := cliContext.String("config-file")
+	if len(path) == 0 {
+		return nil
+	}
+
+	cfgFile, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	return errors.Annotatef(cfgFile.applyTo(cliContext), "invalid config file %q", path)
+}
+
+// loadConfigFile loads the config file.
+func loadConfigFile(path string) (*configFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read config file %q", path)
+	}
+
+	cfgFile := &configFile{}
+	if err = yaml.UnmarshalStrict(content, cfgFile); err != nil {
+		return nil, errors.Annotatef(err, "invalid config file %q", path)
+	}
+	if cfgFile.Version != configFileVersion {
+		return nil, errors.Errorf("invalid config file %q: unsupported version %q, expected %q", path, cfgFile.Version, configFileVersion)
+	}
+
+	return cfgFile, nil
+}
+
+// applyTo sets the flags of the settings in the file, unless they are set already.
+func (c *configFile) applyTo(cliContext *cli.Context) error {
+	return walkConfigFile(reflect.ValueOf(c).Elem(), func(name string, field reflect.Value, _ reflect.StructField) error {
+		if field.IsNil() || cliContext.GlobalIsSet(name) {
+			return nil
+		}
+
+		for _, value := range formatFlagValues(field) {
+			if err := cliContext.GlobalSet(name, value); err != nil {
+				return errors.Annotatef(err, "invalid value %q of %s", value, name)
+			}
+		}
+
+		return nil
+	})
+}
+
+// newEffectiveConfigFile reads the flags into a config file, with the passwords of the URLs redacted.
+func newEffectiveConfigFile(cliContext *cli.Context) *configFile {
+	cfgFile := &configFile{Version: configFileVersion}
+	_ = walkConfigFile(reflect.ValueOf(cfgFile).Elem(), func(name string, field reflect.Value, structField reflect.StructField) error {
+		redact := structField.Tag.Get("redact") == "url"
+
+		if field.Kind() == reflect.Slice {
+			// copied, since the flag keeps the slice
+			values := append([]string(nil), cliContext.GlobalStringSlice(name)...)
+			if redact {
+				for i := range values {
+					values[i] = redactURLs(values[i])
+				}
+			}
+			if len(values) != 0 {
+				field.Set(reflect.ValueOf(values))
+			}
+			return nil
+		}
+
+		value := reflect.New(field.Type().Elem())
+		switch ptr := value.Interface().(type) {
+		case *string:
+			*ptr = cliContext.GlobalString(name)
+			if redact {
+				*ptr = redactURLs(*ptr)
+			}
+		case *bool:
+			*ptr = cliContext.GlobalBool(name)
+		case *int:
+			*ptr = cliContext.GlobalInt(name)
+		case *float64:
+			*ptr = cliContext.GlobalFloat64(name)
+		case *time.Duration:
+			*ptr = cliContext.GlobalDuration(name)
+		}
+		field.Set(value)
+
+		return nil
+	})
+
+	return cfgFile
+}
+
+// walkConfigFile calls the function with the settings of the config file by the names of their flags.
+func walkConfigFile(v reflect.Value, fn func(name string, field reflect.Value, structField reflect.StructField) error) error {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := walkConfigFile(field, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if name := structField.Tag.Get("flag"); len(name) != 0 {
+			if err := fn(name, field, structField); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// formatFlagValues formats the setting as flag values, which are several for the repeatable flags.
+func formatFlagValues(field reflect.Value) []string {
+	switch value := field.Interface().(type) {
+	case *string:
+		return []string{*value}
+	case *bool:
+		return []string{strconv.FormatBool(*value)}
+	case *int:
+		return []string{strconv.Itoa(*value)}
+	case *float64:
+		return []string{strconv.FormatFloat(*value, 'g', -1, 64)}
+	case *time.Duration:
+		return []string{value.String()}
+	case []string:
+		return value
+	}
+
+	return nil
+}
+
+// redactURLs hides the passwords of the URLs within the value.
+func redactURLs(value string) string {
+	return urlPasswordRegexp.ReplaceAllString(value, "$1:<secret>@")
+}
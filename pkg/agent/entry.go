@@ -2,62 +2,178 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
-	_ "net/http/pprof" //nolint:gosec // enable pprof for debugging
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/config"
 
+	"github.com/caas-team/prometheus-auth/pkg/audit"
 	"github.com/caas-team/prometheus-auth/pkg/data"
 	"github.com/caas-team/prometheus-auth/pkg/kube"
 	"github.com/cockroachdb/cmux"
 	"github.com/juju/errors"
-	promapi "github.com/prometheus/client_golang/api"
-	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
 	authentication "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-func Run(cliContext *cli.Context) {
-	// enable profiler if debug is active
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil)) //nolint:gosec // TODO: set profiler behind a flag
-	}()
+const metricNamesCacheSize = 1024
+
+const (
+	// upstreamModeRewrite injects the owned namespaces into the queries.
+	upstreamModeRewrite = "rewrite"
+	// upstreamModeTenantHeader forwards the queries unchanged, but sets the tenant header,
+	// which is used by natively multi-tenant stores like Thanos, Cortex or Mimir.
+	upstreamModeTenantHeader = "tenant-header"
+
+	tenantIDSourceProject    = "project"
+	tenantIDSourceNamespaces = "namespaces"
+)
 
+func Run(cliContext *cli.Context) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	cfg := &agentConfig{
 		ctx:                  ctx,
+		cancel:               cancel,
 		listenAddress:        cliContext.String("listen-address"),
+		adminListenAddress:   cliContext.String("admin-listen-address"),
+		profiling:            cliContext.Bool("enable-profiling"),
+		tlsCertFile:          cliContext.String("tls-cert-file"),
+		tlsKeyFile:           cliContext.String("tls-key-file"),
 		readTimeout:          cliContext.Duration("read-timeout"),
+		shutdownDelay:        cliContext.Duration("shutdown-delay"),
+		shutdownTimeout:      cliContext.Duration("shutdown-timeout"),
 		maxConnections:       cliContext.Int("max-connections"),
+		maxConcurrentQueries: cliContext.Int("max-concurrent-queries"),
 		filterReaderLabelSet: data.NewSet(cliContext.StringSlice("filter-reader-labels")...),
+		metricNamesCacheTTL:  cliContext.Duration("metric-names-cache-ttl"),
+	}
+
+	if len(cfg.adminListenAddress) == 0 {
+		log.Panic("--admin-listen-address is blank")
 	}
 
 	proxyURLString := cliContext.String("proxy-url")
 	if len(proxyURLString) == 0 {
 		log.Panic("--agent.proxy-url is blank")
 	}
-	proxyURL, err := url.Parse(proxyURLString)
+	proxyURLs, err := parseURLs(proxyURLString)
 	if err != nil {
-		log.Panic("Unable to parse agent.proxy-url")
+		log.WithError(err).Panic("Unable to parse agent.proxy-url")
+	}
+	cfg.proxyURLs = proxyURLs
+	cfg.upstreamHealthCheckInterval = cliContext.Duration("upstream-health-check-interval")
+	cfg.upstreamDialTimeout = cliContext.Duration("upstream-dial-timeout")
+	cfg.upstreamIdleConnTimeout = cliContext.Duration("upstream-idle-conn-timeout")
+	cfg.upstreamKeepAlivesDisabled = cliContext.Bool("upstream-disable-keep-alives")
+	cfg.grpcUpstreamTargets = cliContext.StringSlice("grpc-upstream")
+	cfg.grpcKeepAliveTime = cliContext.Duration("grpc-keepalive-time")
+	cfg.grpcKeepAliveTimeout = cliContext.Duration("grpc-keepalive-timeout")
+
+	cfg.upstreamClientConfig = config.DefaultHTTPClientConfig
+	if clientConfigPath := cliContext.String("upstream-client-config"); len(clientConfigPath) != 0 {
+		if cfg.upstreamClientConfig, err = loadUpstreamClientConfig(clientConfigPath); err != nil {
+			log.WithError(err).Panic("Unable to load --upstream-client-config")
+		}
+	}
+	cfg.upstreamRoutes = cliContext.StringSlice("upstream-route")
+	cfg.upstreamFanOut = cliContext.Bool("upstream-fan-out")
+	cfg.upstreamReplicas = cliContext.StringSlice("upstream-replica")
+	cfg.dedupReplicaLabel = cliContext.String("dedup-replica-label")
+
+	if limitsConfigPath := cliContext.String("limits-config"); len(limitsConfigPath) != 0 {
+		if cfg.tenantLimits, err = loadTenantLimitsConfig(limitsConfigPath); err != nil {
+			log.WithError(err).Panic("Unable to load --limits-config")
+		}
+	}
+
+	if namespacesConfigPath := cliContext.String("namespaces-config"); len(namespacesConfigPath) != 0 {
+		if cfg.namespacesMapping, err = loadNamespacesMapping(namespacesConfigPath); err != nil {
+			log.WithError(err).Panic("Unable to load --namespaces-config")
+		}
+	}
+
+	cfg.cardinalityCacheTTL = cliContext.Duration("cardinality-cache-ttl")
+
+	cfg.shadowRules = cliContext.StringSlice("shadow-rule")
+	if err = validateShadowRules(cfg.shadowRules); err != nil {
+		log.WithError(err).Panic("Invalid --shadow-rule")
+	}
+
+	cfg.audit = audit.Config{
+		Sinks:          cliContext.StringSlice("audit-sink"),
+		FileMaxSize:    int64(cliContext.Int("audit-file-max-size")) * 1024 * 1024,
+		FileMaxBackups: cliContext.Int("audit-file-max-backups"),
+		SampleRate:     cliContext.Float64("audit-sample-rate"),
+		Redact:         cliContext.StringSlice("audit-redact"),
+	}
+
+	cfg.tracingEndpoint = cliContext.String("tracing-endpoint")
+	cfg.tracingSampleRatio = cliContext.Float64("tracing-sample-ratio")
+	if cfg.tracingSampleRatio < 0 || cfg.tracingSampleRatio > 1 {
+		log.Panicf("--tracing-sample-ratio %v is not between 0 and 1", cfg.tracingSampleRatio)
+	}
+
+	cfg.partialResponse = cliContext.String("partial-response")
+	if cfg.partialResponse != partialResponseWarn && cfg.partialResponse != partialResponseAbort {
+		log.Panicf("Unknown --partial-response %q", cfg.partialResponse)
+	}
+
+	cfg.upstreamMode = cliContext.String("upstream-mode")
+	switch cfg.upstreamMode {
+	case upstreamModeRewrite:
+	case upstreamModeTenantHeader:
+		cfg.tenantHeader = cliContext.String("tenant-header")
+		if len(cfg.tenantHeader) == 0 {
+			log.Panic("--tenant-header is blank")
+		}
+
+		cfg.tenantIDSource = cliContext.String("tenant-id")
+		if cfg.tenantIDSource != tenantIDSourceProject && cfg.tenantIDSource != tenantIDSourceNamespaces {
+			log.Panicf("Unknown --tenant-id %q", cfg.tenantIDSource)
+		}
+
+		// the responses are proxied unchanged, so they cannot be merged
+		if cfg.upstreamFanOut {
+			log.Panic("--upstream-fan-out is not supported in 'tenant-header' upstream mode")
+		}
+	default:
+		log.Panicf("Unknown --upstream-mode %q", cfg.upstreamMode)
+	}
+
+	cfg.kube = kube.Config{
+		ReviewCacheTTL:        cliContext.Duration("review-cache-ttl"),
+		ReviewCacheSize:       cliContext.Int("review-cache-size"),
+		SecretResyncPeriod:    cliContext.Duration("secret-resync-period"),
+		NamespaceResyncPeriod: cliContext.Duration("namespace-resync-period"),
+	}
+	if err = cfg.kube.Validate(); err != nil {
+		log.WithError(err).Panic("Invalid kube config")
 	}
-	cfg.proxyURL = proxyURL
 
-	accessTokenPath := "/var/run/secrets/kubernetes.io/serviceaccount/token" //nolint: gosec // read token from file
+	accessTokenPath := cliContext.String("token-file")
 	accessTokenBytes, err := os.ReadFile(accessTokenPath)
 	if err != nil {
 		log.WithError(err).Panicf("Failed to read token file %q", accessTokenPath)
@@ -77,6 +193,8 @@ func Run(cliContext *cli.Context) {
 		cfg.oidcIssuer = oidcURL.String()
 	}
 
+	cfg.effectiveConfig = newEffectiveConfigFile(cliContext)
+
 	log.Println(cfg)
 
 	reader, err := createAgent(context.Background(), cfg)
@@ -84,58 +202,166 @@ func Run(cliContext *cli.Context) {
 		log.WithError(err).Panic("Failed to create agent")
 	}
 
-	if err = reader.serve(); err != nil {
+	shutdown, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err = reader.serve(shutdown); err != nil {
 		log.WithError(err).Panic("Failed to serve")
 	}
 }
 
 type agentConfig struct {
 	ctx                  context.Context
+	cancel               context.CancelFunc
 	myToken              string
 	listenAddress        string
-	proxyURL             *url.URL
+	adminListenAddress   string
+	profiling            bool
+	tlsCertFile          string
+	tlsKeyFile           string
+	proxyURLs            []*url.URL
 	readTimeout          time.Duration
+	shutdownDelay        time.Duration
+	shutdownTimeout      time.Duration
 	maxConnections       int
 	filterReaderLabelSet data.Set
 	oidcIssuer           string
+	metricNamesCacheTTL  time.Duration
+	upstreamMode         string
+	tenantHeader         string
+	tenantIDSource       string
+	upstreamRoutes       []string
+	upstreamReplicas     []string
+	dedupReplicaLabel    string
+	upstreamFanOut       bool
+	partialResponse      string
+	tenantLimits         *tenantLimitsConfig
+	namespacesMapping    *namespacesMapping
+	maxConcurrentQueries int
+	cardinalityCacheTTL  time.Duration
+	audit                audit.Config
+	shadowRules          []string
+	tracingEndpoint      string
+	tracingSampleRatio   float64
+	kube                 kube.Config
+	// effectiveConfig is the config resolved from the file, the environment variables and the flags, redacted.
+	effectiveConfig *configFile
+
+	upstreamHealthCheckInterval time.Duration
+	upstreamClientConfig        config.HTTPClientConfig
+	upstreamDialTimeout         time.Duration
+	upstreamIdleConnTimeout     time.Duration
+	upstreamKeepAlivesDisabled  bool
+	grpcUpstreamTargets         []string
+	grpcKeepAliveTime           time.Duration
+	grpcKeepAliveTimeout        time.Duration
 }
 
 func (a *agentConfig) String() string {
 	sb := &strings.Builder{}
 
 	_, _ = fmt.Fprint(sb, "listening on ", a.listenAddress)
-	_, _ = fmt.Fprint(sb, ", proxying to ", a.proxyURL.String())
+	if len(a.tlsCertFile) != 0 {
+		sb.WriteString(" with TLS")
+	}
+	_, _ = fmt.Fprint(sb, ", serving the admin endpoints on ", a.adminListenAddress)
+	if a.profiling {
+		sb.WriteString(" with profiling")
+	}
+	_, _ = fmt.Fprint(sb, ", proxying to ", joinURLs(a.proxyURLs))
+	if len(a.upstreamClientConfig.TLSConfig.CAFile) != 0 || len(a.upstreamClientConfig.TLSConfig.CertFile) != 0 {
+		sb.WriteString(" over TLS")
+	}
+	if hasUpstreamCredentials(&a.upstreamClientConfig) {
+		sb.WriteString(" with credentials")
+	}
+	if len(a.upstreamRoutes) != 0 {
+		_, _ = fmt.Fprintf(sb, " and routing [%s]", strings.Join(a.upstreamRoutes, ","))
+	}
+	if len(a.upstreamReplicas) != 0 {
+		_, _ = fmt.Fprintf(sb, " with HA replicas [%s] deduplicated by label %q", strings.Join(a.upstreamReplicas, ","), a.dedupReplicaLabel)
+	}
+	if a.upstreamFanOut {
+		_, _ = fmt.Fprintf(sb, " with fanning out to all matching routes (%s on partial responses)", a.partialResponse)
+	}
+	if a.upstreamMode == upstreamModeTenantHeader {
+		_, _ = fmt.Fprintf(sb, " with the %s tenant ID in header %q", a.tenantIDSource, a.tenantHeader)
+	}
 	_, _ = fmt.Fprintf(sb, " with ignoring 'remote reader' labels [%s]", a.filterReaderLabelSet)
 	_, _ = fmt.Fprintf(sb, ", only allow maximum %d connections with %v read timeout", a.maxConnections, a.readTimeout)
+	_, _ = fmt.Fprintf(sb, ", draining for %v after %v on shutdown", a.shutdownTimeout, a.shutdownDelay)
+	if a.maxConcurrentQueries > 0 {
+		_, _ = fmt.Fprintf(sb, " and %d queries in flight", a.maxConcurrentQueries)
+	}
+	if a.metricNamesCacheTTL > 0 {
+		_, _ = fmt.Fprintf(sb, ", caching metric names for %v", a.metricNamesCacheTTL)
+	}
+	if a.tenantLimits != nil {
+		_, _ = fmt.Fprintf(sb, ", limiting %d tenants beyond the defaults", len(a.tenantLimits.Tenants))
+	}
+	if a.namespacesMapping != nil {
+		_, _ = fmt.Fprintf(sb, ", mapping the namespaces of %d projects and %d users", len(a.namespacesMapping.Projects), len(a.namespacesMapping.Users))
+	}
+	if len(a.shadowRules) != 0 {
+		_, _ = fmt.Fprintf(sb, ", only reporting the denials of [%s]", strings.Join(a.shadowRules, ","))
+	}
+	if len(a.audit.Sinks) != 0 {
+		_, _ = fmt.Fprintf(sb, ", auditing %v of the requests to [%s]", a.audit.SampleRate, strings.Join(a.audit.Sinks, ","))
+	}
+	if len(a.tracingEndpoint) != 0 {
+		_, _ = fmt.Fprintf(sb, ", tracing %v of the requests to %s", a.tracingSampleRatio, a.tracingEndpoint)
+	}
 	sb.WriteString(" .")
 
 	return sb.String()
 }
 
 type agent struct {
-	cfg        *agentConfig
-	userInfo   authentication.UserInfo
-	listener   net.Listener
-	namespaces kube.Namespaces
-	tokens     kube.Tokens
-	remoteAPI  promapiv1.API
-	registry   *prometheus.Registry
+	cfg                *agentConfig
+	userInfo           authentication.UserInfo
+	listener           net.Listener
+	adminListener      net.Listener
+	namespaces         kube.Namespaces
+	tokens             kube.Tokens
+	upstreams          *upstreams
+	grpcUpstreams      *grpcUpstreamPool
+	grpcMetrics        *grpcStreamMetrics
+	rateLimiter        *tenantRateLimiter
+	scheduler          *fairScheduler
+	complexityMetrics  *queryComplexityMetrics
+	cardinalityCache   *cache.LRUExpireCache
+	cardinalityMetrics *cardinalityMetrics
+	registry           *prometheus.Registry
+	metricNamesCache   *cache.LRUExpireCache
+	auditLogger        *audit.Logger
+	shadowMetrics      *shadowMetrics
+	requestMetrics     *requestMetrics
+	tracerProvider     *sdktrace.TracerProvider
+	inFlight           inFlightRequests
+	shuttingDown       atomic.Bool
 }
 
-func (a *agent) serve() error {
+// serve serves the connections until it fails, or the shutdown context is done by a signal.
+func (a *agent) serve(shutdown context.Context) error {
 	listenerMux := cmux.New(a.listener)
-	httpProxy := a.createHTTPProxy()
 	grpcProxy := a.createGRPCProxy()
+	httpProxy := a.createHTTPProxy(grpcProxy)
+	adminServer := a.createAdminServer()
+	// the listener must be matched before the multiplexer accepts connections
+	httpListener := createHTTPListener(listenerMux)
 
-	errCh := make(chan error)
+	// buffered, since all goroutines fail once the listeners are closed on shutdown
+	errCh := make(chan error, 3)
 	go func() {
-		if err := httpProxy.Serve(createHTTPListener(listenerMux)); err != nil {
-			errCh <- errors.Annotate(err, "failed to start proxy http listener")
+		log.Infof("Start listening for admin connections on %s", a.cfg.adminListenAddress)
+
+		if err := adminServer.Serve(a.adminListener); err != nil {
+			errCh <- errors.Annotatef(err, "failed to listen on admin address %s", a.cfg.adminListenAddress)
 		}
 	}()
 	go func() {
-		if err := grpcProxy.Serve(createGRPCListener(listenerMux, a.cfg.myToken)); err != nil {
-			errCh <- errors.Annotate(err, "failed to start proxy grpc listener")
+		if err := httpProxy.Serve(httpListener); err != nil {
+			errCh <- errors.Annotate(err, "failed to start proxy http listener")
 		}
 	}()
 	go func() {
@@ -149,12 +375,8 @@ func (a *agent) serve() error {
 	select {
 	case err := <-errCh:
 		return err
-	case <-a.cfg.ctx.Done():
-		grpcProxy.GracefulStop()
-		err := httpProxy.Shutdown(a.cfg.ctx)
-		if err != nil {
-			log.Warnf("Error shuting down httproxy: %v", err)
-		}
+	case <-shutdown.Done():
+		a.shutdown(httpProxy, grpcProxy, adminServer)
 		return nil
 	}
 }
@@ -187,7 +409,23 @@ func createAgent(_ context.Context, cfg *agentConfig) (*agent, error) {
 	if err != nil {
 		return nil, errors.Annotatef(err, "unable to listen on addr %s", cfg.listenAddress)
 	}
-	listener = netutil.LimitListener(listener, cfg.maxConnections)
+	if cfg.maxConnections > 0 {
+		listener = netutil.LimitListener(listener, cfg.maxConnections)
+	}
+	if len(cfg.tlsCertFile) != 0 {
+		tlsConfig, tErr := newListenerTLSConfig(cfg.tlsCertFile, cfg.tlsKeyFile)
+		if tErr != nil {
+			_ = listener.Close()
+			return nil, tErr
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	// the admin listener is neither limited nor encrypted, since it is not exposed to the tenants
+	adminListener, err := net.Listen("tcp", cfg.adminListenAddress)
+	if err != nil {
+		_ = listener.Close()
+		return nil, errors.Annotatef(err, "unable to listen on admin addr %s", cfg.adminListenAddress)
+	}
 
 	// create Kubernetes client
 	k8sConfig, err := rest.InClusterConfig()
@@ -199,35 +437,90 @@ func createAgent(_ context.Context, cfg *agentConfig) (*agent, error) {
 		return nil, errors.Annotate(err, "unable to new Kubernetes clientSet")
 	}
 
-	// create Prometheus client
-	promClient, err := promapi.NewClient(promapi.Config{
-		Address: cfg.proxyURL.String(),
-	})
+	// create Prometheus upstreams
+	upstreams, err := newUpstreams(cfg, registry)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create Prometheus upstreams")
+	}
+	if cfg.upstreamHealthCheckInterval > 0 {
+		upstreams.startHealthChecks(cfg.ctx, cfg.upstreamHealthCheckInterval)
+	}
+	grpcUpstreams, err := newGRPCUpstreamPool(cfg.ctx, cfg, registry)
 	if err != nil {
-		return nil, errors.Annotate(err, "unable to new Prometheus client")
+		return nil, errors.Annotate(err, "unable to create gRPC upstreams")
 	}
 
 	// create tokens client and get userInfo
-	tokens := kube.NewTokens(cfg.ctx, k8sClient)
+	tokens := kube.NewTokens(cfg.ctx, k8sClient, cfg.kube, registry)
 	userInfo, err := tokens.Authenticate(cfg.myToken)
 	if err != nil {
 		return nil, errors.Annotate(err, "unable to get userInfo from agent token")
 	}
 
+	// create metric names cache, only if enabled
+	var metricNamesCache *cache.LRUExpireCache
+	if cfg.metricNamesCacheTTL > 0 {
+		metricNamesCache = cache.NewLRUExpireCache(metricNamesCacheSize)
+	}
+
+	var cardinalityCache *cache.LRUExpireCache
+	if cfg.cardinalityCacheTTL > 0 {
+		cardinalityCache = cache.NewLRUExpireCache(cardinalityCacheSize)
+	}
+
+	var auditLogger *audit.Logger
+	if len(cfg.audit.Sinks) != 0 {
+		if auditLogger, err = audit.New(cfg.audit, registry); err != nil {
+			return nil, errors.Annotate(err, "unable to create audit log")
+		}
+	}
+
+	tracerProvider, err := newTracerProvider(cfg.ctx, cfg)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create tracing")
+	}
+
+	var rateLimiter *tenantRateLimiter
+	if cfg.tenantLimits != nil {
+		rateLimiter = newTenantRateLimiter(cfg.tenantLimits, registry)
+	}
+	var scheduler *fairScheduler
+	if cfg.maxConcurrentQueries > 0 || (cfg.tenantLimits != nil && cfg.tenantLimits.hasConcurrencyLimits()) {
+		scheduler = newFairScheduler(cfg.tenantLimits, cfg.maxConcurrentQueries, registry)
+	}
+
 	return &agent{
-		cfg:        cfg,
-		userInfo:   userInfo,
-		listener:   listener,
-		namespaces: kube.NewNamespaces(cfg.ctx, k8sClient, cfg.oidcIssuer, registry),
-		tokens:     tokens,
-		remoteAPI:  promapiv1.NewAPI(promClient),
-		registry:   registry,
+		cfg:                cfg,
+		userInfo:           userInfo,
+		listener:           listener,
+		adminListener:      adminListener,
+		namespaces:         kube.NewNamespaces(cfg.ctx, k8sClient, cfg.oidcIssuer, cfg.kube, registry),
+		tokens:             tokens,
+		upstreams:          upstreams,
+		grpcUpstreams:      grpcUpstreams,
+		grpcMetrics:        newGRPCStreamMetrics(registry),
+		rateLimiter:        rateLimiter,
+		scheduler:          scheduler,
+		complexityMetrics:  newQueryComplexityMetrics(registry),
+		cardinalityCache:   cardinalityCache,
+		cardinalityMetrics: newCardinalityMetrics(registry),
+		registry:           registry,
+		metricNamesCache:   metricNamesCache,
+		auditLogger:        auditLogger,
+		shadowMetrics:      newShadowMetrics(registry),
+		requestMetrics:     newRequestMetrics(registry),
+		tracerProvider:     tracerProvider,
 	}, nil
 }
 
-func (a *agent) createHTTPProxy() *http.Server {
+func (a *agent) createHTTPProxy(grpcProxy *grpc.Server) *http.Server {
+	// HTTP/2 is served by the h2c handler, both in cleartext and behind TLS,
+	// since the connections are already terminated by the listener
 	return &http.Server{
-		Handler:     a.httpBackend(),
+		Handler: h2c.NewHandler(
+			a.inFlight.handler(grpcDispatchHandler(grpcProxy, a.httpBackend())),
+			&http2.Server{IdleTimeout: a.cfg.readTimeout},
+		),
 		ReadTimeout: a.cfg.readTimeout,
 	}
 }
@@ -2,19 +2,163 @@ package agent
 
 import (
 	"context"
+	"strings"
 
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/caas-team/prometheus-auth/pkg/kube"
+	"github.com/caas-team/prometheus-auth/pkg/prom"
+	"github.com/juju/errors"
 	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
+	"github.com/prometheus/prometheus/prompb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// the methods of the Thanos StoreAPI, which the tenants are allowed to call
+const (
+	grpcMethodStoreInfo        = "/thanos.Store/Info"
+	grpcMethodStoreSeries      = "/thanos.Store/Series"
+	grpcMethodStoreLabelNames  = "/thanos.Store/LabelNames"
+	grpcMethodStoreLabelValues = "/thanos.Store/LabelValues"
 )
 
 func (a *agent) grpcBackend() grpc.StreamHandler {
-	return grpcproxy.TransparentHandler(func(ctx context.Context, _ string) (context.Context, *grpc.ClientConn, error) {
-		con, err := grpc.NewClient(a.cfg.proxyURL.String())
+	proxyHandler := grpcproxy.TransparentHandler(func(ctx context.Context, _ string) (context.Context, *grpc.ClientConn, error) {
+		con, err := a.grpcUpstreams.conn()
 		if err != nil {
-			return ctx, nil, status.Errorf(codes.Unavailable, "Unavailable endpoint")
+			return ctx, nil, err
 		}
 		return ctx, con, nil
 	})
+
+	return a.grpcMetrics.instrument(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+
+		accessToken := grpcAccessToken(stream.Context())
+		if len(accessToken) == 0 {
+			return status.Error(codes.Unauthenticated, "no access token provided")
+		}
+
+		userInfo, err := a.tokens.Authenticate(accessToken)
+		if err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		// direct proxy
+		if kube.MatchingUsers(a.userInfo, userInfo) {
+			return proxyHandler(srv, stream)
+		}
+
+		var matchersField protowire.Number
+		switch method {
+		case grpcMethodStoreInfo:
+			return proxyHandler(srv, stream)
+		case grpcMethodStoreSeries:
+			matchersField = 3
+		case grpcMethodStoreLabelNames:
+			matchersField = 6
+		case grpcMethodStoreLabelValues:
+			matchersField = 7
+		default:
+			return status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+		}
+
+		if !a.namespaces.HasSynced() {
+			return status.Error(codes.Unavailable, errNamespacesUnsynced.Error())
+		}
+
+		projectID, namespaceSet := a.namespaces.Resolve(accessToken)
+		shadow := a.shadowing(a.limitsTenant(projectID, namespaceSet), nil, method)
+
+		return proxyHandler(srv, &tenantServerStream{
+			ServerStream:  stream,
+			namespaceSet:  shadow.namespaces(a.cfg.namespacesMapping, projectID, userInfo.Username, namespaceSet),
+			matchersField: matchersField,
+		})
+	})
+}
+
+func grpcAccessToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get(authorizationHeaderKey) {
+		if token, found := strings.CutPrefix(value, "Bearer "); found {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// tenantServerStream injects the namespace matcher into the requests received from a tenant.
+type tenantServerStream struct {
+	grpc.ServerStream
+	namespaceSet  data.Set
+	matchersField protowire.Number
+}
+
+func (s *tenantServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	// the proxy receives the raw requests as unknown fields of an empty message
+	frame, ok := m.(*emptypb.Empty)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+
+	raw, err := injectNamespaceMatcher(frame.ProtoReflect().GetUnknown(), s.matchersField, s.namespaceSet)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	frame.ProtoReflect().SetUnknown(raw)
+
+	return nil
+}
+
+// injectNamespaceMatcher rewrites the label matchers in the given field of a raw request,
+// which have the same wire format as the matchers of the remote read API.
+func injectNamespaceMatcher(raw []byte, matchersField protowire.Number, namespaceSet data.Set) ([]byte, error) {
+	ret := make([]byte, 0, len(raw))
+	var matchers []*prompb.LabelMatcher
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		valueLen := protowire.ConsumeFieldValue(num, typ, raw[n:])
+		if valueLen < 0 {
+			return nil, protowire.ParseError(valueLen)
+		}
+
+		if num == matchersField && typ == protowire.BytesType {
+			value, _ := protowire.ConsumeBytes(raw[n:])
+
+			matcher := &prompb.LabelMatcher{}
+			if err := matcher.Unmarshal(value); err != nil {
+				return nil, errors.Annotate(err, "unable to unmarshal label matcher")
+			}
+			matchers = append(matchers, matcher)
+		} else {
+			ret = append(ret, raw[:n+valueLen]...)
+		}
+
+		raw = raw[n+valueLen:]
+	}
+
+	for _, matcher := range prom.FilterLabelMatchers(namespaceSet, matchers) {
+		value, err := matcher.Marshal()
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to marshal label matcher")
+		}
+
+		ret = protowire.AppendTag(ret, matchersField, protowire.BytesType)
+		ret = protowire.AppendBytes(ret, value)
+	}
+
+	return ret, nil
 }
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// grpcUpstreamPool keeps one connection per gRPC upstream target,
+// the streams are proxied to the first ready target and fail over to the others.
+type grpcUpstreamPool struct {
+	conns []*grpc.ClientConn
+	up    *prometheus.GaugeVec
+}
+
+func newGRPCUpstreamPool(ctx context.Context, cfg *agentConfig, reg prometheus.Registerer) (*grpcUpstreamPool, error) {
+	dialOpts, err := newGRPCDialOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:    cfg.grpcKeepAliveTime,
+		Timeout: cfg.grpcKeepAliveTimeout,
+	}))
+
+	targets := cfg.grpcUpstreamTargets
+	if len(targets) == 0 {
+		for _, u := range cfg.proxyURLs {
+			targets = append(targets, u.Host)
+		}
+	}
+
+	pool := &grpcUpstreamPool{
+		conns: make([]*grpc.ClientConn, 0, len(targets)),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "prometheus_auth_grpc_upstream_up",
+				Help: "Whether the connection to the gRPC upstream is ready.",
+			},
+			[]string{"target"},
+		),
+	}
+	reg.MustRegister(pool.up)
+
+	for _, target := range targets {
+		conn, cErr := grpc.NewClient(target, dialOpts...)
+		if cErr != nil {
+			pool.close()
+			return nil, errors.Annotatef(cErr, "unable to create gRPC client for %s", target)
+		}
+		pool.conns = append(pool.conns, conn)
+	}
+
+	for idx, conn := range pool.conns {
+		go pool.watch(ctx, conn, pool.up.WithLabelValues(targets[idx]))
+	}
+
+	return pool, nil
+}
+
+// watch connects eagerly and tracks the state of the connection, until the context is done,
+// which closes the connection.
+func (p *grpcUpstreamPool) watch(ctx context.Context, conn *grpc.ClientConn, up prometheus.Gauge) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.WithError(err).Warnf("failed to close gRPC upstream %s", conn.Target())
+		}
+	}()
+
+	conn.Connect()
+	state := conn.GetState()
+	for {
+		if state == connectivity.Ready {
+			up.Set(1)
+		} else {
+			up.Set(0)
+		}
+		// reconnect idle connections right away instead of on the next stream
+		if state == connectivity.Idle {
+			conn.Connect()
+		}
+
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+
+		newState := conn.GetState()
+		log.Debugf("gRPC upstream %s changed from %s to %s", conn.Target(), state, newState)
+		state = newState
+	}
+}
+
+// conn returns the connection of the first ready target,
+// otherwise the first one which is not failing, to let gRPC wait for it.
+func (p *grpcUpstreamPool) conn() (*grpc.ClientConn, error) {
+	var fallback *grpc.ClientConn
+	for _, conn := range p.conns {
+		switch conn.GetState() {
+		case connectivity.Ready:
+			return conn, nil
+		case connectivity.Idle, connectivity.Connecting:
+			if fallback == nil {
+				fallback = conn
+			}
+		case connectivity.TransientFailure, connectivity.Shutdown:
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+	if len(p.conns) != 0 {
+		// all are failing, gRPC returns the last connection error
+		return p.conns[0], nil
+	}
+
+	return nil, status.Error(codes.Unavailable, "no gRPC upstream")
+}
+
+func (p *grpcUpstreamPool) close() {
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+// grpcStreamMetrics records the duration and the result of the proxied streams.
+type grpcStreamMetrics struct {
+	streams  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newGRPCStreamMetrics(reg prometheus.Registerer) *grpcStreamMetrics {
+	m := &grpcStreamMetrics{
+		streams: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_grpc_streams_total",
+				Help: "The total number of proxied gRPC streams by method and status code.",
+			},
+			[]string{"method", "code"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "prometheus_auth_grpc_stream_duration_seconds",
+				Help:    "The duration of the proxied gRPC streams by method.",
+				Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 30, 120, 600, 3600}, //nolint:mnd // buckets up to long-running streams
+			},
+			[]string{"method"},
+		),
+	}
+	reg.MustRegister(m.streams, m.duration)
+
+	return m
+}
+
+func (m *grpcStreamMetrics) observe(method string, start time.Time, err error) {
+	// only the known methods are used as label, to bound the cardinality
+	switch method {
+	case grpcMethodStoreInfo, grpcMethodStoreSeries, grpcMethodStoreLabelNames, grpcMethodStoreLabelValues:
+	default:
+		method = "other"
+	}
+
+	m.streams.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// instrument wraps the stream handler with the stream metrics.
+func (m *grpcStreamMetrics) instrument(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		start := time.Now()
+
+		err := next(srv, stream)
+		m.observe(method, start, err)
+		return err
+	}
+}
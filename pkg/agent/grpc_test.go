@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// encodeStoreRequest encodes a request of the Thanos StoreAPI with a leading varint field and the given matchers.
+func encodeStoreRequest(t *testing.T, matchersField protowire.Number, matchers ...*prompb.LabelMatcher) []byte {
+	raw := protowire.AppendTag(nil, 1, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, 42)
+	for _, matcher := range matchers {
+		value, err := matcher.Marshal()
+		require.NoError(t, err)
+		raw = protowire.AppendTag(raw, matchersField, protowire.BytesType)
+		raw = protowire.AppendBytes(raw, value)
+	}
+
+	return raw
+}
+
+func decodeStoreRequestMatchers(t *testing.T, raw []byte, matchersField protowire.Number) []prompb.LabelMatcher {
+	var ret []prompb.LabelMatcher
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		require.GreaterOrEqual(t, n, 0)
+		valueLen := protowire.ConsumeFieldValue(num, typ, raw[n:])
+		require.GreaterOrEqual(t, valueLen, 0)
+
+		if num == matchersField {
+			value, _ := protowire.ConsumeBytes(raw[n:])
+			var matcher prompb.LabelMatcher
+			require.NoError(t, matcher.Unmarshal(value))
+			ret = append(ret, matcher)
+		}
+		raw = raw[n+valueLen:]
+	}
+
+	return ret
+}
+
+func Test_injectNamespaceMatcher(t *testing.T) {
+	nameMatcher := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}
+
+	t.Run("append", func(t *testing.T) {
+		raw, err := injectNamespaceMatcher(encodeStoreRequest(t, 3, nameMatcher), 3, data.NewSet("ns-a", "ns-b"))
+		require.NoError(t, err)
+
+		require.Equal(t, []prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "ns-a|ns-b"},
+		}, decodeStoreRequestMatchers(t, raw, 3))
+
+		// the other fields are kept
+		num, _, n := protowire.ConsumeTag(raw)
+		require.Equal(t, protowire.Number(1), num)
+		value, _ := protowire.ConsumeVarint(raw[n:])
+		require.Equal(t, uint64(42), value)
+	})
+
+	t.Run("translate", func(t *testing.T) {
+		nsMatcher := &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "ns-.*"}
+		raw, err := injectNamespaceMatcher(encodeStoreRequest(t, 7, nsMatcher), 7, data.NewSet("ns-a", "other"))
+		require.NoError(t, err)
+
+		require.Equal(t, []prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "ns-a"},
+		}, decodeStoreRequestMatchers(t, raw, 7))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := injectNamespaceMatcher([]byte{0xff}, 3, data.NewSet("ns-a"))
+		require.Error(t, err)
+	})
+}
+
+func Test_grpcBackend(t *testing.T) {
+	// fake Thanos StoreAPI, which echoes the raw request
+	received := make(chan []byte, 1)
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstreamSrv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		req := &emptypb.Empty{}
+		if rErr := stream.RecvMsg(req); rErr != nil {
+			return rErr
+		}
+		received <- req.ProtoReflect().GetUnknown()
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+	go func() { _ = upstreamSrv.Serve(upstreamListener) }()
+	t.Cleanup(upstreamSrv.Stop)
+
+	agt := mockAgentWithUpstream(t, "http://"+upstreamListener.Addr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	agt.grpcUpstreams, err = newGRPCUpstreamPool(ctx, agt.cfg, agt.registry)
+	require.NoError(t, err)
+	agt.grpcMetrics = newGRPCStreamMetrics(agt.registry)
+
+	agentListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	agentSrv := agt.createGRPCProxy()
+	go func() { _ = agentSrv.Serve(agentListener) }()
+	t.Cleanup(agentSrv.Stop)
+
+	conn, err := grpc.NewClient(agentListener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	call := func(token, method string, raw []byte) error {
+		ctx := context.Background()
+		if len(token) != 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+
+		stream, sErr := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+		if sErr != nil {
+			return sErr
+		}
+
+		req := &emptypb.Empty{}
+		req.ProtoReflect().SetUnknown(raw)
+		if sErr = stream.SendMsg(req); sErr != nil {
+			return sErr
+		}
+		if sErr = stream.CloseSend(); sErr != nil {
+			return sErr
+		}
+
+		return stream.RecvMsg(&emptypb.Empty{})
+	}
+
+	nameMatcher := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}
+
+	t.Run("tenant series", func(t *testing.T) {
+		require.NoError(t, call("someNamespacesToken", grpcMethodStoreSeries, encodeStoreRequest(t, 3, nameMatcher)))
+
+		matchers := decodeStoreRequestMatchers(t, <-received, 3)
+		require.Len(t, matchers, 2)
+		require.Equal(t, "namespace", matchers[1].GetName())
+	})
+
+	t.Run("tenant label values", func(t *testing.T) {
+		require.NoError(t, call("someNamespacesToken", grpcMethodStoreLabelValues, encodeStoreRequest(t, 7)))
+
+		matchers := decodeStoreRequestMatchers(t, <-received, 7)
+		require.Len(t, matchers, 1)
+		require.Equal(t, "namespace", matchers[0].GetName())
+	})
+
+	t.Run("agent token", func(t *testing.T) {
+		raw := encodeStoreRequest(t, 3, nameMatcher)
+		require.NoError(t, call("myToken", grpcMethodStoreSeries, raw))
+		require.Equal(t, raw, <-received)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		err := call("", grpcMethodStoreSeries, nil)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		err := call("someNamespacesToken", "/thanos.Rules/Rules", nil)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("pooled connection", func(t *testing.T) {
+		first, cErr := agt.grpcUpstreams.conn()
+		require.NoError(t, cErr)
+		second, cErr := agt.grpcUpstreams.conn()
+		require.NoError(t, cErr)
+		require.Same(t, first, second)
+
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(agt.grpcUpstreams.up.WithLabelValues(upstreamListener.Addr().String())) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("stream metrics", func(t *testing.T) {
+		require.InDelta(t, 2, testutil.ToFloat64(agt.grpcMetrics.streams.WithLabelValues(grpcMethodStoreSeries, codes.OK.String())), 0)
+		require.InDelta(t, 1, testutil.ToFloat64(agt.grpcMetrics.streams.WithLabelValues("other", codes.PermissionDenied.String())), 0)
+	})
+}
+
+func Test_grpcUpstreamPoolFailover(t *testing.T) {
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedTarget := closedListener.Addr().String()
+	require.NoError(t, closedListener.Close())
+
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstreamSrv := grpc.NewServer()
+	go func() { _ = upstreamSrv.Serve(upstreamListener) }()
+	t.Cleanup(upstreamSrv.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	cfg := &agentConfig{
+		proxyURLs:           []*url.URL{{Scheme: "http", Host: "localhost:9090"}},
+		grpcUpstreamTargets: []string{closedTarget, upstreamListener.Addr().String()},
+	}
+	pool, err := newGRPCUpstreamPool(ctx, cfg, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		conn, cErr := pool.conn()
+		return cErr == nil && conn.Target() == upstreamListener.Addr().String()
+	}, 5*time.Second, 10*time.Millisecond)
+}
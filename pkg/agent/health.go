@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// readinessTimeout bounds checking the upstreams on a readiness probe.
+	readinessTimeout = 5 * time.Second
+	// unsyncedRetryAfter is how long the tenants are asked to wait for the namespaces to be synced.
+	unsyncedRetryAfter = 5 * time.Second
+)
+
+var errNamespacesUnsynced = errors.New("the namespaces are not synced yet")
+
+// healthz reports that the agent is alive.
+func (a *agent) healthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, "ok")
+}
+
+// readyz reports whether the agent is ready to serve the tenants.
+func (a *agent) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := a.ready(ctx); err != nil {
+		log.Debugf("not ready: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = io.WriteString(w, "ok")
+}
+
+// ready requires the agent not to be shutting down, the namespaces to be synced and the upstreams to be reachable.
+func (a *agent) ready(ctx context.Context) error {
+	if a.shuttingDown.Load() {
+		return errShuttingDown
+	}
+	if !a.namespaces.HasSynced() {
+		return errNamespacesUnsynced
+	}
+
+	return a.upstreams.ready(ctx)
+}
+
+// namespacesSynced writes the rejection if the namespaces are not synced yet,
+// since the tenants would get empty results otherwise.
+func (a *agent) namespacesSynced(w http.ResponseWriter) bool {
+	if a.namespaces.HasSynced() {
+		return true
+	}
+
+	writeRetryLater(w, http.StatusServiceUnavailable, "unavailable", errNamespacesUnsynced.Error(), unsyncedRetryAfter)
+	return false
+}
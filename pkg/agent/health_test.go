@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_health(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/-/ready":      "ready",
+		"/api/v1/query": map[string]interface{}{"resultType": "vector", "result": []interface{}{}},
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	namespaces, _ := agt.namespaces.(*fakeOwnedNamespaces)
+	httpBackend := agt.httpBackend()
+	adminBackend := agt.adminBackend()
+
+	doRequest := func(token string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090"+path, nil)
+		if len(token) != 0 {
+			req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		if strings.HasPrefix(path, "/_/") {
+			adminBackend.ServeHTTP(res, req)
+		} else {
+			httpBackend.ServeHTTP(res, req)
+		}
+		return res
+	}
+	query := "/api/v1/query?" + url.Values{"query": {"up"}}.Encode()
+
+	require.Equal(t, http.StatusOK, doRequest("", "/_/healthz").Code)
+	require.Equal(t, http.StatusOK, doRequest("", "/_/readyz").Code)
+	require.Equal(t, http.StatusOK, doRequest("someNamespacesToken", query).Code)
+
+	// the tenants are rejected until the namespaces are synced
+	namespaces.unsynced = true
+	res := doRequest("", "/_/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.Contains(t, res.Body.String(), "not synced")
+	res = doRequest("someNamespacesToken", query)
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.Equal(t, "5", res.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, doRequest("myToken", query).Code)
+	require.Equal(t, http.StatusOK, doRequest("", "/_/healthz").Code)
+	namespaces.unsynced = false
+
+	// the upstream is not reachable
+	upstream.Close()
+	res = doRequest("", "/_/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.Contains(t, res.Body.String(), "is not ready")
+}
@@ -2,22 +2,25 @@ package agent
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"strings"
 	"time"
 
+	"github.com/caas-team/prometheus-auth/pkg/data"
 	"github.com/caas-team/prometheus-auth/pkg/kube"
 	"github.com/gorilla/mux"
 	"github.com/juju/errors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	authentication "k8s.io/api/authentication/v1"
 )
 
+// deniedRouteName names the route of the access controlled requests to the APIs which are not allowed.
+const deniedRouteName = "denied"
+
 func (a *agent) httpBackend() http.Handler {
-	proxy := httputil.NewSingleHostReverseProxy(a.cfg.proxyURL)
+	proxy := a.upstreams.defaultUpstream.proxy
 	router := mux.NewRouter()
 
 	if log.GetLevel() == log.DebugLevel {
@@ -30,14 +33,6 @@ func (a *agent) httpBackend() http.Handler {
 		})
 	}
 
-	// enable metrics
-	router.Path("/_/metrics").Methods("GET").Handler(promhttp.HandlerFor(
-		a.registry,
-		promhttp.HandlerOpts{
-			Registry: a.registry,
-		},
-	))
-
 	// proxy white list
 	router.Path("/alerts").Methods("GET").Handler(proxy)
 	router.Path("/graph").Methods("GET").Handler(proxy)
@@ -54,19 +49,41 @@ func (a *agent) httpBackend() http.Handler {
 	router.Path("/metrics").Methods("GET").Handler(proxy)
 	router.Path("/-/healthy").Methods("GET").Handler(proxy)
 	router.Path("/-/ready").Methods("GET").Handler(proxy)
-	router.PathPrefix("/debug/").Methods("GET").Handler(proxy)
 
 	// access control
-	router.PathPrefix("/").Handler(accessControl(a, proxy))
+	router.PathPrefix("/").Handler(accessControl(a))
 
 	return router
 }
 
-func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
+func accessControl(agt *agent) http.Handler {
 	router := mux.NewRouter()
 
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := routeOf(r)
+			ctx, span := agt.startRequestSpan(r, route)
+			defer span.End()
+			r = r.WithContext(ctx)
+			// the requests are tagged by their trace IDs in the logs and the audit events
+			tag := span.SpanContext().TraceID().String()
+			recorder := newResponseRecorder(w)
+			w = recorder
+
+			// only the project IDs are taken as tenant labels, the other requests are not attributed
+			var projectID string
+			defer func() {
+				span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+				if recorder.status >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, http.StatusText(recorder.status))
+				}
+				agt.requestMetrics.observe(route, r, recorder.status, projectID, start)
+			}()
+
+			event, logAudit := agt.audited(recorder, r, tag)
+			defer logAudit()
+
 			var userInfo authentication.UserInfo
 			var err error
 			accessToken := strings.TrimPrefix(r.Header.Get(authorizationHeaderKey), "Bearer ")
@@ -75,29 +92,96 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 			if len(accessToken) == 0 {
 				err = errors.New("no access token provided")
 			} else {
+				_, authSpan := startSpan(ctx, "authenticate")
 				userInfo, err = agt.tokens.Authenticate(accessToken)
+				endSpan(authSpan, err)
 			}
 
 			if err != nil {
 				// either not token was provided or user is unauthenticated with k8s API
+				event.SetError(err.Error())
 				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
 			}
 
+			event.SetUser(userInfo.Username, userInfo.UID)
+
 			// direct proxy
 			if kube.MatchingUsers(agt.userInfo, userInfo) {
-				proxyHandler.ServeHTTP(w, r)
+				agt.upstreams.lookup("", nil, r.URL.Path).proxy.ServeHTTP(w, r)
+				return
+			}
+
+			if !agt.namespacesSynced(w) {
+				event.SetError(errNamespacesUnsynced.Error())
+				return
+			}
+
+			_, nsSpan := startSpan(ctx, "resolve namespaces")
+			var namespaceSet data.Set
+			projectID, namespaceSet = agt.namespaces.Resolve(accessToken)
+			nsSpan.SetAttributes(attribute.String("project.id", projectID), attribute.Int("namespaces", len(namespaceSet)))
+			nsSpan.End()
+			span.SetAttributes(attribute.String("project.id", projectID))
+			limitsTenant := agt.limitsTenant(projectID, namespaceSet)
+			shadow := agt.shadowing(limitsTenant, event, tag)
+			namespaceSet = shadow.namespaces(agt.cfg.namespacesMapping, projectID, userInfo.Username, namespaceSet)
+			event.SetTenant(projectID, namespaceSet.Values())
+			if agt.rateLimited(w, r, limitsTenant, shadow) {
+				return
+			}
+			_, scheduleSpan := startSpan(ctx, "schedule")
+			release, scheduled := agt.scheduled(w, r, limitsTenant, projectID)
+			scheduleSpan.End()
+			if !scheduled {
+				return
+			}
+			defer release()
+
+			ups := []*upstream{agt.upstreams.lookup(projectID, namespaceSet, r.URL.Path)}
+			if agt.cfg.upstreamFanOut {
+				ups = agt.upstreams.lookupAll(projectID, namespaceSet, r.URL.Path)
+			}
+
+			// tenant header
+			if agt.cfg.upstreamMode == upstreamModeTenantHeader {
+				// only the read APIs which are hijacked in the 'rewrite' mode are forwarded
+				if mux.CurrentRoute(r).GetName() == deniedRouteName {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+
+				tenantID := agt.tenantID(projectID, namespaceSet)
+				if len(tenantID) == 0 {
+					http.Error(w, "unable to resolve tenant", http.StatusForbidden)
+					return
+				}
+
+				r.Header.Set(agt.cfg.tenantHeader, tenantID)
+				ups[0].proxy.ServeHTTP(w, r)
 				return
 			}
 
 			apiCtx := &apiContext{
-				tag:                  fmt.Sprintf("%016x", time.Now().Unix()),
-				response:             w,
-				request:              r,
-				proxyHandler:         proxyHandler,
-				filterReaderLabelSet: agt.cfg.filterReaderLabelSet,
-				namespaceSet:         agt.namespaces.Query(accessToken),
-				remoteAPI:            agt.remoteAPI,
+				tag:                   tag,
+				route:                 route,
+				response:              w,
+				request:               r,
+				upstreams:             ups,
+				abortOnPartialFailure: agt.cfg.partialResponse == partialResponseAbort,
+				replicaLabel:          agt.cfg.dedupReplicaLabel,
+				filterReaderLabelSet:  agt.cfg.filterReaderLabelSet,
+				namespaceSet:          namespaceSet,
+				queryLimits:           agt.cfg.tenantLimits.queryLimits(limitsTenant),
+				complexityMetrics:     agt.complexityMetrics,
+				cardinalityCache:      agt.cardinalityCache,
+				cardinalityCacheTTL:   agt.cfg.cardinalityCacheTTL,
+				cardinalityMetrics:    agt.cardinalityMetrics,
+				metricNamesCache:      agt.metricNamesCache,
+				metricNamesCacheTTL:   agt.cfg.metricNamesCacheTTL,
+				audit:                 event,
+				shadow:                shadow,
+				requestMetrics:        agt.requestMetrics,
 			}
 
 			newReqCtx := context.WithValue(r.Context(), apiContextKey, apiCtx)
@@ -107,16 +191,28 @@ func accessControl(agt *agent, proxyHandler http.Handler) http.Handler {
 
 	router.Path("/api/v1/query").Methods("GET", "POST").Handler(apiContextHandler(hijackQuery))
 	router.Path("/api/v1/query_range").Methods("GET", "POST").Handler(apiContextHandler(hijackQueryRange))
+	router.Path("/api/v1/query_exemplars").Methods("GET", "POST").Handler(apiContextHandler(hijackQueryExemplars))
 	router.Path("/api/v1/series").Methods("GET").Handler(apiContextHandler(hijackSeries))
 	router.Path("/api/v1/read").Methods("POST").Handler(apiContextHandler(hijackRead))
 	router.Path("/api/v1/label/__name__/values").Methods("GET").Handler(apiContextHandler(hijackLabelName))
 	router.Path("/api/v1/label/namespace/values").Methods("GET").Handler(apiContextHandler(hijackLabelNamespaces))
-	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(proxyHandler)
+	router.Path("/api/v1/metadata").Methods("GET").Handler(apiContextHandler(hijackMetadata))
+	router.Path("/api/v1/label/{name}/values").Methods("GET").Handler(apiContextHandler(proxyLabelValues))
 	router.Path("/federate").Methods("GET").Handler(apiContextHandler(hijackFederate))
 
-	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	router.PathPrefix("/").Name(deniedRouteName).HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 	})
 
 	return router
 }
+
+// tenantID returns the ID of the tenant, which is either
+// its project ID or the '|'-joined list of its namespaces.
+func (a *agent) tenantID(projectID string, namespaceSet data.Set) string {
+	if a.cfg.tenantIDSource == tenantIDSourceNamespaces {
+		return strings.Join(namespaceSet.Values(), "|")
+	}
+
+	return projectID
+}
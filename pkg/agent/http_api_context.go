@@ -5,15 +5,19 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/caas-team/prometheus-auth/pkg/audit"
 	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/caas-team/prometheus-auth/pkg/prom"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/juju/errors"
-	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	promgo "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	prommodel "github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/cache"
 	"k8s.io/apimachinery/pkg/util/runtime"
 )
 
@@ -29,13 +33,27 @@ var (
 
 type apiContext struct {
 	sync.Once
-	tag                  string
-	response             http.ResponseWriter
-	request              *http.Request
-	proxyHandler         http.Handler
-	filterReaderLabelSet data.Set
-	namespaceSet         data.Set
-	remoteAPI            promapiv1.API
+	tag                   string
+	route                 string
+	response              http.ResponseWriter
+	request               *http.Request
+	upstreams             []*upstream
+	abortOnPartialFailure bool
+	replicaLabel          string
+	shardCombiner         prom.ShardCombiner
+	warnings              []string
+	filterReaderLabelSet  data.Set
+	namespaceSet          data.Set
+	queryLimits           *queryLimits
+	complexityMetrics     *queryComplexityMetrics
+	cardinalityCache      *cache.LRUExpireCache
+	cardinalityCacheTTL   time.Duration
+	cardinalityMetrics    *cardinalityMetrics
+	metricNamesCache      *cache.LRUExpireCache
+	metricNamesCacheTTL   time.Duration
+	audit                 *audit.Event
+	shadow                *shadowing
+	requestMetrics        *requestMetrics
 }
 
 type jsonResponseData struct {
@@ -43,89 +61,214 @@ type jsonResponseData struct {
 	Data      interface{} `json:"data,omitempty"`
 	ErrorType string      `json:"errorType,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
 }
 
 func (c *apiContext) responseJSON(data interface{}) error {
 	var err error
 	c.Do(func() {
-		resp := c.response
-		resp.Header().Set("Content-Type", "application/json")
+		err = c.writeJSON(data)
+	})
 
-		responseData := &jsonResponseData{
-			Status: "success",
-			Data:   data,
-		}
+	return err
+}
 
-		respBytes, marshalErr := json.Marshal(responseData)
-		if marshalErr != nil {
-			err = errors.Wrap(marshalErr, errInternal)
-			return
-		}
+func (c *apiContext) writeJSON(data interface{}) error {
+	resp := c.response
+	resp.Header().Set("Content-Type", "application/json")
 
-		if _, writeErr := resp.Write(respBytes); writeErr != nil {
-			err = errors.Wrap(writeErr, errInternal)
-			return
-		}
+	responseData := &jsonResponseData{
+		Status:   "success",
+		Data:     data,
+		Warnings: c.warnings,
+	}
+
+	respBytes, marshalErr := json.Marshal(responseData)
+	if marshalErr != nil {
+		return errors.Wrap(marshalErr, errInternal)
+	}
+
+	if _, writeErr := resp.Write(respBytes); writeErr != nil {
+		return errors.Wrap(writeErr, errInternal)
+	}
+
+	return nil
+}
+
+func (c *apiContext) responseProto(data proto.Message) error {
+	var err error
+	c.Do(func() {
+		err = c.writeProto(data)
 	})
 
 	return err
 }
 
-func (c *apiContext) responseProto(data proto.Message) error {
+func (c *apiContext) writeProto(data proto.Message) error {
+	resp := c.response
+	resp.Header().Set("Content-Type", "application/x-protobuf")
+	resp.Header().Set("Content-Encoding", "snappy")
+
+	if data == nil {
+		resp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	responseData, marshalErr := proto.Marshal(data)
+	if marshalErr != nil {
+		return errors.Wrap(marshalErr, errInternal)
+	}
+
+	respBytes := snappy.Encode(nil, responseData)
+	if _, writeErr := resp.Write(respBytes); writeErr != nil {
+		return errors.Wrap(writeErr, errInternal)
+	}
+
+	return nil
+}
+
+func (c *apiContext) responseMetrics(data ...*promgo.MetricFamily) error {
 	var err error
 	c.Do(func() {
-		resp := c.response
-		resp.Header().Set("Content-Type", "application/x-protobuf")
-		resp.Header().Set("Content-Encoding", "snappy")
+		err = c.writeMetrics(data...)
+	})
 
-		if data == nil {
-			resp.WriteHeader(http.StatusNoContent)
-			return
+	return err
+}
+
+func (c *apiContext) writeMetrics(data ...*promgo.MetricFamily) error {
+	req, resp := c.request, c.response
+
+	respFormat := expfmt.Negotiate(req.Header)
+	respEncoder := expfmt.NewEncoder(resp, respFormat)
+	resp.Header().Set("Content-Type", string(respFormat))
+
+	for _, family := range data {
+		if encodeErr := respEncoder.Encode(family); encodeErr != nil {
+			return errors.Wrap(encodeErr, errInternal)
 		}
+	}
 
-		responseData, marshalErr := proto.Marshal(data)
-		if marshalErr != nil {
-			err = errors.Wrap(marshalErr, errInternal)
-			return
+	return nil
+}
+
+// partialFailure records the failure of a single upstream as warning,
+// unless partial responses are not accepted.
+func (c *apiContext) partialFailure(err error) error {
+	if c.abortOnPartialFailure {
+		return errors.Wrap(err, errNotProvisioned)
+	}
+
+	log.Warnf("partial response[%s]: %v", c.tag, err)
+	c.warnings = append(c.warnings, err.Error())
+	return nil
+}
+
+// fansOut tells whether the requests are sent to several upstreams or HA replicas.
+func (c *apiContext) fansOut() bool {
+	return len(c.upstreams) > 1 || len(c.upstreams[0].replicas) != 0
+}
+
+// eachRemoteAPI calls fn with the API client of each upstream of the tenant,
+// failing over to the HA replicas of an upstream if it fails,
+// it fails only if all upstreams fail, or if partial responses are not accepted.
+func (c *apiContext) eachRemoteAPI(fn func(up *upstream) error) error {
+	var firstErr error
+	failed := 0
+	for _, up := range c.upstreams {
+		var err error
+		for _, member := range up.members() {
+			if err = fn(member); err == nil {
+				break
+			}
+
+			log.Debugf("failed to call upstream %s[%s]: %v", member.name, c.tag, err)
+		}
+		if err == nil {
+			continue
 		}
 
-		respBytes := snappy.Encode(nil, responseData)
-		if _, writeErr := resp.Write(respBytes); writeErr != nil {
-			err = errors.Wrap(writeErr, errInternal)
-			return
+		failed++
+		if firstErr == nil {
+			firstErr = err
 		}
-	})
 
-	return err
+		if len(c.upstreams) > 1 {
+			if pErr := c.partialFailure(errors.Annotatef(err, "upstream %s", up.name)); pErr != nil {
+				return pErr
+			}
+		}
+	}
+
+	if failed == len(c.upstreams) {
+		return errors.Wrap(firstErr, errNotProvisioned)
+	}
+
+	return nil
 }
 
-func (c *apiContext) responseMetrics(data *promgo.MetricFamily) error {
-	var err error
-	c.Do(func() {
-		req, resp := c.request, c.response
+// queryMetricNames returns the metric names which have series in the owned namespaces.
+// The result is cached per namespace set if a cache TTL is configured.
+func (c *apiContext) queryMetricNames() (prommodel.LabelValues, error) {
+	cacheKey := c.namespaceSet.String()
+	if c.metricNamesCache != nil {
+		if cached, exist := c.metricNamesCache.Get(cacheKey); exist {
+			names, _ := cached.(prommodel.LabelValues)
+			return names, nil
+		}
+	}
 
-		respFormat := expfmt.Negotiate(req.Header)
-		respEncoder := expfmt.NewEncoder(resp, respFormat)
-		resp.Header().Set("Content-Type", string(respFormat))
+	expr := prom.NewExprForCountAllLabels(c.namespaceSet.Values())
+	names := make(prommodel.LabelValues, 0)
+	seen := make(map[prommodel.LabelValue]struct{})
+	err := c.eachRemoteAPI(func(up *upstream) error {
+		vals, warns, err := up.api.Query(c.request.Context(), expr, time.Time{})
+		for _, warn := range warns {
+			log.Debugf("received warning on query: %s", warn)
+		}
+		if err != nil {
+			return err
+		}
 
-		if data == nil {
-			return
+		vectorVals, ok := vals.(prommodel.Vector)
+		if !ok {
+			return errors.Errorf("unexpected value type %q", vals.Type())
 		}
 
-		if encodeErr := respEncoder.Encode(data); encodeErr != nil {
-			err = errors.Wrap(encodeErr, errInternal)
+		for _, vectorVal := range vectorVals {
+			name := vectorVal.Metric[prommodel.MetricNameLabel]
+			if _, exist := seen[name]; !exist {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
 		}
+
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	if c.metricNamesCache != nil && len(c.warnings) == 0 {
+		c.metricNamesCache.Add(cacheKey, names, c.metricNamesCacheTTL)
+	}
+
+	return names, nil
 }
 
 func (c *apiContext) proxyWith(request *http.Request) error {
+	var err error
 	c.Do(func() {
-		c.proxyHandler.ServeHTTP(c.response, request)
+		// the warnings of the agent are added to the response of a single upstream like to the merged responses
+		if c.fansOut() || len(c.warnings) != 0 {
+			err = c.fanOut(request)
+			return
+		}
+
+		c.upstreams[0].proxy.ServeHTTP(c.response, request)
 	})
 
-	return nil
+	return err
 }
 
 type apiContextHandler func(*apiContext) error
@@ -137,7 +280,10 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	apiCtx, _ := r.Context().Value(apiContextKey).(*apiContext)
 
+	ctx, span := startSpan(apiCtx.request.Context(), "hijack")
+	apiCtx.request = apiCtx.request.WithContext(ctx)
 	err := f(apiCtx)
+	endSpan(span, err)
 	if err == nil {
 		return
 	}
@@ -153,13 +299,15 @@ func (f apiContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		causeErrMsg = err.Error()
 	}
+	apiCtx.audit.SetError(causeErrMsg)
 
 	responseErrType := ""
 	responseCode := http.StatusInternalServerError
-	if errors.As(err, &errBadRequest) {
+	switch errors.Cause(err) { //nolint:errorlint // the juju errors keep the cause instead of wrapping it
+	case errBadRequest:
 		responseCode = http.StatusBadRequest
 		responseErrType = "bad_data"
-	} else if errors.As(err, &errNotProvisioned) {
+	case errNotProvisioned:
 		responseCode = http.StatusUnprocessableEntity
 		responseErrType = "execution"
 	}
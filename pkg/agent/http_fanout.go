@@ -0,0 +1,377 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caas-team/prometheus-auth/pkg/prom"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	promgo "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	partialResponseWarn  = "warn"
+	partialResponseAbort = "abort"
+)
+
+type fanOutResponse struct {
+	// group is the index of the upstream, whose HA replicas share it
+	group    int
+	upstream *upstream
+	response *http.Response
+	body     []byte
+	err      error
+}
+
+type fanOutAPIResponse struct {
+	Status   string          `json:"status"`
+	Data     json.RawMessage `json:"data"`
+	Warnings []string        `json:"warnings"`
+}
+
+type fanOutQueryData struct {
+	ResultType prommodel.ValueType `json:"resultType"`
+	Result     json.RawMessage     `json:"result"`
+}
+
+// fanOut sends the request to all upstreams of the tenant and merges their responses.
+func (c *apiContext) fanOut(request *http.Request) error {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(request.Body); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+
+	if request.URL.Path == "/federate" {
+		request.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	}
+
+	// each upstream is requested together with its HA replicas
+	groups := make([][]*fanOutResponse, len(c.upstreams))
+	var wg sync.WaitGroup
+	for idx, up := range c.upstreams {
+		members := up.members()
+		groups[idx] = make([]*fanOutResponse, len(members))
+		for memberIdx, member := range members {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resp, respBody, err := member.fetch(request, body)
+				groups[idx][memberIdx] = &fanOutResponse{group: idx, upstream: member, response: resp, body: respBody, err: err}
+			}()
+		}
+	}
+	wg.Wait()
+
+	dedup := false
+	succeeded := make([]*fanOutResponse, 0, len(groups))
+	var failed []*fanOutResponse
+	for _, group := range groups {
+		groupSucceeded := false
+		for _, resp := range group {
+			if resp.err != nil {
+				continue
+			}
+
+			groupSucceeded = true
+			succeeded = append(succeeded, resp)
+		}
+
+		if len(group) > 1 {
+			dedup = true
+		}
+
+		if !groupSucceeded {
+			failed = append(failed, group[0])
+			continue
+		}
+
+		// a failing replica is covered by its peers
+		for _, resp := range group {
+			if resp.err != nil {
+				log.Debugf("failed to request replica %s[%s]: %v", resp.upstream.name, c.tag, resp.err)
+			}
+		}
+	}
+
+	// relay the failure of the first upstream if all failed
+	if len(succeeded) == 0 {
+		first := failed[0]
+		if first.response == nil {
+			return errors.Wrap(first.err, errNotProvisioned)
+		}
+
+		c.response.Header().Set("Content-Type", first.response.Header.Get("Content-Type"))
+		c.response.WriteHeader(first.response.StatusCode)
+		_, _ = c.response.Write(first.body)
+		return nil
+	}
+
+	for _, resp := range failed {
+		if err := c.partialFailure(resp.err); err != nil {
+			return err
+		}
+	}
+
+	// the series of HA replicas are deduplicated by dropping the replica label
+	merger := &fanOutMerger{dedup: dedup, replicaLabel: c.replicaLabel, combine: c.shardCombiner}
+
+	switch request.URL.Path {
+	case "/api/v1/read":
+		return c.mergeReadResponses(merger, succeeded)
+	case "/federate":
+		return c.mergeFederateResponses(merger, succeeded)
+	default:
+		return c.mergeAPIResponses(merger, request.URL.Path, succeeded)
+	}
+}
+
+// checkShardable prepares combining the results of the query across the upstreams,
+// it rejects the aggregations whose results cannot be combined from the partial results of the upstreams.
+func (c *apiContext) checkShardable(expr parser.Expr) error {
+	if len(c.upstreams) < 2 {
+		return nil
+	}
+
+	combiner, err := prom.ShardCombinerOf(expr)
+	if err != nil {
+		return err
+	}
+	c.shardCombiner = combiner
+
+	return nil
+}
+
+func (c *apiContext) mergeReadResponses(merger *fanOutMerger, responses []*fanOutResponse) error {
+	var results [][]*prompb.QueryResult
+	for _, resp := range responses {
+		decoded, err := snappy.Decode(nil, resp.body)
+		if err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to decode response of upstream %s", resp.upstream.name), errInternal)
+		}
+
+		var readResp prompb.ReadResponse
+		if err = proto.Unmarshal(decoded, &readResp); err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to unmarshal response of upstream %s", resp.upstream.name), errInternal)
+		}
+
+		for idx, result := range readResp.GetResults() {
+			if idx == len(results) {
+				results = append(results, nil)
+			}
+			results[idx] = append(results[idx], result)
+		}
+	}
+
+	merged := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(results)),
+	}
+	for _, queryResults := range results {
+		merged.Results = append(merged.Results, merger.queryResults(queryResults...))
+	}
+
+	return c.writeProto(merged)
+}
+
+func (c *apiContext) mergeFederateResponses(merger *fanOutMerger, responses []*fanOutResponse) error {
+	families := make([]map[string]*promgo.MetricFamily, 0, len(responses))
+	for _, resp := range responses {
+		var parser expfmt.TextParser
+		parsed, err := parser.TextToMetricFamilies(bytes.NewReader(resp.body))
+		if err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to parse response of upstream %s", resp.upstream.name), errInternal)
+		}
+
+		families = append(families, parsed)
+	}
+
+	return c.writeMetrics(merger.metricFamilies(families...)...)
+}
+
+func (c *apiContext) mergeAPIResponses(merger *fanOutMerger, path string, responses []*fanOutResponse) error {
+	datas := make([]json.RawMessage, 0, len(responses))
+	groups := make([]int, 0, len(responses))
+	for _, resp := range responses {
+		var apiResp fanOutAPIResponse
+		if err := json.Unmarshal(resp.body, &apiResp); err != nil {
+			return errors.Wrap(errors.Annotatef(err, "unable to unmarshal response of upstream %s", resp.upstream.name), errInternal)
+		}
+
+		c.warnings = append(c.warnings, apiResp.Warnings...)
+		datas = append(datas, apiResp.Data)
+		groups = append(groups, resp.group)
+	}
+
+	var merged interface{}
+	var err error
+	switch {
+	case path == "/api/v1/query" || path == "/api/v1/query_range":
+		merged, err = merger.queryData(datas, groups)
+	case path == "/api/v1/series":
+		merged, err = mergeData(datas, merger.labelSets)
+	case path == "/api/v1/labels" || strings.HasPrefix(path, "/api/v1/label/"):
+		merged, err = mergeData(datas, prom.MergeStrings)
+	default:
+		merged = datas[0]
+	}
+	if err != nil {
+		return errors.Wrap(err, errInternal)
+	}
+
+	return c.writeJSON(merged)
+}
+
+func (m *fanOutMerger) queryData(datas []json.RawMessage, groups []int) (interface{}, error) {
+	queryDatas := make([]fanOutQueryData, 0, len(datas))
+	for _, data := range datas {
+		var queryData fanOutQueryData
+		if err := json.Unmarshal(data, &queryData); err != nil {
+			return nil, err
+		}
+
+		queryDatas = append(queryDatas, queryData)
+	}
+
+	results := make([]json.RawMessage, 0, len(queryDatas))
+	for _, queryData := range queryDatas {
+		results = append(results, queryData.Result)
+	}
+
+	var merged interface{}
+	var err error
+	resultType := queryDatas[0].ResultType
+	switch { //nolint:exhaustive // scalars and strings are the same on all upstreams
+	case resultType == prommodel.ValVector && m.combine != nil:
+		merged, err = combineData(results, groups, m.vectors, m.combinedVectors)
+	case resultType == prommodel.ValMatrix && m.combine != nil:
+		merged, err = combineData(results, groups, m.matrices, m.combinedMatrices)
+	case resultType == prommodel.ValVector:
+		merged, err = mergeData(results, m.vectors)
+	case resultType == prommodel.ValMatrix:
+		merged, err = mergeData(results, m.matrices)
+	default:
+		merged = results[0]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &struct {
+		ResultType prommodel.ValueType `json:"resultType"`
+		Result     interface{}         `json:"result"`
+	}{
+		ResultType: resultType,
+		Result:     merged,
+	}, nil
+}
+
+// mergeData unmarshals the data of each upstream and merges them with the given function.
+func mergeData[T any](datas []json.RawMessage, merge func(...T) T) (T, error) {
+	values := make([]T, 0, len(datas))
+	for _, data := range datas {
+		var value T
+		if err := json.Unmarshal(data, &value); err != nil {
+			return value, err
+		}
+
+		values = append(values, value)
+	}
+
+	return merge(values...), nil
+}
+
+// combineData merges the data of the HA replicas of each upstream,
+// and combines the merged data of the upstreams, which are the shards of an aggregation.
+func combineData[T any](datas []json.RawMessage, groups []int, merge, combine func(...T) T) (T, error) {
+	var order []int
+	byGroup := make(map[int][]json.RawMessage)
+	for idx, data := range datas {
+		if _, exist := byGroup[groups[idx]]; !exist {
+			order = append(order, groups[idx])
+		}
+		byGroup[groups[idx]] = append(byGroup[groups[idx]], data)
+	}
+
+	shards := make([]T, 0, len(order))
+	for _, group := range order {
+		shard, err := mergeData(byGroup[group], merge)
+		if err != nil {
+			return shard, err
+		}
+
+		shards = append(shards, shard)
+	}
+
+	return combine(shards...), nil
+}
+
+// fanOutMerger merges the responses of the upstreams,
+// deduplicating the series of HA replicas if needed,
+// and combining the results of an aggregation over the upstreams if needed.
+type fanOutMerger struct {
+	dedup        bool
+	replicaLabel string
+	combine      prom.ShardCombiner
+}
+
+func (m *fanOutMerger) vectors(vectors ...prommodel.Vector) prommodel.Vector {
+	if m.dedup {
+		return prom.DedupVectors(m.replicaLabel, vectors...)
+	}
+
+	return prom.MergeVectors(vectors...)
+}
+
+func (m *fanOutMerger) matrices(matrices ...prommodel.Matrix) prommodel.Matrix {
+	if m.dedup {
+		return prom.DedupMatrices(m.replicaLabel, matrices...)
+	}
+
+	return prom.MergeMatrices(matrices...)
+}
+
+func (m *fanOutMerger) combinedVectors(vectors ...prommodel.Vector) prommodel.Vector {
+	return prom.CombineVectors(m.combine, vectors...)
+}
+
+func (m *fanOutMerger) combinedMatrices(matrices ...prommodel.Matrix) prommodel.Matrix {
+	return prom.CombineMatrices(m.combine, matrices...)
+}
+
+func (m *fanOutMerger) labelSets(labelSets ...[]prommodel.LabelSet) []prommodel.LabelSet {
+	if m.dedup {
+		return prom.DedupLabelSets(m.replicaLabel, labelSets...)
+	}
+
+	return prom.MergeLabelSets(labelSets...)
+}
+
+func (m *fanOutMerger) metricFamilies(families ...map[string]*promgo.MetricFamily) []*promgo.MetricFamily {
+	if m.dedup {
+		return prom.DedupMetricFamilies(m.replicaLabel, families...)
+	}
+
+	return prom.MergeMetricFamilies(families...)
+}
+
+func (m *fanOutMerger) queryResults(results ...*prompb.QueryResult) *prompb.QueryResult {
+	if m.dedup {
+		return prom.DedupQueryResults(m.replicaLabel, results...)
+	}
+
+	return prom.MergeQueryResults(results...)
+}
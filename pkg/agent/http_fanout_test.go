@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeShard starts an upstream which owns the series of a single namespace.
+func startFakeShard(t *testing.T, namespace string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query":
+			w.Header().Set("Content-Type", "application/json")
+			if strings.HasPrefix(r.FormValue("query"), "sum(") {
+				// the partial sum of the shard
+				_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[60,"1"]}]}}`)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[`+
+				`{"metric":{"__name__":"test_metric1","namespace":%q},"value":[60,"1"]}]}}`, namespace)
+		case "/api/v1/series":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":[{"__name__":"test_metric1","namespace":%q}]}`, namespace)
+		case "/federate":
+			_, _ = fmt.Fprintf(w, "# TYPE test_metric1 untyped\ntest_metric1{namespace=%q} 1 60000\n", namespace)
+		case "/api/v1/read":
+			readResp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "namespace", Value: namespace}},
+				Samples: []prompb.Sample{{Timestamp: 60000, Value: 1}},
+			}}}}}
+			respData, _ := proto.Marshal(readResp)
+			_, _ = w.Write(snappy.Encode(nil, respData))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func mockFanOutAgent(t *testing.T, partialResponse string, routes ...string) http.Handler {
+	agt := mockAgentWithUpstream(t, "http://localhost:9090")
+	agt.cfg.upstreamFanOut = true
+	agt.cfg.partialResponse = partialResponse
+
+	agt.cfg.upstreamRoutes = routes
+	ups, err := newUpstreams(agt.cfg, prometheus.NewRegistry())
+	require.NoError(t, err)
+	agt.upstreams = ups
+
+	return agt.httpBackend()
+}
+
+func Test_fanOut(t *testing.T) {
+	shardA := startFakeShard(t, "ns-a")
+	shardB := startFakeShard(t, "ns-b")
+	closedShard := httptest.NewServer(http.NotFoundHandler())
+	closedShard.Close()
+
+	httpBackend := mockFanOutAgent(t, partialResponseWarn,
+		"namespace:ns-a="+shardA.URL,
+		"namespace:ns-b="+shardB.URL,
+	)
+
+	t.Run("query", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/query?query=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"__name__":"test_metric1","namespace":"ns-a"},"value":[60,"1"]},`+
+			`{"metric":{"__name__":"test_metric1","namespace":"ns-b"},"value":[60,"1"]}]}}`, res.Body.String())
+	})
+
+	t.Run("sum", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/query?query="+url.QueryEscape("sum(test_metric1)"), nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[60,"2"]}]}}`, res.Body.String())
+
+		// the partial averages of the shards cannot be combined
+		res = executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/query?query="+url.QueryEscape("avg(test_metric1)"), nil)
+		require.Equal(t, http.StatusBadRequest, res.Code)
+		require.Contains(t, res.Body.String(), "the avg aggregation cannot be combined across upstreams")
+	})
+
+	t.Run("series", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/series?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":[`+
+			`{"__name__":"test_metric1","namespace":"ns-a"},`+
+			`{"__name__":"test_metric1","namespace":"ns-b"}]}`, res.Body.String())
+	})
+
+	t.Run("federate", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/federate?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, "# TYPE test_metric1 untyped\n"+
+			"test_metric1{namespace=\"ns-a\"} 1 60000\n"+
+			"test_metric1{namespace=\"ns-b\"} 1 60000\n", res.Body.String())
+	})
+
+	t.Run("read", func(t *testing.T) {
+		reqData, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{
+			StartTimestampMs: 0,
+			EndTimestampMs:   120000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_metric1"}},
+		}}})
+		require.NoError(t, err)
+
+		res := executeFanOutRequest(httpBackend, http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, reqData)))
+		require.Equal(t, http.StatusOK, res.Code)
+
+		respData, err := snappy.Decode(nil, res.Body.Bytes())
+		require.NoError(t, err)
+		var readResp prompb.ReadResponse
+		require.NoError(t, proto.Unmarshal(respData, &readResp))
+		require.Len(t, readResp.GetResults(), 1)
+		require.Len(t, readResp.GetResults()[0].GetTimeseries(), 2)
+	})
+
+	t.Run("partial response warning", func(t *testing.T) {
+		partialBackend := mockFanOutAgent(t, partialResponseWarn,
+			"namespace:ns-a="+shardA.URL,
+			"namespace:ns-b="+closedShard.URL,
+		)
+
+		res := executeFanOutRequest(partialBackend, http.MethodGet, "/api/v1/series?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Contains(t, res.Body.String(), `"data":[{"__name__":"test_metric1","namespace":"ns-a"}]`)
+		require.Contains(t, res.Body.String(), `"warnings":["failed to request upstream `+strings.TrimPrefix(closedShard.URL, "http://"))
+	})
+
+	t.Run("partial response abort", func(t *testing.T) {
+		partialBackend := mockFanOutAgent(t, partialResponseAbort,
+			"namespace:ns-a="+shardA.URL,
+			"namespace:ns-b="+closedShard.URL,
+		)
+
+		res := executeFanOutRequest(partialBackend, http.MethodGet, "/api/v1/series?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusUnprocessableEntity, res.Code)
+	})
+}
+
+func executeFanOutRequest(handler http.Handler, method, uri string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, (&url.URL{Scheme: "http", Host: "localhost:9090"}).String()+uri, body)
+	req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	return res
+}
+
+// startFakeReplica starts an HA replica which has scraped the given timestamps of a series.
+func startFakeReplica(t *testing.T, replica string, timestamps ...int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			values := make([]string, 0, len(timestamps))
+			for _, ts := range timestamps {
+				values = append(values, fmt.Sprintf(`[%d,"1"]`, ts))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+				`{"metric":{"__name__":"test_metric1","namespace":"ns-a","prometheus_replica":%q},"values":[%s]}]}}`,
+				replica, strings.Join(values, ","))
+		case "/api/v1/series":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":[`+
+				`{"__name__":"test_metric1","namespace":"ns-a","prometheus_replica":%q}]}`, replica)
+		case "/api/v1/read":
+			samples := make([]prompb.Sample, 0, len(timestamps))
+			for _, ts := range timestamps {
+				samples = append(samples, prompb.Sample{Timestamp: ts * 1000, Value: 1})
+			}
+			readResp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "namespace", Value: "ns-a"}, {Name: "prometheus_replica", Value: replica}},
+				Samples: samples,
+			}}}}}
+			respData, _ := proto.Marshal(readResp)
+			_, _ = w.Write(snappy.Encode(nil, respData))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func mockHAAgent(t *testing.T, upstreamURL string, replicaURLs ...string) http.Handler {
+	agt := mockAgentWithUpstream(t, upstreamURL)
+	agt.cfg.dedupReplicaLabel = "prometheus_replica"
+	for _, replicaURL := range replicaURLs {
+		agt.cfg.upstreamReplicas = append(agt.cfg.upstreamReplicas, upstreamURL+"="+replicaURL)
+	}
+
+	ups, err := newUpstreams(agt.cfg, prometheus.NewRegistry())
+	require.NoError(t, err)
+	agt.upstreams = ups
+
+	return agt.httpBackend()
+}
+
+func Test_fanOutDedup(t *testing.T) {
+	// replica-0 misses the samples at 90 and 105, which replica-1 has scraped
+	replica0 := startFakeReplica(t, "replica-0", 60, 75, 120, 135)
+	replica1 := startFakeReplica(t, "replica-1", 61, 76, 91, 106, 121)
+	closedReplica := httptest.NewServer(http.NotFoundHandler())
+	closedReplica.Close()
+
+	httpBackend := mockHAAgent(t, replica0.URL, replica1.URL)
+
+	t.Run("query_range", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/query_range?query=test_metric1&start=0&end=150&step=15", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"test_metric1","namespace":"ns-a"},`+
+			`"values":[[60,"1"],[75,"1"],[91,"1"],[106,"1"],[121,"1"],[135,"1"]]}]}}`, res.Body.String())
+	})
+
+	t.Run("series", func(t *testing.T) {
+		res := executeFanOutRequest(httpBackend, http.MethodGet, "/api/v1/series?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"test_metric1","namespace":"ns-a"}]}`, res.Body.String())
+	})
+
+	t.Run("read", func(t *testing.T) {
+		reqData, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{
+			StartTimestampMs: 0,
+			EndTimestampMs:   150000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test_metric1"}},
+		}}})
+		require.NoError(t, err)
+
+		res := executeFanOutRequest(httpBackend, http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, reqData)))
+		require.Equal(t, http.StatusOK, res.Code)
+
+		respData, err := snappy.Decode(nil, res.Body.Bytes())
+		require.NoError(t, err)
+		var readResp prompb.ReadResponse
+		require.NoError(t, proto.Unmarshal(respData, &readResp))
+		require.Len(t, readResp.GetResults(), 1)
+		require.Len(t, readResp.GetResults()[0].GetTimeseries(), 1)
+
+		series := readResp.GetResults()[0].GetTimeseries()[0]
+		require.Equal(t, []prompb.Label{{Name: "namespace", Value: "ns-a"}}, series.GetLabels())
+		require.Len(t, series.GetSamples(), 6)
+	})
+
+	t.Run("replica down", func(t *testing.T) {
+		downBackend := mockHAAgent(t, closedReplica.URL, replica1.URL)
+
+		res := executeFanOutRequest(downBackend, http.MethodGet, "/api/v1/series?match[]=test_metric1", nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"test_metric1","namespace":"ns-a"}]}`, res.Body.String())
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/caas-team/prometheus-auth/pkg/prom"
 	"github.com/golang/snappy"
 	"github.com/juju/errors"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	prommodel "github.com/prometheus/common/model"
 	promlb "github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
@@ -38,15 +40,20 @@ func hijackFederate(apiCtx *apiContext) error {
 
 	matchFormValues := queries["match[]"]
 	for _, rawValue := range matchFormValues {
-		_, err = parser.ParseMetricSelector(rawValue)
-		if err != nil {
+		matchers, pErr := parser.ParseMetricSelector(rawValue)
+		if pErr != nil {
+			return errors.Wrap(pErr, errBadRequest)
+		}
+
+		if err = apiCtx.checkSelector(matchers); err != nil {
 			return errors.Wrap(err, errBadRequest)
 		}
 	}
 
 	// quick response
 	if len(matchFormValues) == 0 || len(apiCtx.namespaceSet) == 0 {
-		return apiCtx.responseMetrics(nil)
+		apiCtx.quickResponse()
+		return apiCtx.responseMetrics()
 	}
 
 	ns := append(apiCtx.namespaceSet.Values(), globalNamespace)
@@ -61,11 +68,13 @@ func hijackFederate(apiCtx *apiContext) error {
 		}
 
 		log.Debugf("raw federate[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyExpression(expr, apiCtx.namespaceSet, prom.NamespaceMatchName)
+		hjkValue := apiCtx.rewriteExpression(expr, prom.NamespaceMatchName)
 		log.Debugf("hjk federate[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.audit.AddQuery(rawValue, hjkValue)
 		queries.Add("match[]", hjkValue)
-		hjkValue = modifyExpression(expr, apiCtx.namespaceSet, prom.ExportedNamespaceMatchName)
+		hjkValue = apiCtx.rewriteExpression(expr, prom.ExportedNamespaceMatchName)
 		log.Debugf("hjk federate[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.audit.AddQuery(rawValue, hjkValue)
 		queries.Add("match[]", hjkValue)
 	}
 
@@ -104,8 +113,21 @@ func hijackQuery(apiCtx *apiContext) error {
 		return errors.Wrap(err, errBadRequest)
 	}
 
+	now := time.Now()
+	evalTime := now
+	if t := req.FormValue("time"); t != "" {
+		if evalTime, err = parseTime(t); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+
+	if err = apiCtx.checkQuery(queryExpr, evalTime, evalTime, now); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		var qs *stats.QueryStats
 
 		if queryExpr.Type() != parser.ValueTypeScalar {
@@ -136,10 +158,15 @@ func hijackQuery(apiCtx *apiContext) error {
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := modifyExpression(queryExpr, apiCtx.namespaceSet, prom.NamespaceMatchName)
+	hjkValue := apiCtx.rewriteExpression(queryExpr, prom.NamespaceMatchName)
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
+	apiCtx.audit.AddQuery(rawValue, hjkValue)
 	req.Form.Set("query", hjkValue)
 
+	if err = apiCtx.checkCardinality(hjkValue, evalTime, evalTime); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
 	// inject
 	reqURL := *req.URL
 	reqURL.RawQuery = req.Form.Encode()
@@ -178,6 +205,11 @@ func hijackQueryRange(apiCtx *apiContext) error { //nolint:funlen // TODO: refac
 		return errors.Wrap(errors.New("end timestamp must not be before start time"), errBadRequest)
 	}
 
+	now := time.Now()
+	if err = apiCtx.shadow.deny(ruleQueryLimits, apiCtx.queryLimits.checkTimeRange(start, end, now)); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
 	step, err := parseDuration(req.FormValue("step"))
 	if err != nil {
 		return errors.Wrap(err, errBadRequest)
@@ -187,8 +219,14 @@ func hijackQueryRange(apiCtx *apiContext) error { //nolint:funlen // TODO: refac
 		return errors.Wrap(errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer"), errBadRequest)
 	}
 
-	if end.Sub(start)/step > maxResolutionPoints {
-		return errors.Wrap(errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"), errBadRequest)
+	// the default limit of Prometheus is the old behaviour, so it still applies if the configured limit is shadowed
+	if apiCtx.shadow.shadowed(ruleQueryLimits) {
+		if err = checkDefaultResolution(start, end, step); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+	if err = apiCtx.shadow.deny(ruleQueryLimits, apiCtx.queryLimits.checkResolution(start, end, step)); err != nil {
+		return errors.Wrap(err, errBadRequest)
 	}
 
 	queryFormValue := req.FormValue("query")
@@ -202,8 +240,13 @@ func hijackQueryRange(apiCtx *apiContext) error { //nolint:funlen // TODO: refac
 		return errors.Wrap(err, errBadRequest)
 	}
 
+	if err = apiCtx.checkQuery(queryExpr, start, end, now); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		var qs *stats.QueryStats
 
 		if queryExpr.Type() != parser.ValueTypeScalar {
@@ -234,10 +277,15 @@ func hijackQueryRange(apiCtx *apiContext) error { //nolint:funlen // TODO: refac
 	// hijack
 	req.Form.Del("query")
 	log.Debugf("raw query[%s - 0] => %s", apiCtx.tag, rawValue)
-	hjkValue := modifyExpression(queryExpr, apiCtx.namespaceSet, prom.NamespaceMatchName)
+	hjkValue := apiCtx.rewriteExpression(queryExpr, prom.NamespaceMatchName)
 	log.Debugf("hjk query[%s - 0] => %s", apiCtx.tag, hjkValue)
+	apiCtx.audit.AddQuery(rawValue, hjkValue)
 	req.Form.Set("query", hjkValue)
 
+	if err = apiCtx.checkCardinality(hjkValue, start, end); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
 	// inject
 	reqURL := *req.URL
 	reqURL.RawQuery = req.Form.Encode()
@@ -251,6 +299,80 @@ func hijackQueryRange(apiCtx *apiContext) error { //nolint:funlen // TODO: refac
 	return apiCtx.proxyWith(newReq)
 }
 
+func hijackQueryExemplars(apiCtx *apiContext) error {
+	req := apiCtx.request
+	apiCtx.response.Header().Set("Content-Type", "application/json")
+
+	// pre check
+	var start, end time.Time
+	if t := req.FormValue("start"); t != "" {
+		var err error
+		if start, err = parseTime(t); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+
+	if t := req.FormValue("end"); t != "" {
+		var err error
+		if end, err = parseTime(t); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return errors.Wrap(errors.New("end timestamp must not be before start time"), errBadRequest)
+	}
+
+	queryFormValue := req.FormValue("query")
+	if len(queryFormValue) == 0 {
+		return errors.Wrap(errors.New("unable to get 'query' value from request"), errBadRequest)
+	}
+
+	rawValue := queryFormValue
+	queryExpr, err := parser.ParseExpr(rawValue)
+	if err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
+	if err = apiCtx.checkExemplarsQuery(queryExpr); err != nil {
+		return errors.Wrap(err, errBadRequest)
+	}
+
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
+		emptyRespData := make([]promapiv1.ExemplarQueryResult, 0)
+
+		return apiCtx.responseJSON(emptyRespData)
+	}
+
+	// hijack
+	log.Debugf("raw exemplars[%s - 0] => %s", apiCtx.tag, rawValue)
+	hjkValue := apiCtx.rewriteExpression(queryExpr, prom.NamespaceMatchName)
+	log.Debugf("hjk exemplars[%s - 0] => %s", apiCtx.tag, hjkValue)
+	apiCtx.audit.AddQuery(rawValue, hjkValue)
+
+	vals := make([]promapiv1.ExemplarQueryResult, 0)
+	err = apiCtx.eachRemoteAPI(func(up *upstream) error {
+		upVals, qErr := up.api.QueryExemplars(req.Context(), hjkValue, start, end)
+		vals = append(vals, upVals...)
+		return qErr
+	})
+	if err != nil {
+		return err
+	}
+
+	// filter out the exemplars of series outside the owned namespaces
+	hjkValues := make([]promapiv1.ExemplarQueryResult, 0, len(vals))
+	for _, val := range vals {
+		if _, exist := apiCtx.namespaceSet[string(val.SeriesLabels[prom.NamespaceMatchName])]; exist {
+			hjkValues = append(hjkValues, val)
+		}
+	}
+
+	return apiCtx.responseJSON(hjkValues)
+}
+
 func hijackSeries(apiCtx *apiContext) error {
 	apiCtx.response.Header().Set("Content-Type", "application/json")
 
@@ -260,14 +382,29 @@ func hijackSeries(apiCtx *apiContext) error {
 		return errors.Wrap(err, errBadRequest)
 	}
 
+	now := time.Now()
+	var start time.Time
 	if t := queries.Get("start"); t != "" {
-		if _, err = parseTime(t); err != nil {
+		if start, err = parseTime(t); err != nil {
 			return errors.Wrap(err, errBadRequest)
 		}
 	}
 
+	end := now
 	if t := queries.Get("end"); t != "" {
-		if _, err = parseTime(t); err != nil {
+		if end, err = parseTime(t); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
+
+	// without start, the series of the whole retention are selected
+	if start.IsZero() && !apiCtx.shadow.shadowed(ruleQueryLimits) {
+		if start = apiCtx.queryLimits.earliestStart(end, now); !start.IsZero() {
+			queries.Set("start", formatTime(start))
+		}
+	}
+	if !start.IsZero() {
+		if err = apiCtx.shadow.deny(ruleQueryLimits, apiCtx.queryLimits.checkTimeRange(start, end, now)); err != nil {
 			return errors.Wrap(err, errBadRequest)
 		}
 	}
@@ -278,14 +415,19 @@ func hijackSeries(apiCtx *apiContext) error {
 	}
 
 	for _, rawValue := range matchFormValues {
-		_, err = parser.ParseMetricSelector(rawValue)
-		if err != nil {
+		matchers, pErr := parser.ParseMetricSelector(rawValue)
+		if pErr != nil {
+			return errors.Wrap(pErr, errBadRequest)
+		}
+
+		if err = apiCtx.checkSelector(matchers); err != nil {
 			return errors.Wrap(err, errBadRequest)
 		}
 	}
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		emptyRespData := make([]promlb.Labels, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
@@ -300,8 +442,9 @@ func hijackSeries(apiCtx *apiContext) error {
 		}
 
 		log.Debugf("raw series[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyExpression(expr, apiCtx.namespaceSet, prom.NamespaceMatchName)
+		hjkValue := apiCtx.rewriteExpression(expr, prom.NamespaceMatchName)
 		log.Debugf("hjk series[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.audit.AddQuery(rawValue, hjkValue)
 
 		queries.Add("match[]", hjkValue)
 	}
@@ -329,9 +472,16 @@ func hijackRead(apiCtx *apiContext) error {
 	}
 
 	rawQueries := pbreq.Queries
+	now := time.Now()
+	for _, rawQuery := range rawQueries {
+		if err = apiCtx.checkReadQuery(rawQuery, now); err != nil {
+			return errors.Wrap(err, errBadRequest)
+		}
+	}
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		size := len(rawQueries)
 
 		results := make([]*prompb.QueryResult, 0, size)
@@ -349,14 +499,21 @@ func hijackRead(apiCtx *apiContext) error {
 	// hijack
 	hjkQueries := make([]*prompb.Query, 0, len(rawQueries))
 	for idx, rawValue := range rawQueries {
-		log.Debugf("raw read[%s - %d] => %s", apiCtx.tag, idx, rawValue)
-		hjkValue := modifyQuery(rawValue, apiCtx.namespaceSet, apiCtx.filterReaderLabelSet)
+		rawString := rawValue.String()
+		log.Debugf("raw read[%s - %d] => %s", apiCtx.tag, idx, rawString)
+		hjkValue := apiCtx.rewriteQuery(rawValue)
 		log.Debugf("hjk read[%s - %d] => %s", apiCtx.tag, idx, hjkValue)
+		apiCtx.audit.AddQuery(rawString, hjkValue.String())
 
 		hjkQueries = append(hjkQueries, hjkValue)
 	}
 	pbreq.Queries = hjkQueries
 
+	// only sampled responses can be merged
+	if apiCtx.fansOut() {
+		pbreq.AcceptedResponseTypes = []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}
+	}
+
 	// inject
 	marshaledData, err := pbreq.Marshal()
 	if err != nil {
@@ -376,6 +533,7 @@ func hijackRead(apiCtx *apiContext) error {
 func hijackLabelNamespaces(apiCtx *apiContext) error {
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		emptyRespData := make([]string, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
@@ -396,35 +554,95 @@ func hijackLabelName(apiCtx *apiContext) error {
 
 	// quick response
 	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
 		emptyRespData := make([]string, 0)
 
 		return apiCtx.responseJSON(emptyRespData)
 	}
 
 	// hijack
-	expr := prom.NewExprForCountAllLabels(apiCtx.namespaceSet.Values())
-	vals, warns, err := apiCtx.remoteAPI.Query(apiCtx.request.Context(), expr, time.Time{})
-	for _, warn := range warns {
-		log.Debugf("received warning on query: %s", warn)
+	hjkValues, err := apiCtx.queryMetricNames()
+	if err != nil {
+		return err
+	}
+
+	return apiCtx.responseJSON(hjkValues)
+}
+
+func hijackMetadata(apiCtx *apiContext) error {
+	req := apiCtx.request
+	apiCtx.response.Header().Set("Content-Type", "application/json")
+
+	// pre check
+	limit := -1
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			return errors.Wrap(errors.New("limit must be a number"), errBadRequest)
+		}
+	}
+
+	metric := req.FormValue("metric")
+
+	// quick response
+	if len(apiCtx.namespaceSet) == 0 {
+		apiCtx.quickResponse()
+		emptyRespData := make(map[string][]promapiv1.Metadata)
+
+		return apiCtx.responseJSON(emptyRespData)
+	}
+
+	// hijack
+	metricNames, err := apiCtx.queryMetricNames()
+	if err != nil {
+		return err
 	}
+
+	ownedNames := make(data.Set, len(metricNames))
+	for _, name := range metricNames {
+		ownedNames[string(name)] = struct{}{}
+	}
+
+	// the limit is applied after filtering, so it is not passed to the remote
+	vals := make(map[string][]promapiv1.Metadata)
+	err = apiCtx.eachRemoteAPI(func(up *upstream) error {
+		upVals, mErr := up.api.Metadata(req.Context(), metric, "")
+		for name, md := range upVals {
+			if _, exist := vals[name]; !exist {
+				vals[name] = md
+			}
+		}
+		return mErr
+	})
 	if err != nil {
-		return errors.Wrap(err, errNotProvisioned)
+		return err
 	}
 
-	vectorVals, ok := vals.(prommodel.Vector)
-	if !ok {
-		return errors.Wrap(err, errNotProvisioned)
+	hjkValues := make(map[string][]promapiv1.Metadata)
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if limit >= 0 && len(hjkValues) >= limit {
+			break
+		}
 
-	hjkValues := make(prommodel.LabelValues, 0, len(vectorVals))
-	for _, vectorVal := range vectorVals {
-		valLabelSet := prommodel.LabelSet(vectorVal.Metric)
-		hjkValues = append(hjkValues, valLabelSet["__name__"])
+		if _, exist := ownedNames[name]; exist {
+			hjkValues[name] = vals[name]
+		}
 	}
 
 	return apiCtx.responseJSON(hjkValues)
 }
 
+// proxyLabelValues proxies the request unchanged to the upstream of the tenant.
+func proxyLabelValues(apiCtx *apiContext) error {
+	return apiCtx.proxyWith(apiCtx.request)
+}
+
 func parseTime(s string) (time.Time, error) {
 	if t, err := strconv.ParseFloat(s, 64); err == nil {
 		s, ns := math.Modf(t)
@@ -437,6 +655,10 @@ func parseTime(s string) (time.Time, error) {
 	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
 }
 
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/float64(time.Second/time.Millisecond), 'f', -1, 64)
+}
+
 func parseDuration(s string) (time.Duration, error) {
 	if d, err := strconv.ParseFloat(s, 64); err == nil {
 		ts := d * float64(time.Second)
@@ -451,6 +673,54 @@ func parseDuration(s string) (time.Duration, error) {
 	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
 }
 
+// checkQuery checks the expression of an instant or range query against the limits of the tenant,
+// both when hijacking the query and when replaying it.
+func (c *apiContext) checkQuery(expr parser.Expr, start, end, now time.Time) error {
+	if err := c.shadow.deny(ruleQueryLimits, c.queryLimits.checkExpr(expr, start, end, now)); err != nil {
+		return err
+	}
+	if err := c.shadow.deny(ruleDeniedMetrics, c.queryLimits.checkDeniedMetrics(expr)); err != nil {
+		return err
+	}
+	if err := c.checkComplexity(expr); err != nil {
+		return err
+	}
+
+	return c.checkShardable(expr)
+}
+
+// checkExemplarsQuery checks the expression of an exemplars query against the limits of the tenant.
+func (c *apiContext) checkExemplarsQuery(expr parser.Expr) error {
+	if err := c.shadow.deny(ruleDeniedMetrics, c.queryLimits.checkDeniedMetrics(expr)); err != nil {
+		return err
+	}
+
+	return c.checkComplexity(expr)
+}
+
+// checkSelector checks a series selector of the series or federate endpoint against the limits of the tenant.
+func (c *apiContext) checkSelector(matchers []*promlb.Matcher) error {
+	if err := c.shadow.deny(ruleDeniedMetrics, c.queryLimits.checkDeniedMatchers(matchers)); err != nil {
+		return err
+	}
+
+	return c.checkComplexity(&parser.VectorSelector{LabelMatchers: matchers})
+}
+
+// checkReadQuery checks a remote read query against the limits of the tenant.
+func (c *apiContext) checkReadQuery(query *prompb.Query, now time.Time) error {
+	if err := c.shadow.deny(ruleQueryLimits, c.queryLimits.checkReadQuery(query, now)); err != nil {
+		return err
+	}
+
+	matchers, err := remote.FromLabelMatchers(query.GetMatchers())
+	if err != nil {
+		return err
+	}
+
+	return c.shadow.deny(ruleDeniedMetrics, c.queryLimits.checkDeniedMatchers(matchers))
+}
+
 // modifyExpression modifies the given PromQL expression by adding a namespace label matcher
 // to the selectors within the expression, to match the passed namespaceSet.
 func modifyExpression(originalExpr parser.Expr, namespaceSet data.Set, labelName string) string {
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// requestMetrics instruments the access controlled requests,
+// the tenant label only takes the project IDs, so that its cardinality is bounded by the projects.
+type requestMetrics struct {
+	requests        *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	rewriteDuration *prometheus.HistogramVec
+	quickResponses  *prometheus.CounterVec
+}
+
+func newRequestMetrics(reg prometheus.Registerer) *requestMetrics {
+	m := &requestMetrics{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_requests_total",
+				Help: "The total number of access controlled requests by route, method, status code and project.",
+			},
+			[]string{"route", "method", "code", "tenant"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "prometheus_auth_request_duration_seconds",
+				Help:    "The duration of the access controlled requests by route, method, status code and project.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route", "method", "code", "tenant"},
+		),
+		rewriteDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "prometheus_auth_rewrite_duration_seconds",
+				Help:    "The duration of injecting the namespaces into the queries by route.",
+				Buckets: []float64{0.00001, 0.0001, 0.001, 0.01, 0.1}, //nolint:mnd // rewrites take microseconds
+			},
+			[]string{"route"},
+		),
+		quickResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_quick_responses_total",
+				Help: "The total number of requests answered with an empty result without querying the upstream, by route.",
+			},
+			[]string{"route"},
+		),
+	}
+	reg.MustRegister(m.requests, m.duration, m.rewriteDuration, m.quickResponses)
+
+	return m
+}
+
+func (m *requestMetrics) observe(route string, r *http.Request, status int, projectID string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, r.Method, code, projectID).Inc()
+	m.duration.WithLabelValues(route, r.Method, code, projectID).Observe(time.Since(start).Seconds())
+}
+
+// routeOf returns the path template of the route which the request matched.
+func routeOf(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+
+	return r.URL.Path
+}
+
+// rewriteExpression injects the namespaces into the expression, tracing and timing the rewrite.
+func (c *apiContext) rewriteExpression(expr parser.Expr, labelName string) string {
+	_, span := startSpan(c.request.Context(), "rewrite", attribute.String("label", labelName))
+	defer span.End()
+	if c.requestMetrics != nil {
+		defer c.observeRewrite(time.Now())
+	}
+
+	return modifyExpression(expr, c.namespaceSet, labelName)
+}
+
+// rewriteQuery injects the namespaces into the remote read query, tracing and timing the rewrite.
+func (c *apiContext) rewriteQuery(query *prompb.Query) *prompb.Query {
+	_, span := startSpan(c.request.Context(), "rewrite")
+	defer span.End()
+	if c.requestMetrics != nil {
+		defer c.observeRewrite(time.Now())
+	}
+
+	return modifyQuery(query, c.namespaceSet, c.filterReaderLabelSet)
+}
+
+func (c *apiContext) observeRewrite(start time.Time) {
+	c.requestMetrics.rewriteDuration.WithLabelValues(c.route).Observe(time.Since(start).Seconds())
+}
+
+// quickResponse counts the request which is answered without querying the upstream.
+func (c *apiContext) quickResponse() {
+	if c.requestMetrics != nil {
+		c.requestMetrics.quickResponses.WithLabelValues(c.route).Inc()
+	}
+}
+
+// responseRecorder records the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = statusCode, true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets the http.ResponseController reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_requestMetrics(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query":            map[string]interface{}{"resultType": "vector", "result": []interface{}{}},
+		"/api/v1/label/job/values": []string{"prometheus"},
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.requestMetrics = newRequestMetrics(agt.registry)
+	httpBackend := agt.httpBackend()
+
+	doRequest := func(token string, path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090"+path, nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res.Code
+	}
+	query := "/api/v1/query?" + url.Values{"query": {"sum(up)"}}.Encode()
+
+	require.Equal(t, http.StatusOK, doRequest("someNamespacesToken", query))
+	require.Equal(t, http.StatusOK, doRequest("someNamespacesToken", "/api/v1/label/job/values"))
+	require.Equal(t, http.StatusOK, doRequest("noneNamespacesToken", query))
+	require.Equal(t, http.StatusUnauthorized, doRequest("unknownToken", query))
+
+	requests := agt.requestMetrics.requests
+	require.InDelta(t, 1, testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", http.MethodGet, "200", "p-some")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(requests.WithLabelValues("/api/v1/label/{name}/values", http.MethodGet, "200", "p-some")), 0)
+	// the tenants without a project are not attributed
+	require.InDelta(t, 1, testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", http.MethodGet, "200", "")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(requests.WithLabelValues("/api/v1/query", http.MethodGet, "401", "")), 0)
+	require.Equal(t, 4, testutil.CollectAndCount(agt.requestMetrics.duration))
+
+	require.InDelta(t, 1, testutil.ToFloat64(agt.requestMetrics.quickResponses.WithLabelValues("/api/v1/query")), 0)
+	require.Equal(t, 1, testutil.CollectAndCount(agt.requestMetrics.rewriteDuration))
+
+	require.Equal(t, 1, testutil.CollectAndCount(agt.registry, "prometheus_auth_upstream_request_duration_seconds"))
+	require.InDelta(t, 0, testutil.ToFloat64(agt.upstreams.defaultUpstream.transport.errors), 0)
+}
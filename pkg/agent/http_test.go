@@ -30,7 +30,6 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	jsoniter "github.com/json-iterator/go"
-	promapi "github.com/prometheus/client_golang/api"
 	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
@@ -40,6 +39,7 @@ import (
 	promtsdb "github.com/prometheus/prometheus/tsdb"
 	promweb "github.com/prometheus/prometheus/web"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	authentication "k8s.io/api/authentication/v1"
 )
 
@@ -375,31 +375,34 @@ func startPrometheusWebHandler(t *testing.T, webHandler *promweb.Handler) {
 }
 
 func mockAgent(t *testing.T) *agent {
-	proxyURL, err := url.Parse("http://localhost:9090")
+	return mockAgentWithUpstream(t, "http://localhost:9090")
+}
+
+func mockAgentWithUpstream(t *testing.T, upstreamURL string) *agent {
+	proxyURL, err := url.Parse(upstreamURL)
 	if err != nil {
 		t.Error(err)
 	}
 
 	agtCfg := &agentConfig{
-		ctx:      context.Background(),
-		myToken:  "myToken",
-		proxyURL: proxyURL,
+		ctx:          context.Background(),
+		myToken:      "myToken",
+		proxyURLs:    []*url.URL{proxyURL},
+		upstreamMode: upstreamModeRewrite,
 		filterReaderLabelSet: data.NewSet(
 			"prometheus",
 			"prometheus_replica",
 		),
 	}
 
-	// create Prometheus client
-	promClient, err := promapi.NewClient(promapi.Config{
-		Address: proxyURL.String(),
-	})
+	registry := prometheus.NewRegistry()
+
+	// create Prometheus upstreams
+	upstreams, err := newUpstreams(agtCfg, registry)
 	if err != nil {
 		t.Error(err)
 	}
 
-	registry := prometheus.NewRegistry()
-
 	return &agent{
 		cfg: agtCfg,
 		userInfo: authentication.UserInfo{
@@ -408,8 +411,11 @@ func mockAgent(t *testing.T) *agent {
 		},
 		namespaces: mockOwnedNamespaces(),
 		tokens:     mockTokenAuth(),
-		remoteAPI:  promapiv1.NewAPI(promClient),
+		upstreams:  upstreams,
 		registry:   registry,
+		tracerProvider: sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.NeverSample()),
+		),
 	}
 }
 
@@ -626,18 +632,35 @@ func sortReadResponse(rr *prompb.ReadResponse) {
 
 type fakeOwnedNamespaces struct {
 	token2Namespaces map[string]data.Set
+	token2ProjectID  map[string]string
+	unsynced         bool
 }
 
 func (f *fakeOwnedNamespaces) Query(token string) data.Set {
 	return f.token2Namespaces[token]
 }
 
+func (f *fakeOwnedNamespaces) ProjectID(token string) string {
+	return f.token2ProjectID[token]
+}
+
+func (f *fakeOwnedNamespaces) Resolve(token string) (string, data.Set) {
+	return f.token2ProjectID[token], f.token2Namespaces[token]
+}
+
+func (f *fakeOwnedNamespaces) HasSynced() bool {
+	return !f.unsynced
+}
+
 func mockOwnedNamespaces() kube.Namespaces {
 	return &fakeOwnedNamespaces{
 		token2Namespaces: map[string]data.Set{
 			"noneNamespacesToken": {},
 			"someNamespacesToken": data.NewSet("ns-a", "ns-b"),
 		},
+		token2ProjectID: map[string]string{
+			"someNamespacesToken": "p-some",
+		},
 	}
 }
 
@@ -683,3 +706,227 @@ func (a *dbAdapter) Stats(statsByLabelName string, limit int) (*promtsdb.Stats,
 func (a *dbAdapter) WALReplayStatus() (promtsdb.WALReplayStatus, error) {
 	return promtsdb.WALReplayStatus{}, nil
 }
+
+// startFakePrometheus starts an upstream which answers the given API paths with
+// the given JSON data, wrapped into a successful Prometheus API response.
+func startFakePrometheus(t *testing.T, responses map[string]interface{}) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respData, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "success", Data: respData})))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func Test_hijackMetadata(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query": map[string]interface{}{
+			"resultType": "vector",
+			"result": []map[string]interface{}{
+				{"metric": map[string]string{"__name__": "test_metric1"}, "value": []interface{}{0, "2"}},
+				{"metric": map[string]string{"__name__": "test_metric3"}, "value": []interface{}{0, "1"}},
+			},
+		},
+		"/api/v1/metadata": map[string][]promapiv1.Metadata{
+			"test_metric1": {{Type: "counter", Help: "owned", Unit: ""}},
+			"test_metric2": {{Type: "gauge", Help: "not owned", Unit: ""}},
+			"test_metric3": {{Type: "gauge", Help: "owned", Unit: ""}},
+		},
+	})
+	httpBackend := mockAgentWithUpstream(t, upstream.URL).httpBackend()
+
+	cases := []struct {
+		name    string
+		token   string
+		queries url.Values
+		want    map[string][]promapiv1.Metadata
+	}{
+		{
+			name:  "none namespaces",
+			token: "noneNamespacesToken",
+			want:  map[string][]promapiv1.Metadata{},
+		},
+		{
+			name:  "some namespaces",
+			token: "someNamespacesToken",
+			want: map[string][]promapiv1.Metadata{
+				"test_metric1": {{Type: "counter", Help: "owned", Unit: ""}},
+				"test_metric3": {{Type: "gauge", Help: "owned", Unit: ""}},
+			},
+		},
+		{
+			name:    "some namespaces with limit",
+			token:   "someNamespacesToken",
+			queries: url.Values{"limit": []string{"1"}},
+			want: map[string][]promapiv1.Metadata{
+				"test_metric1": {{Type: "counter", Help: "owned", Unit: ""}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/metadata?"+c.queries.Encode(), nil)
+			req.Header.Set(authorizationHeaderKey, "Bearer "+c.token)
+			res := httptest.NewRecorder()
+			httpBackend.ServeHTTP(res, req)
+
+			require.Equal(t, http.StatusOK, res.Code)
+			require.JSONEq(t, jsonResponseBody(&jsonResponseData{Status: "success", Data: c.want}), res.Body.String())
+		})
+	}
+}
+
+func Test_hijackQueryExemplars(t *testing.T) {
+	exemplars := []promapiv1.Exemplar{
+		{Labels: model.LabelSet{"trace_id": "abc"}, Value: 1, Timestamp: 1000},
+	}
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query_exemplars": []promapiv1.ExemplarQueryResult{
+			{SeriesLabels: model.LabelSet{"__name__": "test_metric1", "namespace": "ns-a"}, Exemplars: exemplars},
+			{SeriesLabels: model.LabelSet{"__name__": "test_metric1", "namespace": "ns-c"}, Exemplars: exemplars},
+			{SeriesLabels: model.LabelSet{"__name__": "test_metric2"}, Exemplars: exemplars},
+		},
+	})
+	httpBackend := mockAgentWithUpstream(t, upstream.URL).httpBackend()
+
+	cases := []struct {
+		name     string
+		token    string
+		queries  url.Values
+		wantCode int
+		want     *jsonResponseData
+	}{
+		{
+			name:     "none namespaces",
+			token:    "noneNamespacesToken",
+			queries:  url.Values{"query": []string{"test_metric1"}},
+			wantCode: http.StatusOK,
+			want:     &jsonResponseData{Status: "success", Data: []promapiv1.ExemplarQueryResult{}},
+		},
+		{
+			name:     "some namespaces",
+			token:    "someNamespacesToken",
+			queries:  url.Values{"query": []string{"test_metric1"}, "start": []string{"0"}, "end": []string{"10"}},
+			wantCode: http.StatusOK,
+			want: &jsonResponseData{Status: "success", Data: []promapiv1.ExemplarQueryResult{
+				{SeriesLabels: model.LabelSet{"__name__": "test_metric1", "namespace": "ns-a"}, Exemplars: exemplars},
+			}},
+		},
+		{
+			name:     "invalid time range",
+			token:    "someNamespacesToken",
+			queries:  url.Values{"query": []string{"test_metric1"}, "start": []string{"10"}, "end": []string{"0"}},
+			wantCode: http.StatusBadRequest,
+			want:     &jsonResponseData{Status: "error", ErrorType: "bad_data", Error: "end timestamp must not be before start time"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query_exemplars?"+c.queries.Encode(), nil)
+			req.Header.Set(authorizationHeaderKey, "Bearer "+c.token)
+			res := httptest.NewRecorder()
+			httpBackend.ServeHTTP(res, req)
+
+			require.Equal(t, c.wantCode, res.Code)
+			require.JSONEq(t, jsonResponseBody(c.want), res.Body.String())
+		})
+	}
+}
+
+func Test_accessControlTenantHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s", r.Header.Get("X-Scope-OrgID"), r.URL.Query().Get("query"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cases := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		source   string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "project",
+			token:    "someNamespacesToken",
+			source:   tenantIDSourceProject,
+			wantCode: http.StatusOK,
+			wantBody: "p-some test_metric1",
+		},
+		{
+			name:     "namespaces",
+			token:    "someNamespacesToken",
+			source:   tenantIDSourceNamespaces,
+			wantCode: http.StatusOK,
+			wantBody: "ns-a|ns-b test_metric1",
+		},
+		{
+			name:     "no tenant",
+			token:    "noneNamespacesToken",
+			source:   tenantIDSourceProject,
+			wantCode: http.StatusForbidden,
+			wantBody: "unable to resolve tenant\n",
+		},
+		{
+			name:     "admin API",
+			method:   http.MethodPost,
+			target:   "/api/v1/admin/tsdb/delete_series?match[]=test_metric1",
+			token:    "someNamespacesToken",
+			source:   tenantIDSourceProject,
+			wantCode: http.StatusUnauthorized,
+			wantBody: "unauthorized\n",
+		},
+		{
+			name:     "remote write",
+			method:   http.MethodPost,
+			target:   "/api/v1/push",
+			token:    "someNamespacesToken",
+			source:   tenantIDSourceProject,
+			wantCode: http.StatusUnauthorized,
+			wantBody: "unauthorized\n",
+		},
+		{
+			name:     "reload",
+			method:   http.MethodPost,
+			target:   "/-/reload",
+			token:    "someNamespacesToken",
+			source:   tenantIDSourceProject,
+			wantCode: http.StatusUnauthorized,
+			wantBody: "unauthorized\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			agt := mockAgentWithUpstream(t, upstream.URL)
+			agt.cfg.upstreamMode = upstreamModeTenantHeader
+			agt.cfg.tenantHeader = "X-Scope-OrgID"
+			agt.cfg.tenantIDSource = c.source
+
+			method, target := c.method, c.target
+			if len(method) == 0 {
+				method, target = http.MethodGet, "/api/v1/query?query=test_metric1"
+			}
+
+			req := httptest.NewRequest(method, "http://localhost:9090"+target, nil)
+			req.Header.Set(authorizationHeaderKey, "Bearer "+c.token)
+			req.Header.Set("X-Scope-OrgID", "spoofed")
+			res := httptest.NewRecorder()
+			agt.httpBackend().ServeHTTP(res, req)
+
+			require.Equal(t, c.wantCode, res.Code)
+			require.Equal(t, c.wantBody, res.Body.String())
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// endpointClass groups the hijacked API endpoints which cost the upstream alike.
+type endpointClass string
+
+const (
+	endpointClassInstant  endpointClass = "instant"
+	endpointClassRange    endpointClass = "range"
+	endpointClassSeries   endpointClass = "series"
+	endpointClassRead     endpointClass = "read"
+	endpointClassFederate endpointClass = "federate"
+)
+
+var endpointClasses = []endpointClass{ //nolint:gochecknoglobals // list of constants
+	endpointClassInstant, endpointClassRange, endpointClassSeries, endpointClassRead, endpointClassFederate,
+}
+
+// endpointClassOf returns the class of the API path, or an empty class if it is not limited.
+func endpointClassOf(path string) endpointClass {
+	switch {
+	case path == "/api/v1/query":
+		return endpointClassInstant
+	case path == "/api/v1/query_range", path == "/api/v1/query_exemplars":
+		return endpointClassRange
+	case path == "/api/v1/series", path == "/api/v1/labels", path == "/api/v1/metadata",
+		strings.HasPrefix(path, "/api/v1/label/"):
+		return endpointClassSeries
+	case path == "/api/v1/read":
+		return endpointClassRead
+	case path == "/federate":
+		return endpointClassFederate
+	}
+
+	return ""
+}
+
+// rateLimit is a token bucket, which is refilled with the given number of requests per second.
+type rateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// concurrencyLimit caps the in-flight upstream queries, the excess queries wait in a bounded queue.
+type concurrencyLimit struct {
+	MaxInFlight int `yaml:"max_in_flight"`
+	MaxQueued   int `yaml:"max_queued"`
+}
+
+// tenantLimits are the limits of a tenant, unset limits fall back to the defaults.
+type tenantLimits struct {
+	RateLimits  map[endpointClass]*rateLimit `yaml:"rate_limits,omitempty"`
+	Concurrency *concurrencyLimit            `yaml:"concurrency,omitempty"`
+	QueryLimits *queryLimits                 `yaml:"query_limits,omitempty"`
+	// Shadow lists the rules whose denials are only reported, or 'all'.
+	Shadow []string `yaml:"shadow,omitempty"`
+}
+
+// tenantLimitsConfig is the content of the limits config file.
+type tenantLimitsConfig struct {
+	Defaults tenantLimits            `yaml:"defaults"`
+	Tenants  map[string]tenantLimits `yaml:"tenants,omitempty"`
+}
+
+// loadTenantLimitsConfig loads the limits config file.
+func loadTenantLimitsConfig(path string) (*tenantLimitsConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read limits config %q", path)
+	}
+
+	limitsCfg := &tenantLimitsConfig{}
+	if err = yaml.UnmarshalStrict(content, limitsCfg); err != nil {
+		return nil, errors.Annotatef(err, "invalid limits config %q", path)
+	}
+	if err = limitsCfg.validate(); err != nil {
+		return nil, errors.Annotatef(err, "invalid limits config %q", path)
+	}
+
+	return limitsCfg, nil
+}
+
+func (c *tenantLimitsConfig) validate() error {
+	if err := c.Defaults.validate(); err != nil {
+		return errors.Annotate(err, "defaults")
+	}
+	for tenant, limits := range c.Tenants {
+		if err := limits.validate(); err != nil {
+			return errors.Annotatef(err, "tenant %q", tenant)
+		}
+	}
+
+	return nil
+}
+
+func (l *tenantLimits) validate() error {
+	for class, limit := range l.RateLimits {
+		if !slices.Contains(endpointClasses, class) {
+			return errors.Errorf("unknown endpoint class %q", class)
+		}
+		if limit == nil {
+			// disables the default limit for a tenant
+			continue
+		}
+		if limit.RequestsPerSecond <= 0 || limit.Burst <= 0 {
+			return errors.Errorf("rate limit of %q must have positive requests_per_second and burst", class)
+		}
+	}
+
+	if l.Concurrency != nil && (l.Concurrency.MaxInFlight <= 0 || l.Concurrency.MaxQueued < 0) {
+		return errors.New("concurrency must have positive max_in_flight and non-negative max_queued")
+	}
+	if err := validateShadowRules(l.Shadow); err != nil {
+		return err
+	}
+	if l.QueryLimits != nil {
+		return l.QueryLimits.validate()
+	}
+
+	return nil
+}
+
+// rateLimit returns the rate limit of the tenant for the endpoint class, or nil if it is not limited.
+func (c *tenantLimitsConfig) rateLimit(tenant string, class endpointClass) *rateLimit {
+	if limits, exist := c.Tenants[tenant]; exist {
+		if limit, set := limits.RateLimits[class]; set {
+			return limit
+		}
+	}
+
+	return c.Defaults.RateLimits[class]
+}
+
+// concurrencyLimit returns the concurrency limit of the tenant, or nil if it is not limited.
+func (c *tenantLimitsConfig) concurrencyLimit(tenant string) *concurrencyLimit {
+	if limits, exist := c.Tenants[tenant]; exist && limits.Concurrency != nil {
+		return limits.Concurrency
+	}
+
+	return c.Defaults.Concurrency
+}
+
+// queryLimits returns the query limits of the tenant, or nil if there are none.
+func (c *tenantLimitsConfig) queryLimits(tenant string) *queryLimits {
+	if c == nil {
+		return nil
+	}
+	if limits, exist := c.Tenants[tenant]; exist && limits.QueryLimits != nil {
+		return limits.QueryLimits
+	}
+
+	return c.Defaults.QueryLimits
+}
+
+// shadowRules returns the shadowed rules of the tenant.
+func (c *tenantLimitsConfig) shadowRules(tenant string) []string {
+	if limits, exist := c.Tenants[tenant]; exist && limits.Shadow != nil {
+		return limits.Shadow
+	}
+
+	return c.Defaults.Shadow
+}
+
+// hasConcurrencyLimits tells whether any tenant has a concurrency limit.
+func (c *tenantLimitsConfig) hasConcurrencyLimits() bool {
+	if c.Defaults.Concurrency != nil {
+		return true
+	}
+	for _, limits := range c.Tenants {
+		if limits.Concurrency != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitsTenant returns the tenant whose limits apply, which is the tenant ID
+// or the '|'-joined list of namespaces if the token is not bound to a project.
+func (a *agent) limitsTenant(projectID string, namespaceSet data.Set) string {
+	if tenant := a.tenantID(projectID, namespaceSet); len(tenant) != 0 {
+		return tenant
+	}
+
+	return strings.Join(namespaceSet.Values(), "|")
+}
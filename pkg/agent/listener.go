@@ -1,79 +1,61 @@
 package agent
 
 import (
-	"fmt"
-	"io"
+	"crypto/tls"
 	"net"
+	"net/http"
 	"strings"
 
 	"github.com/cockroachdb/cmux"
+	"github.com/juju/errors"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
 )
 
-const (
-	authorizationHeaderKey = "Authorization"
-	tableSize              = uint32(4 << 10) // 4 KiB
-)
+const authorizationHeaderKey = "Authorization"
+
+// newListenerTLSConfig creates the TLS config of the listener, which negotiates HTTP/2 and HTTP/1.1 via ALPN.
+func newListenerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load TLS certificate %q and key %q", certFile, keyFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
 
+// createHTTPListener matches HTTP/1.1 and HTTP/2 connections, the latter are served by the h2c handler.
 func createHTTPListener(mux cmux.CMux) net.Listener {
 	return mux.Match(
 		cmux.HTTP1Fast(),
+		cmux.HTTP2(),
 	)
 }
 
-func createGRPCListener(mux cmux.CMux, hostAccessToken string) net.Listener {
-	return mux.Match(
-		http2HeaderFieldEqual(map[string]string{
-			"Content-Type":         "application/grpc",
-			authorizationHeaderKey: fmt.Sprintf("Bearer %s", hostAccessToken),
-		}),
-	)
+// grpcDispatchHandler passes the gRPC requests to the gRPC server, which authenticates them per stream,
+// and all other requests to the HTTP backend.
+// The gRPC requests are told apart per request instead of per connection,
+// since gRPC clients wait for the server settings before sending the first headers.
+func grpcDispatchHandler(grpcServer http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && isGRPCContentType(r.Header.Get("Content-Type")) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
-func hasHTTP2Preface(r io.Reader) bool {
-	var b [len(http2.ClientPreface)]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
+// isGRPCContentType matches "application/grpc" and its subtypes like "application/grpc+proto".
+func isGRPCContentType(value string) bool {
+	subtype, found := strings.CutPrefix(value, "application/grpc")
+	if !found {
 		return false
 	}
 
-	return string(b[:]) == http2.ClientPreface
-}
-
-func http2HeaderFieldEqual(nameValuePairs map[string]string) cmux.Matcher { //nolint:gocognit // function is fine
-	return func(r io.Reader) bool {
-		if !hasHTTP2Preface(r) {
-			return false
-		}
-
-		var matched bool
-		framer := http2.NewFramer(io.Discard, r)
-		hdec := hpack.NewDecoder(tableSize, func(hf hpack.HeaderField) {
-			for name, value := range nameValuePairs {
-				matched = strings.EqualFold(hf.Name, name) && hf.Value == value
-				if !matched {
-					break
-				}
-			}
-		})
-		for {
-			f, err := framer.ReadFrame()
-			if err != nil {
-				return false
-			}
-
-			if f, ok := f.(*http2.HeadersFrame); ok {
-				if _, err = hdec.Write(f.HeaderBlockFragment()); err != nil {
-					return false
-				}
-				if matched {
-					return true
-				}
-
-				if f.Flags&http2.FlagHeadersEndHeaders != 0 {
-					return false
-				}
-			}
-		}
-	}
+	return len(subtype) == 0 || subtype[0] == '+' || subtype[0] == ';'
 }
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func Test_isGRPCContentType(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/json":               false,
+		"":                               false,
+	} {
+		require.Equal(t, expected, isGRPCContentType(value), value)
+	}
+}
+
+func Test_serveProtocols(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query": map[string]interface{}{
+			"resultType": "vector",
+			"result": []map[string]interface{}{
+				{"metric": map[string]string{"__name__": "test_metric1"}, "value": []interface{}{0, "1"}},
+			},
+		},
+		"/api/v1/metadata": map[string][]promapiv1.Metadata{
+			"test_metric1": {{Type: "counter", Help: "owned"}},
+			"test_metric2": {{Type: "gauge", Help: "not owned"}},
+		},
+	})
+
+	// reuse the self-signed certificate of a test server for the listener
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsSrv.Close)
+	certFile, keyFile := writeTLSCertificate(t, tlsSrv.TLS.Certificates[0])
+	certPool := x509.NewCertPool()
+	certPool.AddCert(tlsSrv.Certificate())
+
+	cleartext := startServingAgent(t, upstream.URL, "", "")
+	secure := startServingAgent(t, upstream.URL, certFile, keyFile)
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	h2Client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: certPool, MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+	}}
+
+	clients := []struct {
+		name   string
+		client *http.Client
+		url    string
+		proto  int
+	}{
+		{name: "HTTP/1.1", client: http.DefaultClient, url: "http://" + cleartext, proto: 1},
+		{name: "h2c", client: h2cClient, url: "http://" + cleartext, proto: 2},
+		{name: "h2", client: h2Client, url: "https://" + secure, proto: 2},
+	}
+	for _, c := range clients {
+		t.Run(c.name, func(t *testing.T) {
+			doRequest := func(token string) (*http.Response, string) {
+				req, err := http.NewRequest(http.MethodGet, c.url+"/api/v1/metadata", nil)
+				require.NoError(t, err)
+				if len(token) != 0 {
+					req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+				}
+
+				res, err := c.client.Do(req)
+				require.NoError(t, err)
+				defer res.Body.Close()
+				body, err := io.ReadAll(res.Body)
+				require.NoError(t, err)
+
+				return res, string(body)
+			}
+
+			res, body := doRequest("someNamespacesToken")
+			require.Equal(t, c.proto, res.ProtoMajor)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			require.Contains(t, body, "test_metric1")
+			require.NotContains(t, body, "test_metric2")
+
+			res, _ = doRequest("")
+			require.Equal(t, c.proto, res.ProtoMajor)
+			require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		})
+	}
+
+	grpcTargets := []struct {
+		name  string
+		addr  string
+		creds credentials.TransportCredentials
+	}{
+		{name: "gRPC", addr: cleartext, creds: insecure.NewCredentials()},
+		{name: "gRPC over TLS", addr: secure, creds: credentials.NewTLS(&tls.Config{RootCAs: certPool, MinVersion: tls.VersionTLS12})},
+	}
+	for _, c := range grpcTargets {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := grpc.NewClient(c.addr, grpc.WithTransportCredentials(c.creds))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// reaching the gRPC server, which rejects streams without token
+			err = conn.Invoke(context.Background(), grpcMethodStoreInfo, &emptypb.Empty{}, &emptypb.Empty{})
+			require.Equal(t, codes.Unauthenticated, status.Code(err))
+		})
+	}
+}
+
+// startServingAgent serves the agent on a local listener, with TLS if the certificate is given,
+// and returns its address.
+func startServingAgent(t *testing.T, upstreamURL, certFile, keyFile string) string {
+	agt := mockAgentWithUpstream(t, upstreamURL)
+	agt.grpcMetrics = newGRPCStreamMetrics(agt.registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	agt.cfg.ctx = ctx
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if len(certFile) != 0 {
+		tlsConfig, tErr := newListenerTLSConfig(certFile, keyFile)
+		require.NoError(t, tErr)
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	agt.listener = listener
+	agt.adminListener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = agt.serve(ctx) }()
+
+	return listener.Addr().String()
+}
+
+func writeTLSCertificate(t *testing.T, cert tls.Certificate) (string, string) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"os"
+
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// namespacesMapping maps the tenants to their candidate namespaces, by project or by user,
+// the tenants which are not mapped keep the resolved namespaces.
+type namespacesMapping struct {
+	Projects map[string][]string `yaml:"projects,omitempty"`
+	Users    map[string][]string `yaml:"users,omitempty"`
+}
+
+func loadNamespacesMapping(path string) (*namespacesMapping, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read namespace mapping %q", path)
+	}
+
+	mapping := &namespacesMapping{}
+	if err = yaml.UnmarshalStrict(content, mapping); err != nil {
+		return nil, errors.Annotatef(err, "invalid namespace mapping %q", path)
+	}
+
+	return mapping, nil
+}
+
+// lookup returns the candidate namespaces of the tenant, and whether the tenant is mapped,
+// the project takes precedence over the user.
+func (m *namespacesMapping) lookup(projectID, user string) (data.Set, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	if namespaces, exist := m.Projects[projectID]; exist && len(projectID) != 0 {
+		return data.NewSet(namespaces...), true
+	}
+	if namespaces, exist := m.Users[user]; exist && len(user) != 0 {
+		return data.NewSet(namespaces...), true
+	}
+
+	return nil, false
+}
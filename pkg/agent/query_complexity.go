@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"github.com/caas-team/prometheus-auth/pkg/prom"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryComplexityMetrics records the scores of the analyzed queries and the rejected ones.
+type queryComplexityMetrics struct {
+	score    prometheus.Histogram
+	rejected prometheus.Counter
+}
+
+func newQueryComplexityMetrics(reg prometheus.Registerer) *queryComplexityMetrics {
+	m := &queryComplexityMetrics{
+		score: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prometheus_auth_query_complexity_score",
+			Help:    "The complexity scores of the tenant queries by static analysis.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 7), //nolint:mnd // scores from 1 to 4096
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_auth_query_complexity_rejections_total",
+			Help: "The total number of tenant queries rejected for exceeding the cost budget.",
+		}),
+	}
+	reg.MustRegister(m.score, m.rejected)
+
+	return m
+}
+
+// checkComplexity scores the expression and rejects it if it exceeds the cost budget of the tenant.
+func (c *apiContext) checkComplexity(expr parser.Expr) error {
+	complexity := prom.AnalyzeComplexity(expr, prom.DefaultComplexityWeights(), prom.DefaultHighCardinalityLabels())
+	log.Debugf("cost[%s] => %.2f %+v", c.tag, complexity.Score, complexity)
+	if c.complexityMetrics != nil {
+		c.complexityMetrics.score.Observe(complexity.Score)
+	}
+
+	if c.queryLimits == nil || c.queryLimits.MaxQueryCost <= 0 || complexity.Score <= c.queryLimits.MaxQueryCost {
+		return nil
+	}
+
+	err := c.shadow.deny(ruleQueryCost, errors.Errorf("the query cost of %.1f exceeds the budget of %.1f, "+
+		"try selecting metric names, fewer regex matchers, shorter windows or grouping by fewer labels",
+		complexity.Score, c.queryLimits.MaxQueryCost))
+	if err != nil && c.complexityMetrics != nil {
+		c.complexityMetrics.rejected.Inc()
+	}
+	return err
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	prommodel "github.com/prometheus/common/model"
+	promlb "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// queryLimits bound the time ranges a tenant may query, unset limits are not enforced,
+// except the resolution which defaults to the one of Prometheus.
+type queryLimits struct {
+	// MaxQueryRange bounds the duration between start and end.
+	MaxQueryRange prommodel.Duration `yaml:"max_query_range,omitempty"`
+	// MaxLookback bounds how far in the past the queried data may be, including offsets and windows.
+	MaxLookback prommodel.Duration `yaml:"max_lookback,omitempty"`
+	// MaxRangeWindow bounds the windows of the range vector selectors like 'foo[1h]'.
+	MaxRangeWindow prommodel.Duration `yaml:"max_range_window,omitempty"`
+	// MaxSubqueryWindow bounds the windows of the subqueries like 'foo[1d:5m]'.
+	MaxSubqueryWindow prommodel.Duration `yaml:"max_subquery_window,omitempty"`
+	// MaxResolutionPoints bounds the points per series of a range query.
+	MaxResolutionPoints int64 `yaml:"max_resolution_points,omitempty"`
+	// MaxQueryCost bounds the complexity score of the query expressions.
+	MaxQueryCost float64 `yaml:"max_query_cost,omitempty"`
+	// MaxSeries bounds the series the selectors of a query touch, checked upstream before the query.
+	MaxSeries int `yaml:"max_series,omitempty"`
+	// MaxSeriesAction is either 'reject' or 'warn' when the series budget is exceeded.
+	MaxSeriesAction string `yaml:"max_series_action,omitempty"`
+	// DeniedMetrics are the regexes of the metric names the tenant may not select by name.
+	DeniedMetrics []string `yaml:"denied_metrics,omitempty"`
+
+	// deniedMetrics matches the whole names of the denied metrics, compiled by validate
+	deniedMetrics *regexp.Regexp
+}
+
+func (l *queryLimits) validate() error {
+	if l.MaxQueryRange < 0 || l.MaxLookback < 0 || l.MaxRangeWindow < 0 || l.MaxSubqueryWindow < 0 || l.MaxResolutionPoints < 0 || l.MaxQueryCost < 0 {
+		return errors.New("query limits must not be negative")
+	}
+	if l.MaxSeries < 0 {
+		return errors.New("max_series must not be negative")
+	}
+	switch l.MaxSeriesAction {
+	case "", maxSeriesActionReject, maxSeriesActionWarn:
+	default:
+		return errors.Errorf("unknown max_series_action %q", l.MaxSeriesAction)
+	}
+
+	if len(l.DeniedMetrics) != 0 {
+		deniedMetrics, err := regexp.Compile("^(?:" + strings.Join(l.DeniedMetrics, "|") + ")$")
+		if err != nil {
+			return errors.Annotate(err, "invalid denied_metrics")
+		}
+		l.deniedMetrics = deniedMetrics
+	}
+
+	return nil
+}
+
+func (l *queryLimits) maxSeriesAction() string {
+	if len(l.MaxSeriesAction) == 0 {
+		return maxSeriesActionReject
+	}
+
+	return l.MaxSeriesAction
+}
+
+func (l *queryLimits) maxResolutionPoints() int64 {
+	if l == nil || l.MaxResolutionPoints == 0 {
+		return maxResolutionPoints
+	}
+
+	return l.MaxResolutionPoints
+}
+
+// checkTimeRange checks the range between start and end and how far start is in the past.
+func (l *queryLimits) checkTimeRange(start, end, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.MaxQueryRange > 0 && end.Sub(start) > time.Duration(l.MaxQueryRange) {
+		return errors.Errorf("the query time range of %s exceeds the limit of %s",
+			prommodel.Duration(end.Sub(start)), l.MaxQueryRange)
+	}
+
+	return l.checkLookback(start, now)
+}
+
+// earliestStart returns the earliest start allowed for the given end, or zero if the start is not limited.
+func (l *queryLimits) earliestStart(end, now time.Time) time.Time {
+	var start time.Time
+	if l == nil {
+		return start
+	}
+
+	if l.MaxLookback > 0 {
+		start = now.Add(-time.Duration(l.MaxLookback))
+	}
+	if l.MaxQueryRange > 0 {
+		if rangeStart := end.Add(-time.Duration(l.MaxQueryRange)); rangeStart.After(start) {
+			start = rangeStart
+		}
+	}
+
+	return start
+}
+
+func (l *queryLimits) checkLookback(start, now time.Time) error {
+	if l == nil || l.MaxLookback <= 0 {
+		return nil
+	}
+
+	if lookback := now.Sub(start); lookback > time.Duration(l.MaxLookback) {
+		return errors.Errorf("the query looks back %s, which exceeds the limit of %s",
+			prommodel.Duration(lookback.Truncate(time.Second)), l.MaxLookback)
+	}
+
+	return nil
+}
+
+// checkResolution checks the number of points per series of a range query.
+func (l *queryLimits) checkResolution(start, end time.Time, step time.Duration) error {
+	limit := l.maxResolutionPoints()
+	if int64(end.Sub(start)/step) <= limit {
+		return nil
+	}
+
+	// same message as Prometheus by default
+	if limit == maxResolutionPoints {
+		return errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
+	}
+	return errors.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", limit)
+}
+
+// checkDefaultResolution checks the number of points per series of a range query against the default limit of Prometheus.
+func checkDefaultResolution(start, end time.Time, step time.Duration) error {
+	var defaults *queryLimits
+	return defaults.checkResolution(start, end, step)
+}
+
+// checkExpr checks the windows inside the expression and the earliest data it selects,
+// when it is evaluated between start and end.
+func (l *queryLimits) checkExpr(expr parser.Expr, start, end, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			err = checkWindow("range vector", n.Range, l.MaxRangeWindow)
+		case *parser.SubqueryExpr:
+			err = checkWindow("subquery", n.Range, l.MaxSubqueryWindow)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if l.MaxLookback > 0 {
+		minT, maxT := promql.FindMinMaxTime(&parser.EvalStmt{Expr: expr, Start: start, End: end})
+		if minT != 0 || maxT != 0 {
+			return l.checkLookback(timestamp.Time(minT), now)
+		}
+	}
+
+	return nil
+}
+
+// checkReadQuery checks the time range and the hints of a remote read query.
+func (l *queryLimits) checkReadQuery(query *prompb.Query, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+
+	start, end := timestamp.Time(query.GetStartTimestampMs()), timestamp.Time(query.GetEndTimestampMs())
+	if err := l.checkTimeRange(start, end, now); err != nil {
+		return err
+	}
+
+	if hints := query.GetHints(); hints != nil {
+		if err := checkWindow("range vector", time.Duration(hints.GetRangeMs())*time.Millisecond, l.MaxRangeWindow); err != nil {
+			return err
+		}
+		if hints.GetStartMs() != 0 {
+			return l.checkLookback(timestamp.Time(hints.GetStartMs()), now)
+		}
+	}
+
+	return nil
+}
+
+// checkDeniedMetrics checks the metric names of the selectors against the denied metrics.
+func (l *queryLimits) checkDeniedMetrics(expr parser.Expr) error {
+	if l == nil || l.deniedMetrics == nil {
+		return nil
+	}
+
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if n, ok := node.(*parser.VectorSelector); ok {
+			err = l.checkDeniedMatchers(n.LabelMatchers)
+		}
+		return err
+	})
+
+	return err
+}
+
+// checkDeniedMatchers checks the metric names a selector may select against the denied metrics,
+// the selectors which may select any metric, without a metric name or by a name pattern, are denied as well.
+func (l *queryLimits) checkDeniedMatchers(matchers []*promlb.Matcher) error {
+	if l == nil || l.deniedMetrics == nil {
+		return nil
+	}
+
+	names := selectableMetricNames(matchers)
+	if names == nil {
+		return errors.New("the selectors must select the metrics by name or by a list of names, since some metrics are denied")
+	}
+	for _, name := range names {
+		if l.deniedMetrics.MatchString(name) {
+			return errors.Errorf("the metric %s is denied", name)
+		}
+	}
+
+	return nil
+}
+
+// selectableMetricNames returns the metric names the matchers may select,
+// or nil if they are not bound to a list of names, like 'foo|bar'.
+func selectableMetricNames(matchers []*promlb.Matcher) []string {
+	var names []string
+	for _, m := range matchers {
+		if m.Name != promlb.MetricName {
+			continue
+		}
+		if m.Type == promlb.MatchEqual {
+			names = []string{m.Value}
+			break
+		}
+		if m.Type == promlb.MatchRegexp && names == nil {
+			names = m.SetMatches()
+		}
+	}
+	if names == nil {
+		return nil
+	}
+
+	// the other name matchers narrow the names down
+	selectable := make([]string, 0, len(names))
+	for _, name := range names {
+		matched := true
+		for _, m := range matchers {
+			if m.Name == promlb.MetricName && !m.Matches(name) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			selectable = append(selectable, name)
+		}
+	}
+
+	return selectable
+}
+
+func checkWindow(kind string, window time.Duration, limit prommodel.Duration) error {
+	if limit > 0 && window > time.Duration(limit) {
+		return errors.Errorf("the %s window of %s exceeds the limit of %s", kind, prommodel.Duration(window), limit)
+	}
+
+	return nil
+}
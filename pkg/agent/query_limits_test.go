@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryLimits(t *testing.T) {
+	now := time.Now()
+	limits := &queryLimits{
+		MaxQueryRange:       prommodel.Duration(24 * time.Hour),
+		MaxLookback:         prommodel.Duration(7 * 24 * time.Hour),
+		MaxRangeWindow:      prommodel.Duration(time.Hour),
+		MaxSubqueryWindow:   prommodel.Duration(6 * time.Hour),
+		MaxResolutionPoints: 100,
+	}
+
+	t.Run("time range", func(t *testing.T) {
+		require.NoError(t, limits.checkTimeRange(now.Add(-time.Hour), now, now))
+		require.ErrorContains(t, limits.checkTimeRange(now.Add(-48*time.Hour), now, now), "query time range of 2d exceeds the limit of 1d")
+		require.ErrorContains(t, limits.checkTimeRange(now.Add(-8*24*time.Hour), now.Add(-8*24*time.Hour+time.Hour), now), "exceeds the limit of 1w")
+	})
+
+	t.Run("resolution", func(t *testing.T) {
+		require.NoError(t, limits.checkResolution(now.Add(-100*time.Minute), now, time.Minute))
+		require.ErrorContains(t, limits.checkResolution(now.Add(-101*time.Minute), now, time.Minute), "maximum resolution of 100 points")
+
+		var unlimited *queryLimits
+		require.ErrorContains(t, unlimited.checkResolution(now.Add(-11001*time.Second), now, time.Second), "11,000 points")
+	})
+
+	t.Run("expression", func(t *testing.T) {
+		for query, expected := range map[string]string{
+			`rate(up[5m])`:                       "",
+			`rate(up[2h])`:                       "range vector window of 2h exceeds the limit of 1h",
+			`max_over_time(up[1d:5m])`:           "subquery window of 1d exceeds the limit of 6h",
+			`up offset 8d`:                       "exceeds the limit of 1w",
+			`max_over_time(rate(up[1h])[6h:5m])`: "",
+			`vector(1)`:                          "",
+		} {
+			expr, err := parser.ParseExpr(query)
+			require.NoError(t, err)
+
+			err = limits.checkExpr(expr, now, now, now)
+			if expected == "" {
+				require.NoError(t, err, query)
+			} else {
+				require.ErrorContains(t, err, expected, query)
+			}
+		}
+	})
+
+	t.Run("remote read", func(t *testing.T) {
+		query := &prompb.Query{
+			StartTimestampMs: timestamp.FromTime(now.Add(-time.Hour)),
+			EndTimestampMs:   timestamp.FromTime(now),
+			Hints:            &prompb.ReadHints{RangeMs: (5 * time.Minute).Milliseconds()},
+		}
+		require.NoError(t, limits.checkReadQuery(query, now))
+
+		query.Hints.RangeMs = (2 * time.Hour).Milliseconds()
+		require.ErrorContains(t, limits.checkReadQuery(query, now), "range vector window")
+
+		query.Hints = nil
+		query.StartTimestampMs = timestamp.FromTime(now.Add(-48 * time.Hour))
+		require.ErrorContains(t, limits.checkReadQuery(query, now), "query time range")
+	})
+
+	t.Run("denied metrics", func(t *testing.T) {
+		denied := &queryLimits{DeniedMetrics: []string{"secret_.*", "etcd_db_size"}}
+		require.NoError(t, denied.validate())
+
+		for query, expected := range map[string]string{
+			`sum(rate(secret_tokens[5m]))`: "the metric secret_tokens is denied",
+			`etcd_db_size_total`:           "",
+			`{__name__="etcd_db_size"}`:    "the metric etcd_db_size is denied",
+			`up unless secret`:             "",
+			// the selectors which may select a denied metric
+			`{__name__=~"etcd_db_size"}`:                            "the metric etcd_db_size is denied",
+			`{__name__=~"up|secret_tokens"}`:                        "the metric secret_tokens is denied",
+			`{__name__=~".+"}`:                                      "the selectors must select the metrics by name",
+			`{__name__=~"secret_.*"}`:                               "the selectors must select the metrics by name",
+			`{__name__!="up", job="x"}`:                             "the selectors must select the metrics by name",
+			`{__name__!~"secret_.*", job="x"}`:                      "the selectors must select the metrics by name",
+			`{job="x"}`:                                             "the selectors must select the metrics by name",
+			`sum(up) + count({job="x"})`:                            "the selectors must select the metrics by name",
+			`{__name__=~"up|node_load1"}`:                           "",
+			`{__name__=~"up|secret_tokens", __name__!~"secret_.*"}`: "",
+		} {
+			expr, err := parser.ParseExpr(query)
+			require.NoError(t, err)
+
+			err = denied.checkDeniedMetrics(expr)
+			if expected == "" {
+				require.NoError(t, err, query)
+			} else {
+				require.ErrorContains(t, err, expected, query)
+			}
+		}
+
+		require.ErrorContains(t, (&queryLimits{DeniedMetrics: []string{"("}}).validate(), "invalid denied_metrics")
+	})
+
+	t.Run("earliest start", func(t *testing.T) {
+		require.Equal(t, now.Add(-24*time.Hour), limits.earliestStart(now, now))
+		require.Equal(t, now.Add(-7*24*time.Hour), limits.earliestStart(now.Add(-10*24*time.Hour), now))
+
+		var unlimited *queryLimits
+		require.True(t, unlimited.earliestStart(now, now).IsZero())
+	})
+}
+
+func Test_hijackQueryLimits(t *testing.T) {
+	var seriesQueries url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seriesQueries = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "success", Data: []map[string]string{}})))
+	}))
+	t.Cleanup(upstream.Close)
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.tenantLimits = &tenantLimitsConfig{
+		Defaults: tenantLimits{QueryLimits: &queryLimits{
+			MaxQueryRange: prommodel.Duration(24 * time.Hour),
+			MaxLookback:   prommodel.Duration(7 * 24 * time.Hour),
+			MaxQueryCost:  20,
+		}},
+	}
+	agt.complexityMetrics = newQueryComplexityMetrics(agt.registry)
+	httpBackend := agt.httpBackend()
+
+	doRequest := func(path string, queries url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090"+path+"?"+queries.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res
+	}
+
+	now := time.Now()
+	res := doRequest("/api/v1/query_range", url.Values{
+		"query": {"up"},
+		"start": {formatTime(now.Add(-48 * time.Hour))},
+		"end":   {formatTime(now)},
+		"step":  {"60"},
+	})
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	var body jsonResponseData
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+	require.Equal(t, "bad_data", body.ErrorType)
+	require.Contains(t, body.Error, "exceeds the limit of 1d")
+
+	res = doRequest("/api/v1/query", url.Values{"query": {"up offset 30d"}})
+	require.Equal(t, http.StatusBadRequest, res.Code)
+
+	// the query cost is checked on the selectors of the series too
+	res = doRequest("/api/v1/series", url.Values{"match[]": {`{__name__=~".+"}`}})
+	require.Equal(t, http.StatusBadRequest, res.Code)
+	require.Contains(t, res.Body.String(), "exceeds the budget of 20.0")
+	require.InDelta(t, 1, testutil.ToFloat64(agt.complexityMetrics.rejected), 0)
+
+	// the start of the series is limited if it is not given
+	res = doRequest("/api/v1/series", url.Values{"match[]": {"up"}})
+	require.Equal(t, http.StatusOK, res.Code)
+	start, err := strconv.ParseFloat(seriesQueries.Get("start"), 64)
+	require.NoError(t, err)
+	require.InDelta(t, float64(now.Add(-24*time.Hour).Unix()), start, 5)
+}
+
+func Test_hijackDeniedMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(jsonResponseBody(&jsonResponseData{Status: "success", Data: []map[string]string{}})))
+	}))
+	t.Cleanup(upstream.Close)
+
+	limits := &queryLimits{DeniedMetrics: []string{"secret_.*"}}
+	require.NoError(t, limits.validate())
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.tenantLimits = &tenantLimitsConfig{Defaults: tenantLimits{QueryLimits: limits}}
+	httpBackend := agt.httpBackend()
+
+	doRequest := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:9090"+target, bytes.NewReader(body))
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res
+	}
+
+	policy := &replayPolicy{limits: agt.cfg.tenantLimits}
+	for _, selector := range []string{`{__name__=~"secret_tokens"}`, `{__name__=~".+"}`, `{job="x"}`} {
+		t.Run(selector, func(t *testing.T) {
+			selectorValues := url.Values{"match[]": {selector}}.Encode()
+			for _, target := range []string{
+				"/api/v1/query?" + url.Values{"query": {"sum(" + selector + ")"}}.Encode(),
+				"/api/v1/series?" + selectorValues,
+				"/federate?" + selectorValues,
+			} {
+				res := doRequest(http.MethodGet, target, nil)
+				require.Equal(t, http.StatusBadRequest, res.Code, target)
+			}
+
+			matchers, err := parser.ParseMetricSelector(selector)
+			require.NoError(t, err)
+			readMatchers, err := remote.ToLabelMatchers(matchers)
+			require.NoError(t, err)
+			query := &prompb.Query{EndTimestampMs: timestamp.FromTime(time.Now()), Matchers: readMatchers}
+			readData, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{query}})
+			require.NoError(t, err)
+			res := doRequest(http.MethodPost, "/api/v1/read", snappy.Encode(nil, readData))
+			require.Equal(t, http.StatusBadRequest, res.Code)
+
+			for endpoint, raw := range map[string]string{
+				"/api/v1/query":  "sum(" + selector + ")",
+				"/api/v1/series": selector,
+				"/federate":      selector,
+				"/api/v1/read":   query.String(),
+			} {
+				report := newReplayReport()
+				policy.replayEvent(&audit.Event{
+					ProjectID: "p-a", Namespaces: []string{"ns-a"}, Endpoint: endpoint, Status: http.StatusOK, Time: time.Now(),
+					Queries: []audit.Query{{Raw: raw}},
+				}, report)
+				require.Len(t, report.denied, 1, endpoint)
+			}
+		})
+	}
+}
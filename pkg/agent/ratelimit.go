@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterSweepInterval is how often the idle token buckets are evicted.
+const rateLimiterSweepInterval = time.Minute
+
+// tenantRateLimiter keeps a token bucket per tenant and endpoint class,
+// the buckets which are full again are evicted since they behave like new ones.
+type tenantRateLimiter struct {
+	limits    *tenantLimitsConfig
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+	rejected  *prometheus.CounterVec
+}
+
+func newTenantRateLimiter(limits *tenantLimitsConfig, reg prometheus.Registerer) *tenantRateLimiter {
+	l := &tenantRateLimiter{
+		limits:   limits,
+		limiters: make(map[string]*rate.Limiter),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_rate_limited_requests_total",
+				Help: "The total number of requests rejected by the tenant rate limits by endpoint class.",
+			},
+			[]string{"class"},
+		),
+	}
+	reg.MustRegister(l.rejected)
+
+	return l
+}
+
+// reserve takes a token of the tenant's bucket for the endpoint class,
+// it returns how long to wait before retrying if the bucket is empty.
+func (l *tenantRateLimiter) reserve(tenant string, class endpointClass, now time.Time) (time.Duration, bool) {
+	limiter := l.limiter(tenant, class, now)
+	if limiter == nil {
+		return 0, true
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return 0, true
+	}
+
+	// give back the token, the request is not served
+	reservation.CancelAt(now)
+	l.rejected.WithLabelValues(string(class)).Inc()
+	return delay, false
+}
+
+func (l *tenantRateLimiter) limiter(tenant string, class endpointClass, now time.Time) *rate.Limiter {
+	limit := l.limits.rateLimit(tenant, class)
+	if limit == nil {
+		return nil
+	}
+
+	key := string(class) + "/" + tenant
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	limiter, exist := l.limiters[key]
+	if !exist {
+		limiter = rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst)
+		l.limiters[key] = limiter
+	}
+
+	return limiter
+}
+
+// sweep evicts the idle buckets, which have refilled all their tokens.
+func (l *tenantRateLimiter) sweep(now time.Time) {
+	for key, limiter := range l.limiters {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(l.limiters, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// writeTooManyRequests rejects the request like an API error of Prometheus,
+// with the seconds to wait in the 'Retry-After' header.
+func writeTooManyRequests(w http.ResponseWriter, msg string, retryAfter time.Duration) {
+	writeRetryLater(w, http.StatusTooManyRequests, "too_many_requests", msg, retryAfter)
+}
+
+// writeRetryLater writes an API error of Prometheus with the seconds to wait in the 'Retry-After' header.
+func writeRetryLater(w http.ResponseWriter, code int, errType string, msg string, retryAfter time.Duration) {
+	respBytes, err := json.Marshal(&jsonResponseData{
+		Status:    "error",
+		ErrorType: errType,
+		Error:     msg,
+	})
+	if err != nil {
+		log.WithError(err).Error("unable to marshal rejection response")
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(code)
+	if _, err = w.Write(respBytes); err != nil {
+		log.WithError(err).Errorf("failed to write %q into http response", string(respBytes))
+	}
+}
+
+// rateLimited enforces the rate limit of the tenant on the request, it writes the rejection if the limit is exceeded.
+func (a *agent) rateLimited(w http.ResponseWriter, r *http.Request, tenant string, shadow *shadowing) bool {
+	if a.rateLimiter == nil {
+		return false
+	}
+	class := endpointClassOf(r.URL.Path)
+	if class == "" {
+		return false
+	}
+
+	retryAfter, ok := a.rateLimiter.reserve(tenant, class, time.Now())
+	if ok {
+		return false
+	}
+
+	msg := fmt.Sprintf("rate limit of %s requests exceeded, retry after %v", class, retryAfter.Round(time.Millisecond))
+	if shadow.deny(ruleRateLimits, errors.New(msg)) == nil {
+		return false
+	}
+
+	log.Debugf("rate limited %s request of tenant %q for %v", class, tenant, retryAfter)
+	writeTooManyRequests(w, msg, retryAfter)
+	return true
+}
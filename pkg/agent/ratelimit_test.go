@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLimitsConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func Test_loadTenantLimitsConfig(t *testing.T) {
+	limitsCfg, err := loadTenantLimitsConfig(writeLimitsConfig(t, `
+defaults:
+  rate_limits:
+    instant: {requests_per_second: 10, burst: 20}
+    range: {requests_per_second: 1, burst: 2}
+tenants:
+  p-a:
+    rate_limits:
+      range: {requests_per_second: 5, burst: 5}
+      instant: null
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, &rateLimit{RequestsPerSecond: 5, Burst: 5}, limitsCfg.rateLimit("p-a", endpointClassRange))
+	require.Nil(t, limitsCfg.rateLimit("p-a", endpointClassInstant))
+	require.Equal(t, &rateLimit{RequestsPerSecond: 10, Burst: 20}, limitsCfg.rateLimit("p-b", endpointClassInstant))
+	require.Nil(t, limitsCfg.rateLimit("p-b", endpointClassFederate))
+
+	_, err = loadTenantLimitsConfig(writeLimitsConfig(t, "defaults:\n  rate_limits:\n    unknown: {requests_per_second: 1, burst: 1}\n"))
+	require.ErrorContains(t, err, "unknown endpoint class")
+
+	_, err = loadTenantLimitsConfig(writeLimitsConfig(t, "defaults:\n  rate_limits:\n    range: {requests_per_second: 1}\n"))
+	require.ErrorContains(t, err, "positive")
+
+	_, err = loadTenantLimitsConfig(writeLimitsConfig(t, "default: {}\n"))
+	require.ErrorContains(t, err, "not found")
+}
+
+func Test_endpointClassOf(t *testing.T) {
+	require.Equal(t, endpointClassInstant, endpointClassOf("/api/v1/query"))
+	require.Equal(t, endpointClassRange, endpointClassOf("/api/v1/query_range"))
+	require.Equal(t, endpointClassSeries, endpointClassOf("/api/v1/label/job/values"))
+	require.Equal(t, endpointClassRead, endpointClassOf("/api/v1/read"))
+	require.Equal(t, endpointClassFederate, endpointClassOf("/federate"))
+	require.Equal(t, endpointClass(""), endpointClassOf("/api/v1/status/buildinfo"))
+}
+
+func Test_tenantRateLimiter(t *testing.T) {
+	limiter := newTenantRateLimiter(&tenantLimitsConfig{
+		Defaults: tenantLimits{RateLimits: map[endpointClass]*rateLimit{
+			endpointClassRange: {RequestsPerSecond: 0.5, Burst: 2},
+		}},
+	}, prometheus.NewRegistry())
+
+	now := time.Now()
+	for range 2 {
+		_, ok := limiter.reserve("p-a", endpointClassRange, now)
+		require.True(t, ok)
+	}
+
+	retryAfter, ok := limiter.reserve("p-a", endpointClassRange, now)
+	require.False(t, ok)
+	require.Equal(t, 2*time.Second, retryAfter)
+
+	// the rejected request does not take a token
+	retryAfter, ok = limiter.reserve("p-a", endpointClassRange, now.Add(time.Second))
+	require.False(t, ok)
+	require.Equal(t, time.Second, retryAfter)
+	_, ok = limiter.reserve("p-a", endpointClassRange, now.Add(2*time.Second))
+	require.True(t, ok)
+
+	// the buckets are per tenant and class
+	_, ok = limiter.reserve("p-b", endpointClassRange, now)
+	require.True(t, ok)
+	_, ok = limiter.reserve("p-a", endpointClassInstant, now)
+	require.True(t, ok)
+
+	require.InDelta(t, 2, testutil.ToFloat64(limiter.rejected.WithLabelValues(string(endpointClassRange))), 0)
+
+	// the buckets are evicted once they are full again
+	require.Len(t, limiter.limiters, 2)
+	_, ok = limiter.reserve("p-b", endpointClassRange, now.Add(rateLimiterSweepInterval+3*time.Second))
+	require.True(t, ok)
+	require.Len(t, limiter.limiters, 1)
+	retryAfter, ok = limiter.reserve("p-b", endpointClassRange, now.Add(rateLimiterSweepInterval+3*time.Second))
+	require.True(t, ok)
+	require.Zero(t, retryAfter)
+}
+
+func Test_accessControlRateLimit(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/series": []map[string]string{},
+	})
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.rateLimiter = newTenantRateLimiter(&tenantLimitsConfig{
+		Defaults: tenantLimits{RateLimits: map[endpointClass]*rateLimit{
+			endpointClassSeries: {RequestsPerSecond: 0.01, Burst: 1},
+		}},
+	}, agt.registry)
+	httpBackend := agt.httpBackend()
+
+	doRequest := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/series?match[]=up", nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res
+	}
+
+	require.Equal(t, http.StatusOK, doRequest("someNamespacesToken").Code)
+
+	res := doRequest("someNamespacesToken")
+	require.Equal(t, http.StatusTooManyRequests, res.Code)
+	require.Equal(t, "100", res.Header().Get("Retry-After"))
+	var body jsonResponseData
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+	require.Equal(t, "error", body.Status)
+	require.Equal(t, "too_many_requests", body.ErrorType)
+
+	// the agent itself is not limited
+	require.Equal(t, http.StatusOK, doRequest("myToken").Code)
+}
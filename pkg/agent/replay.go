@@ -0,0 +1,318 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/caas-team/prometheus-auth/pkg/prom"
+	"github.com/gogo/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// maxAuditEventSize bounds the size of a line of the audit log.
+const maxAuditEventSize = 16 * 1024 * 1024
+
+// Replay replays the recorded audit events against a candidate policy and prints the impact.
+func Replay(cliContext *cli.Context) {
+	policy := &replayPolicy{
+		filterReaderLabelSet: data.NewSet(cliContext.StringSlice("filter-reader-labels")...),
+	}
+
+	var err error
+	if limitsConfigPath := cliContext.String("limits-config"); len(limitsConfigPath) != 0 {
+		if policy.limits, err = loadTenantLimitsConfig(limitsConfigPath); err != nil {
+			log.WithError(err).Panic("Unable to load --limits-config")
+		}
+	}
+	if namespacesPath := cliContext.String("namespaces"); len(namespacesPath) != 0 {
+		if policy.namespaces, err = loadNamespacesMapping(namespacesPath); err != nil {
+			log.WithError(err).Panic("Unable to load --namespaces")
+		}
+	}
+
+	report := newReplayReport()
+	eventPaths := cliContext.StringSlice("events")
+	if len(eventPaths) == 0 {
+		eventPaths = []string{"-"}
+	}
+	for _, path := range eventPaths {
+		if err = replayFile(path, policy, report); err != nil {
+			log.WithError(err).Panicf("Unable to replay %q", path)
+		}
+	}
+
+	if err = report.print(os.Stdout); err != nil {
+		log.WithError(err).Panic("Unable to print the replay report")
+	}
+}
+
+func replayFile(path string, policy *replayPolicy, report *replayReport) error {
+	if path == "-" {
+		return policy.replay(os.Stdin, report)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	return policy.replay(file, report)
+}
+
+// replayPolicy is the candidate policy to replay the audit events against.
+type replayPolicy struct {
+	limits               *tenantLimitsConfig
+	namespaces           *namespacesMapping
+	filterReaderLabelSet data.Set
+}
+
+// replay replays the audit events, one JSON object per line, into the report.
+func (p *replayPolicy) replay(events io.Reader, report *replayReport) error {
+	scanner := bufio.NewScanner(events)
+	scanner.Buffer(nil, maxAuditEventSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		e := &audit.Event{}
+		if err := json.Unmarshal(line, e); err != nil {
+			report.invalid++
+			log.Debugf("unable to parse audit event: %v", err)
+			continue
+		}
+		p.replayEvent(e, report)
+	}
+
+	return errors.Trace(scanner.Err())
+}
+
+func (p *replayPolicy) replayEvent(e *audit.Event, report *replayReport) {
+	// only the served requests may break
+	if e.Status >= 400 {
+		report.skipped++
+		return
+	}
+
+	tenant := replayTenant(e)
+	impact := report.tenant(tenant)
+	impact.requests++
+	report.replayed++
+
+	namespaceSet, mapped := p.namespacesOf(e)
+	if mapped && len(namespaceSet) == 0 && len(e.Namespaces) != 0 {
+		impact.denied++
+		report.denied = append(report.denied, &replayDenial{event: e, tenant: tenant, reason: "no namespaces are owned"})
+		return
+	}
+
+	// like the limits tenant in the 'rewrite' mode
+	limitsTenant := e.ProjectID
+	if len(limitsTenant) == 0 {
+		limitsTenant = strings.Join(namespaceSet.Values(), "|")
+	}
+	apiCtx := &apiContext{
+		namespaceSet:         namespaceSet,
+		filterReaderLabelSet: p.filterReaderLabelSet,
+		queryLimits:          p.limits.queryLimits(limitsTenant),
+	}
+
+	var changes []*replayChange
+	for idx := 0; idx < len(e.Queries); {
+		raw := e.Queries[idx].Raw
+		hijacked, err := apiCtx.replayQuery(e, raw)
+		if err != nil {
+			impact.denied++
+			report.denied = append(report.denied, &replayDenial{event: e, tenant: tenant, query: raw, reason: err.Error()})
+			return
+		}
+
+		// federate records several rewritten queries per raw query
+		for _, after := range hijacked {
+			var before string
+			if idx < len(e.Queries) && e.Queries[idx].Raw == raw {
+				before = e.Queries[idx].Hijacked
+				idx++
+			}
+			if before != after {
+				changes = append(changes, &replayChange{event: e, tenant: tenant, raw: raw, before: before, after: after})
+			}
+		}
+	}
+
+	if len(changes) != 0 {
+		impact.changed++
+		report.changed = append(report.changed, changes...)
+	}
+}
+
+// namespacesOf returns the namespaces of the tenant of the event, and whether they are mapped by the candidate policy.
+func (p *replayPolicy) namespacesOf(e *audit.Event) (data.Set, bool) {
+	if namespaceSet, mapped := p.namespaces.lookup(e.ProjectID, e.User); mapped {
+		return namespaceSet, true
+	}
+
+	return data.NewSet(e.Namespaces...), false
+}
+
+// replayQuery checks a recorded query against the limits and rewrites it, with the checks of the hijacked endpoint.
+func (c *apiContext) replayQuery(e *audit.Event, raw string) ([]string, error) {
+	switch e.Endpoint {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars":
+		expr, err := parser.ParseExpr(raw)
+		if err != nil {
+			return nil, err
+		}
+		if e.Endpoint == "/api/v1/query_exemplars" {
+			err = c.checkExemplarsQuery(expr)
+		} else {
+			// the time range of the query is not recorded, only its windows and offsets are checked
+			err = c.checkQuery(expr, e.Time, e.Time, e.Time)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{modifyExpression(expr, c.namespaceSet, prom.NamespaceMatchName)}, nil
+	case "/api/v1/series", "/federate":
+		matchers, err := parser.ParseMetricSelector(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.checkSelector(matchers); err != nil {
+			return nil, err
+		}
+		expr, err := parser.ParseExpr(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Endpoint == "/api/v1/series" {
+			return []string{modifyExpression(expr, c.namespaceSet, prom.NamespaceMatchName)}, nil
+		}
+		namespaceSet := data.NewSet(append(c.namespaceSet.Values(), globalNamespace)...)
+		return []string{
+			modifyExpression(expr, namespaceSet, prom.NamespaceMatchName),
+			modifyExpression(expr, namespaceSet, prom.ExportedNamespaceMatchName),
+		}, nil
+	case "/api/v1/read":
+		query := &prompb.Query{}
+		if err := proto.UnmarshalText(raw, query); err != nil {
+			return nil, errors.Annotate(err, "unable to parse the read query")
+		}
+		if err := c.checkReadQuery(query, e.Time); err != nil {
+			return nil, err
+		}
+
+		return []string{modifyQuery(query, c.namespaceSet, c.filterReaderLabelSet).String()}, nil
+	}
+
+	return nil, errors.Errorf("unable to replay the queries of %s", e.Endpoint)
+}
+
+// replayTenant returns the tenant to report the impact on.
+func replayTenant(e *audit.Event) string {
+	switch {
+	case len(e.ProjectID) != 0:
+		return e.ProjectID
+	case len(e.User) != 0:
+		return e.User
+	}
+
+	return "-"
+}
+
+type replayDenial struct {
+	event  *audit.Event
+	tenant string
+	query  string
+	reason string
+}
+
+type replayChange struct {
+	event  *audit.Event
+	tenant string
+	raw    string
+	before string
+	after  string
+}
+
+type replayImpact struct {
+	requests int
+	denied   int
+	changed  int
+}
+
+// replayReport collects the requests which the candidate policy changes.
+type replayReport struct {
+	replayed int
+	skipped  int
+	invalid  int
+	denied   []*replayDenial
+	changed  []*replayChange
+	tenants  map[string]*replayImpact
+}
+
+func newReplayReport() *replayReport {
+	return &replayReport{tenants: make(map[string]*replayImpact)}
+}
+
+func (r *replayReport) tenant(tenant string) *replayImpact {
+	impact, exist := r.tenants[tenant]
+	if !exist {
+		impact = &replayImpact{}
+		r.tenants[tenant] = impact
+	}
+
+	return impact
+}
+
+func (r *replayReport) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0) //nolint:mnd // padding of the columns
+
+	_, _ = fmt.Fprintf(tw, "Replayed %d requests of %d tenants, skipped %d failed requests and %d invalid events.\n",
+		r.replayed, len(r.tenants), r.skipped, r.invalid)
+
+	_, _ = fmt.Fprintf(tw, "\nNewly denied requests (%d):\n", len(r.denied))
+	for _, d := range r.denied {
+		_, _ = fmt.Fprintf(tw, "  %s %s %s %s: %s\n", d.event.Time.Format(time.RFC3339), d.tenant, d.event.Method, d.event.Endpoint, d.reason)
+		if len(d.query) != 0 {
+			_, _ = fmt.Fprintf(tw, "    query: %s\n", d.query)
+		}
+	}
+
+	_, _ = fmt.Fprintf(tw, "\nChanged rewritten queries (%d):\n", len(r.changed))
+	for _, c := range r.changed {
+		_, _ = fmt.Fprintf(tw, "  %s %s %s %s\n", c.event.Time.Format(time.RFC3339), c.tenant, c.event.Method, c.event.Endpoint)
+		_, _ = fmt.Fprintf(tw, "    query:  %s\n    before: %s\n    after:  %s\n", c.raw, c.before, c.after)
+	}
+
+	tenants := make([]string, 0, len(r.tenants))
+	for tenant := range r.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	_, _ = fmt.Fprint(tw, "\nImpact by tenant:\n  TENANT\tREQUESTS\tDENIED\tCHANGED\n")
+	for _, tenant := range tenants {
+		impact := r.tenants[tenant]
+		_, _ = fmt.Fprintf(tw, "  %s\t%d\t%d\t%d\n", tenant, impact.requests, impact.denied, impact.changed)
+	}
+
+	return errors.Trace(tw.Flush())
+}
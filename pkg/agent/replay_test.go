@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/caas-team/prometheus-auth/pkg/prom"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_replay(t *testing.T) {
+	now := time.Now()
+	hijack := func(query string, labelName string, namespaces ...string) string {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+		return modifyExpression(expr, data.NewSet(namespaces...), labelName)
+	}
+	readQuery := func() *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: timestamp.FromTime(now.Add(-time.Hour)),
+			EndTimestampMs:   timestamp.FromTime(now),
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		}
+	}
+	rawRead := readQuery().String()
+	hjkRead := modifyQuery(readQuery(), data.NewSet("ns-c"), nil).String()
+
+	events := []*audit.Event{
+		{
+			ProjectID: "p-a", Namespaces: []string{"ns-a", "ns-b"}, Endpoint: "/api/v1/query", Status: http.StatusOK,
+			Queries: []audit.Query{{Raw: "sum(up)", Hijacked: hijack("sum(up)", prom.NamespaceMatchName, "ns-a", "ns-b")}},
+		},
+		{
+			ProjectID: "p-b", Namespaces: []string{"ns-c"}, Endpoint: "/api/v1/query_range", Status: http.StatusOK,
+			Queries: []audit.Query{{Raw: "rate(up[2h])", Hijacked: hijack("rate(up[2h])", prom.NamespaceMatchName, "ns-c")}},
+		},
+		{
+			ProjectID: "p-b", Namespaces: []string{"ns-c"}, Endpoint: "/api/v1/read", Status: http.StatusOK,
+			Queries: []audit.Query{{Raw: rawRead, Hijacked: hjkRead}},
+		},
+		{
+			ProjectID: "p-b", Namespaces: []string{"ns-c"}, Endpoint: "/federate", Status: http.StatusOK,
+			Queries: []audit.Query{
+				{Raw: "up", Hijacked: hijack("up", prom.NamespaceMatchName, "ns-c", globalNamespace)},
+				{Raw: "up", Hijacked: hijack("up", prom.ExportedNamespaceMatchName, "ns-c", globalNamespace)},
+			},
+		},
+		{ProjectID: "p-b", Endpoint: "/api/v1/query", Status: http.StatusBadRequest},
+		{User: "u-x", Namespaces: []string{"ns-d"}, Endpoint: "/api/v1/labels", Status: http.StatusOK},
+	}
+
+	var input bytes.Buffer
+	for _, e := range events {
+		e.Time, e.Method = now, http.MethodGet
+		line, err := json.Marshal(e)
+		require.NoError(t, err)
+		input.Write(append(line, '\n'))
+	}
+	input.WriteString("not an event\n")
+
+	policy := &replayPolicy{
+		limits: &tenantLimitsConfig{Defaults: tenantLimits{QueryLimits: &queryLimits{
+			MaxRangeWindow: prommodel.Duration(time.Hour),
+		}}},
+		namespaces: &namespacesMapping{
+			Projects: map[string][]string{"p-a": {"ns-a"}},
+			Users:    map[string][]string{"u-x": {}},
+		},
+	}
+	report := newReplayReport()
+	require.NoError(t, policy.replay(&input, report))
+
+	require.Equal(t, 5, report.replayed)
+	require.Equal(t, 1, report.skipped)
+	require.Equal(t, 1, report.invalid)
+
+	require.Len(t, report.denied, 2)
+	require.Equal(t, "p-b", report.denied[0].tenant)
+	require.Contains(t, report.denied[0].reason, "range vector window of 2h exceeds the limit of 1h")
+	require.Equal(t, "u-x", report.denied[1].tenant)
+
+	require.Len(t, report.changed, 1)
+	require.Equal(t, hijack("sum(up)", prom.NamespaceMatchName, "ns-a"), report.changed[0].after)
+
+	require.Equal(t, &replayImpact{requests: 3, denied: 1}, report.tenants["p-b"])
+
+	var output strings.Builder
+	require.NoError(t, report.print(&output))
+	require.Contains(t, output.String(), "Replayed 5 requests of 3 tenants, skipped 1 failed requests and 1 invalid events.")
+	require.Contains(t, output.String(), "Newly denied requests (2):")
+	require.Contains(t, output.String(), "Changed rewritten queries (1):")
+	require.Regexp(t, `p-a +1 +0 +1\n`, output.String())
+}
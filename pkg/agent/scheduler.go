@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxQueuedQueries bounds the queue of a tenant without concurrency limits.
+const defaultMaxQueuedQueries = 64
+
+var errQueueFull = errors.New("too many queued queries")
+
+// fairScheduler caps the in-flight upstream queries per tenant and in total,
+// the excess queries wait in a bounded queue per tenant and the queues are served round-robin,
+// so that the backlog of a tenant does not starve the others.
+type fairScheduler struct {
+	limits      *tenantLimitsConfig
+	maxInFlight int
+
+	mu       sync.Mutex
+	inFlight int
+	tenants  map[string]*schedulerTenant
+	// number of the tenants by metric label, which several tenants may share
+	labels map[string]int
+	// ring of the tenants with queued queries, in the order they are served
+	ring []string
+	next int
+
+	queueLength *prometheus.GaugeVec
+	queueWait   *prometheus.HistogramVec
+	inFlightVec *prometheus.GaugeVec
+}
+
+type schedulerTenant struct {
+	// label is the project ID of the tenant in the metrics, empty without project,
+	// so that their cardinality is bounded by the projects.
+	label    string
+	inFlight int
+	queue    []*schedulerWaiter
+}
+
+type schedulerWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newFairScheduler(limits *tenantLimitsConfig, maxInFlight int, reg prometheus.Registerer) *fairScheduler {
+	s := &fairScheduler{
+		limits:      limits,
+		maxInFlight: maxInFlight,
+		tenants:     make(map[string]*schedulerTenant),
+		labels:      make(map[string]int),
+		queueLength: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "prometheus_auth_queued_queries",
+				Help: "The number of queries waiting for an upstream slot by project.",
+			},
+			[]string{"tenant"},
+		),
+		queueWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "prometheus_auth_queue_wait_seconds",
+				Help:    "The duration the queries waited for an upstream slot by project.",
+				Buckets: []float64{0.005, 0.05, 0.25, 1, 5, 15, 60}, //nolint:mnd // buckets up to the usual query timeouts
+			},
+			[]string{"tenant"},
+		),
+		inFlightVec: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "prometheus_auth_in_flight_queries",
+				Help: "The number of queries in flight to the upstreams by project.",
+			},
+			[]string{"tenant"},
+		),
+	}
+	reg.MustRegister(s.queueLength, s.queueWait, s.inFlightVec)
+
+	return s
+}
+
+// tenantLimit returns the maximum in-flight and queued queries of the tenant, 0 is unlimited in flight.
+func (s *fairScheduler) tenantLimit(tenant string) (int, int) {
+	if s.limits == nil {
+		return 0, defaultMaxQueuedQueries
+	}
+
+	limit := s.limits.concurrencyLimit(tenant)
+	if limit == nil {
+		return 0, defaultMaxQueuedQueries
+	}
+
+	return limit.MaxInFlight, limit.MaxQueued
+}
+
+// acquire waits for an upstream slot of the tenant of the project, the returned function must be called to release it.
+func (s *fairScheduler) acquire(ctx context.Context, tenant, projectID string) (func(), error) {
+	start := time.Now()
+	release := func() { s.release(tenant) }
+
+	s.mu.Lock()
+	t := s.tenant(tenant, projectID)
+	maxInFlight, maxQueued := s.tenantLimit(tenant)
+	if len(t.queue) == 0 && s.available(t, maxInFlight) {
+		s.grant(t)
+		s.mu.Unlock()
+		s.queueWait.WithLabelValues(t.label).Observe(0)
+		return release, nil
+	}
+	if len(t.queue) >= maxQueued {
+		s.forget(tenant, t)
+		s.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	w := &schedulerWaiter{ready: make(chan struct{})}
+	t.queue = append(t.queue, w)
+	if len(t.queue) == 1 {
+		s.ring = append(s.ring, tenant)
+	}
+	s.queueLength.WithLabelValues(t.label).Inc()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		s.queueWait.WithLabelValues(t.label).Observe(time.Since(start).Seconds())
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.granted {
+		// granted while giving up, hand the slot over
+		s.releaseLocked(tenant)
+	} else {
+		s.dequeue(tenant, t, w)
+	}
+
+	return nil, errors.Annotate(ctx.Err(), "gave up waiting for an upstream slot")
+}
+
+func (s *fairScheduler) release(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.releaseLocked(tenant)
+}
+
+func (s *fairScheduler) releaseLocked(tenant string) {
+	t := s.tenants[tenant]
+	t.inFlight--
+	s.inFlight--
+	s.inFlightVec.WithLabelValues(t.label).Dec()
+
+	s.dispatch()
+	s.forget(tenant, t)
+}
+
+// dispatch grants the free slots to the queued queries, taking one query of each tenant in turn.
+func (s *fairScheduler) dispatch() {
+	for skipped := 0; len(s.ring) != 0 && skipped < len(s.ring); {
+		if s.next >= len(s.ring) {
+			s.next = 0
+		}
+		if s.maxInFlight > 0 && s.inFlight >= s.maxInFlight {
+			return
+		}
+
+		tenant := s.ring[s.next]
+		t := s.tenants[tenant]
+		maxInFlight, _ := s.tenantLimit(tenant)
+		if !s.available(t, maxInFlight) {
+			s.next++
+			skipped++
+			continue
+		}
+
+		w := t.queue[0]
+		t.queue = t.queue[1:]
+		s.queueLength.WithLabelValues(t.label).Dec()
+		s.grant(t)
+		w.granted = true
+		close(w.ready)
+		skipped = 0
+
+		if len(t.queue) == 0 {
+			s.ring = append(s.ring[:s.next], s.ring[s.next+1:]...)
+		} else {
+			s.next++
+		}
+	}
+}
+
+func (s *fairScheduler) available(t *schedulerTenant, maxInFlight int) bool {
+	if s.maxInFlight > 0 && s.inFlight >= s.maxInFlight {
+		return false
+	}
+
+	return maxInFlight <= 0 || t.inFlight < maxInFlight
+}
+
+func (s *fairScheduler) grant(t *schedulerTenant) {
+	t.inFlight++
+	s.inFlight++
+	s.inFlightVec.WithLabelValues(t.label).Inc()
+}
+
+func (s *fairScheduler) dequeue(tenant string, t *schedulerTenant, w *schedulerWaiter) {
+	for idx, queued := range t.queue {
+		if queued == w {
+			t.queue = append(t.queue[:idx], t.queue[idx+1:]...)
+			s.queueLength.WithLabelValues(t.label).Dec()
+			break
+		}
+	}
+
+	if len(t.queue) == 0 {
+		for idx, queued := range s.ring {
+			if queued == tenant {
+				s.ring = append(s.ring[:idx], s.ring[idx+1:]...)
+				if idx < s.next {
+					s.next--
+				}
+				break
+			}
+		}
+	}
+	s.forget(tenant, t)
+}
+
+func (s *fairScheduler) tenant(tenant, projectID string) *schedulerTenant {
+	t, exist := s.tenants[tenant]
+	if !exist {
+		t = &schedulerTenant{label: projectID}
+		s.tenants[tenant] = t
+		s.labels[projectID]++
+	}
+
+	return t
+}
+
+// forget drops the state and the metrics of an idle tenant.
+func (s *fairScheduler) forget(tenant string, t *schedulerTenant) {
+	if t.inFlight != 0 || len(t.queue) != 0 {
+		return
+	}
+
+	delete(s.tenants, tenant)
+
+	// the gauges are dropped with the last tenant of the label,
+	// the wait histogram is kept, since its labels are bounded by the projects
+	s.labels[t.label]--
+	if s.labels[t.label] > 0 {
+		return
+	}
+	delete(s.labels, t.label)
+	s.queueLength.DeleteLabelValues(t.label)
+	s.inFlightVec.DeleteLabelValues(t.label)
+}
+
+// scheduled waits for an upstream slot of the tenant of the project, it writes the rejection if the queue is full or the request gave up.
+// The returned function releases the slot.
+func (a *agent) scheduled(w http.ResponseWriter, r *http.Request, tenant, projectID string) (func(), bool) {
+	if a.scheduler == nil || endpointClassOf(r.URL.Path) == "" {
+		return func() {}, true
+	}
+
+	release, err := a.scheduler.acquire(r.Context(), tenant, projectID)
+	if err == nil {
+		return release, true
+	}
+
+	log.Debugf("rejected request of tenant %q: %v", tenant, err)
+	if errors.Is(err, errQueueFull) {
+		writeTooManyRequests(w, "too many queued queries, retry later", time.Second)
+	}
+	// otherwise the client has gone
+
+	return nil, false
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// queueLen returns the number of queued queries of the tenant.
+func (s *fairScheduler) queueLen(tenant string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, exist := s.tenants[tenant]; exist {
+		return len(t.queue)
+	}
+	return 0
+}
+
+func Test_fairScheduler(t *testing.T) {
+	t.Run("round-robin", func(t *testing.T) {
+		s := newFairScheduler(nil, 1, prometheus.NewRegistry())
+		release, err := s.acquire(context.Background(), "a", "p-a")
+		require.NoError(t, err)
+
+		type grant struct {
+			name    string
+			release func()
+		}
+		granted := make(chan grant)
+		enqueue := func(tenant, name string) {
+			queued := s.queueLen(tenant)
+			go func() {
+				rel, aErr := s.acquire(context.Background(), tenant, "p-"+tenant)
+				if aErr == nil {
+					granted <- grant{name: name, release: rel}
+				}
+			}()
+			require.Eventually(t, func() bool { return s.queueLen(tenant) == queued+1 }, time.Second, time.Millisecond)
+		}
+		enqueue("a", "a2")
+		enqueue("a", "a3")
+		enqueue("a", "a4")
+		enqueue("b", "b1")
+		require.InDelta(t, 3, testutil.ToFloat64(s.queueLength.WithLabelValues("p-a")), 0)
+
+		var order []string
+		release()
+		for range 4 {
+			g := <-granted
+			order = append(order, g.name)
+			g.release()
+		}
+		require.Equal(t, []string{"a2", "b1", "a3", "a4"}, order)
+
+		// the idle tenants are forgotten
+		require.Empty(t, s.tenants)
+		require.Equal(t, 0, s.inFlight)
+		require.Zero(t, testutil.CollectAndCount(s.queueLength))
+		require.Zero(t, testutil.CollectAndCount(s.inFlightVec))
+		// the wait times of the idle tenants are kept
+		require.Equal(t, 2, testutil.CollectAndCount(s.queueWait))
+	})
+
+	t.Run("tenant limit and full queue", func(t *testing.T) {
+		s := newFairScheduler(&tenantLimitsConfig{
+			Defaults: tenantLimits{Concurrency: &concurrencyLimit{MaxInFlight: 1, MaxQueued: 1}},
+		}, 0, prometheus.NewRegistry())
+
+		release, err := s.acquire(context.Background(), "a", "p-a")
+		require.NoError(t, err)
+
+		// another tenant is not blocked
+		releaseB, err := s.acquire(context.Background(), "b", "p-b")
+		require.NoError(t, err)
+		releaseB()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		waitErr := make(chan error)
+		go func() {
+			_, aErr := s.acquire(ctx, "a", "p-a")
+			waitErr <- aErr
+		}()
+		require.Eventually(t, func() bool { return s.queueLen("a") == 1 }, time.Second, time.Millisecond)
+
+		_, err = s.acquire(context.Background(), "a", "p-a")
+		require.ErrorIs(t, err, errQueueFull)
+
+		// the waiting query gives up
+		cancel()
+		require.ErrorIs(t, <-waitErr, context.Canceled)
+		require.Equal(t, 0, s.queueLen("a"))
+
+		release()
+		require.Empty(t, s.tenants)
+	})
+
+	t.Run("shared label", func(t *testing.T) {
+		s := newFairScheduler(nil, 0, prometheus.NewRegistry())
+
+		// the tenants without project share the empty label
+		releaseA, err := s.acquire(context.Background(), "ns-a", "")
+		require.NoError(t, err)
+		releaseB, err := s.acquire(context.Background(), "ns-b|ns-c", "")
+		require.NoError(t, err)
+		require.InDelta(t, 2, testutil.ToFloat64(s.inFlightVec.WithLabelValues("")), 0)
+
+		releaseA()
+		require.InDelta(t, 1, testutil.ToFloat64(s.inFlightVec.WithLabelValues("")), 0)
+		require.Equal(t, 1, testutil.CollectAndCount(s.queueWait))
+
+		releaseB()
+		require.Zero(t, testutil.CollectAndCount(s.inFlightVec))
+		require.Equal(t, 1, testutil.CollectAndCount(s.queueWait))
+	})
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// the rules which can be shadowed, so that their denials are only reported
+const (
+	ruleRateLimits    = "rate_limits"
+	ruleQueryLimits   = "query_limits"
+	ruleQueryCost     = "query_cost"
+	ruleMaxSeries     = "max_series"
+	ruleDeniedMetrics = "denied_metrics"
+	ruleNamespaces    = "namespaces"
+
+	// shadowAllRules shadows all rules.
+	shadowAllRules = "all"
+)
+
+var shadowableRules = []string{ //nolint:gochecknoglobals // list of constants
+	ruleRateLimits, ruleQueryLimits, ruleQueryCost, ruleMaxSeries, ruleDeniedMetrics, ruleNamespaces,
+}
+
+func validateShadowRules(rules []string) error {
+	for _, rule := range rules {
+		if rule != shadowAllRules && !slices.Contains(shadowableRules, rule) {
+			return errors.Errorf("unknown shadow rule %q", rule)
+		}
+	}
+
+	return nil
+}
+
+// shadowMetrics counts the denials of the shadowed rules.
+type shadowMetrics struct {
+	denials *prometheus.CounterVec
+}
+
+func newShadowMetrics(reg prometheus.Registerer) *shadowMetrics {
+	m := &shadowMetrics{
+		denials: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_shadow_denials_total",
+				Help: "The total number of denials and namespace differences of the shadowed rules, by rule.",
+			},
+			[]string{"rule"},
+		),
+	}
+	reg.MustRegister(m.denials)
+
+	return m
+}
+
+// shadowing enforces the rules on the requests of a tenant, except the shadowed rules,
+// whose denials are logged, counted and audited while the request proceeds.
+type shadowing struct {
+	rules   data.Set
+	metrics *shadowMetrics
+	event   *audit.Event
+	tag     string
+}
+
+// shadowing returns the shadowing of the tenant's request,
+// the rules are shadowed globally or by the limits of the tenant.
+func (a *agent) shadowing(tenant string, event *audit.Event, tag string) *shadowing {
+	rules := data.NewSet(a.cfg.shadowRules...)
+	if a.cfg.tenantLimits != nil {
+		for _, rule := range a.cfg.tenantLimits.shadowRules(tenant) {
+			rules[rule] = struct{}{}
+		}
+	}
+	if _, all := rules[shadowAllRules]; all {
+		rules = data.NewSet(shadowableRules...)
+	}
+
+	return &shadowing{
+		rules:   rules,
+		metrics: a.shadowMetrics,
+		event:   event,
+		tag:     tag,
+	}
+}
+
+func (s *shadowing) shadowed(rule string) bool {
+	if s == nil {
+		return false
+	}
+
+	_, shadowed := s.rules[rule]
+	return shadowed
+}
+
+// deny returns the denial by the rule, unless the rule is shadowed, then the denial is only recorded.
+func (s *shadowing) deny(rule string, err error) error {
+	if err == nil || !s.shadowed(rule) {
+		return err
+	}
+
+	s.record(rule, err.Error())
+
+	return nil
+}
+
+// namespaces returns the namespaces to serve the tenant with, which are the candidate namespaces of the mapping
+// if the tenant is mapped, unless the rule is shadowed, then the differences to the resolved namespaces are only recorded.
+func (s *shadowing) namespaces(mapping *namespacesMapping, projectID, user string, resolved data.Set) data.Set {
+	candidate, mapped := mapping.lookup(projectID, user)
+	if !mapped {
+		return resolved
+	}
+	if !s.shadowed(ruleNamespaces) {
+		return candidate
+	}
+
+	if len(candidate) == 0 && len(resolved) != 0 {
+		s.record(ruleNamespaces, "no namespaces would be owned")
+		return resolved
+	}
+	for _, namespace := range resolved.Values() {
+		if _, exist := candidate[namespace]; !exist {
+			s.record(ruleNamespaces, fmt.Sprintf("namespace %q would not be owned", namespace))
+		}
+	}
+	for _, namespace := range candidate.Values() {
+		if _, exist := resolved[namespace]; !exist {
+			s.record(ruleNamespaces, fmt.Sprintf("namespace %q would be owned", namespace))
+		}
+	}
+
+	return resolved
+}
+
+// record logs, counts and audits the denial or difference by the shadowed rule.
+func (s *shadowing) record(rule, reason string) {
+	log.Infof("shadow denial[%s] by %s: %s", s.tag, rule, reason)
+	if s.metrics != nil {
+		s.metrics.denials.WithLabelValues(rule).Inc()
+	}
+	s.event.AddShadowDenial(rule, reason)
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/audit"
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_shadowing(t *testing.T) {
+	event := &audit.Event{}
+	shadow := &shadowing{rules: map[string]struct{}{ruleQueryCost: {}}, event: event}
+
+	require.NoError(t, shadow.deny(ruleQueryCost, errors.New("too expensive")))
+	require.EqualError(t, shadow.deny(ruleMaxSeries, errors.New("too many series")), "too many series")
+	require.NoError(t, shadow.deny(ruleMaxSeries, nil))
+	require.Equal(t, []audit.ShadowDenial{{Rule: ruleQueryCost, Reason: "too expensive"}}, event.ShadowDenials)
+
+	var unshadowed *shadowing
+	require.Error(t, unshadowed.deny(ruleQueryCost, errors.New("too expensive")))
+
+	require.NoError(t, validateShadowRules([]string{shadowAllRules, ruleRateLimits, ruleNamespaces}))
+	require.ErrorContains(t, validateShadowRules([]string{"tokens"}), "unknown shadow rule")
+
+	// the candidate namespaces are served unless the rule is shadowed, then the differences are recorded
+	mapping := &namespacesMapping{
+		Projects: map[string][]string{"p-a": {"ns-a", "ns-c"}},
+		Users:    map[string][]string{"u-x": {}},
+	}
+	resolved := data.NewSet("ns-a", "ns-b")
+	require.Equal(t, data.NewSet("ns-a", "ns-c"), unshadowed.namespaces(mapping, "p-a", "u-x", resolved))
+	require.Equal(t, resolved, unshadowed.namespaces(mapping, "p-b", "u-y", resolved))
+
+	event = &audit.Event{}
+	shadow = &shadowing{rules: data.NewSet(ruleNamespaces), event: event}
+	require.Equal(t, resolved, shadow.namespaces(mapping, "p-a", "u-x", resolved))
+	require.Equal(t, resolved, shadow.namespaces(mapping, "", "u-x", resolved))
+	require.Equal(t, []audit.ShadowDenial{
+		{Rule: ruleNamespaces, Reason: `namespace "ns-b" would not be owned`},
+		{Rule: ruleNamespaces, Reason: `namespace "ns-c" would be owned`},
+		{Rule: ruleNamespaces, Reason: "no namespaces would be owned"},
+	}, event.ShadowDenials)
+}
+
+func Test_accessControlShadowNamespaces(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query": map[string]interface{}{"resultType": "vector", "result": []interface{}{}},
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.namespacesMapping = &namespacesMapping{Projects: map[string][]string{"p-some": {"ns-a", "ns-c"}}}
+	agt.shadowMetrics = newShadowMetrics(agt.registry)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLogger, err := audit.New(audit.Config{Sinks: []string{audit.SinkFilePrefix + auditPath}, SampleRate: 1}, agt.registry)
+	require.NoError(t, err)
+	agt.auditLogger = auditLogger
+	httpBackend := agt.httpBackend()
+
+	doQuery := func() {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query?"+url.Values{"query": {"sum(up)"}}.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+	}
+
+	// the resolved namespaces are still served, the differences are only reported
+	agt.cfg.shadowRules = []string{ruleNamespaces}
+	doQuery()
+	require.InDelta(t, 2, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleNamespaces)), 0)
+
+	// the candidate namespaces are served
+	agt.cfg.shadowRules = nil
+	doQuery()
+	require.InDelta(t, 2, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleNamespaces)), 0)
+	require.NoError(t, auditLogger.Close())
+
+	content, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+
+	var shadowed, enforced audit.Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &shadowed))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &enforced))
+
+	require.Equal(t, []string{"ns-a", "ns-b"}, shadowed.Namespaces)
+	require.Equal(t, `sum(up{namespace=~"ns-a|ns-b"})`, shadowed.Queries[0].Hijacked)
+	require.Equal(t, []audit.ShadowDenial{
+		{Rule: ruleNamespaces, Reason: `namespace "ns-b" would not be owned`},
+		{Rule: ruleNamespaces, Reason: `namespace "ns-c" would be owned`},
+	}, shadowed.ShadowDenials)
+
+	require.Equal(t, []string{"ns-a", "ns-c"}, enforced.Namespaces)
+	require.Equal(t, `sum(up{namespace=~"ns-a|ns-c"})`, enforced.Queries[0].Hijacked)
+	require.Empty(t, enforced.ShadowDenials)
+}
+
+func Test_accessControlShadow(t *testing.T) {
+	upstream := startFakePrometheus(t, map[string]interface{}{
+		"/api/v1/query":       map[string]interface{}{"resultType": "vector", "result": []interface{}{}},
+		"/api/v1/query_range": map[string]interface{}{"resultType": "matrix", "result": []interface{}{}},
+	})
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.tenantLimits = &tenantLimitsConfig{
+		Defaults: tenantLimits{
+			RateLimits: map[endpointClass]*rateLimit{endpointClassInstant: {RequestsPerSecond: 0.001, Burst: 2}},
+			QueryLimits: &queryLimits{
+				MaxRangeWindow: prommodel.Duration(time.Hour),
+				DeniedMetrics:  []string{"secret_.*"},
+			},
+			Shadow: []string{ruleDeniedMetrics, ruleRateLimits},
+		},
+	}
+	require.NoError(t, agt.cfg.tenantLimits.validate())
+	agt.rateLimiter = newTenantRateLimiter(agt.cfg.tenantLimits, agt.registry)
+	agt.shadowMetrics = newShadowMetrics(agt.registry)
+	httpBackend := agt.httpBackend()
+
+	doQuery := func(query string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res.Code
+	}
+	doQueryRange := func(points int) int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query_range?"+url.Values{
+			"query": {"up"}, "start": {"0"}, "end": {strconv.Itoa(points)}, "step": {"1"},
+		}.Encode(), nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// the denied metric is only reported
+	require.Equal(t, http.StatusOK, doQuery("sum(secret_tokens)"))
+	require.InDelta(t, 1, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleDeniedMetrics)), 0)
+
+	// the query limits are enforced
+	require.Equal(t, http.StatusBadRequest, doQuery("rate(up[2h])"))
+
+	// the exceeded rate limit is only reported
+	require.Equal(t, http.StatusOK, doQuery("up"))
+	require.InDelta(t, 1, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleRateLimits)), 0)
+
+	agt.cfg.shadowRules = []string{shadowAllRules}
+	require.Equal(t, http.StatusOK, doQuery("rate(up[2h])"))
+	require.InDelta(t, 1, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleQueryLimits)), 0)
+
+	// only the configured resolution limit is shadowed, the default limit of Prometheus still applies
+	require.Equal(t, http.StatusBadRequest, doQueryRange(20000))
+	agt.cfg.tenantLimits.Defaults.QueryLimits.MaxResolutionPoints = 100
+	require.Equal(t, http.StatusOK, doQueryRange(1000))
+	require.InDelta(t, 2, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleQueryLimits)), 0)
+	require.Equal(t, http.StatusBadRequest, doQueryRange(20000))
+	require.InDelta(t, 2, testutil.ToFloat64(agt.shadowMetrics.denials.WithLabelValues(ruleQueryLimits)), 0)
+	agt.cfg.tenantLimits.Defaults.QueryLimits.MaxResolutionPoints = 0
+
+	agt.cfg.shadowRules = nil
+	agt.cfg.tenantLimits.Defaults.Shadow = []string{ruleRateLimits}
+	require.Equal(t, http.StatusBadRequest, doQuery("sum(secret_tokens)"))
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// drainPollInterval is how often the shutdown checks whether the in-flight requests are done.
+const drainPollInterval = 50 * time.Millisecond
+
+var errShuttingDown = errors.New("shutting down")
+
+// inFlightRequests counts the requests being served, including the HTTP/2 and gRPC streams
+// on the connections which the h2c handler hijacked from the HTTP server, so that the shutdown waits for them.
+type inFlightRequests struct {
+	count atomic.Int64
+}
+
+func (f *inFlightRequests) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.count.Add(1)
+		defer f.count.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait blocks until no requests are in flight or the context is done.
+func (f *inFlightRequests) wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for f.count.Load() != 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "%d requests are still in flight", f.count.Load())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// shutdown fails the readiness and keeps serving for the shutdown delay, so that the clients stop sending new requests,
+// then it stops accepting connections and drains the in-flight requests within the shutdown timeout.
+// At last, it stops the informers and the other background loops, and flushes the audit events and the traces.
+func (a *agent) shutdown(httpProxy *http.Server, grpcProxy *grpc.Server, adminServer *http.Server) {
+	a.shuttingDown.Store(true)
+	log.Infof("Shutting down, serving for %v before draining the connections", a.cfg.shutdownDelay)
+	time.Sleep(a.cfg.shutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), a.cfg.shutdownTimeout)
+	defer cancel()
+
+	// closes the listener too, which the multiplexed HTTP listener wraps
+	if err := httpProxy.Shutdown(drainCtx); err != nil {
+		log.Warnf("Error shutting down http proxy: %v", err)
+	}
+	if err := a.inFlight.wait(drainCtx); err != nil {
+		log.Warnf("Error draining requests: %v", err)
+	}
+	// the gRPC streams are served by the HTTP server, which does not support a graceful stop of the gRPC server,
+	// so the streams left over the shutdown timeout are closed
+	grpcProxy.Stop()
+
+	if a.cfg.cancel != nil {
+		a.cfg.cancel()
+	}
+
+	if a.auditLogger != nil {
+		if err := a.auditLogger.Close(); err != nil {
+			log.Warnf("Error closing audit log: %v", err)
+		}
+	}
+	// the drain context may be done already, so the pending spans are flushed with a fresh one
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+	defer cancelFlush()
+	if err := a.tracerProvider.Shutdown(flushCtx); err != nil {
+		log.Warnf("Error flushing traces: %v", err)
+	}
+
+	// the admin server is closed last, so that the probes and the metrics are served while draining
+	if err := adminServer.Close(); err != nil {
+		log.Warnf("Error closing admin server: %v", err)
+	}
+
+	log.Info("Shut down")
+}
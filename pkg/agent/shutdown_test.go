@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_shutdown(t *testing.T) {
+	queryStarted := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/query" {
+			close(queryStarted)
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	t.Cleanup(upstream.Close)
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.shutdownDelay = 500 * time.Millisecond
+	agt.cfg.shutdownTimeout = 5 * time.Second
+	informersStopped := make(chan struct{})
+	agt.cfg.cancel = func() { close(informersStopped) }
+
+	var err error
+	agt.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	agt.adminListener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	shutdown, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- agt.serve(shutdown) }()
+
+	get := func(listener net.Listener, path, token string) (*http.Response, error) {
+		req, rErr := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+path, nil)
+		require.NoError(t, rErr)
+		if len(token) != 0 {
+			req.Header.Set(authorizationHeaderKey, "Bearer "+token)
+		}
+		// every request dials a new connection, to check that the listeners are still accepting
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		return client.Do(req)
+	}
+	readyCode := func() int {
+		res, rErr := get(agt.adminListener, "/_/readyz", "")
+		require.NoError(t, rErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, readyCode())
+
+	// the query is in flight when the signal is received
+	queried := make(chan int, 1)
+	go func() {
+		res, qErr := get(agt.listener, "/api/v1/query?"+url.Values{"query": {"up"}}.Encode(), "someNamespacesToken")
+		if qErr != nil {
+			queried <- 0
+			return
+		}
+		_ = res.Body.Close()
+		queried <- res.StatusCode
+	}()
+	<-queryStarted
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+
+	// the readiness fails, while the connections are still accepted during the shutdown delay
+	require.Eventually(t, func() bool { return readyCode() == http.StatusServiceUnavailable }, time.Second, 10*time.Millisecond)
+	res, err := get(agt.listener, "/-/healthy", "")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the in-flight query is drained before serving returns
+	require.NoError(t, <-served)
+	select {
+	case code := <-queried:
+		require.Equal(t, http.StatusOK, code)
+	case <-time.After(time.Second):
+		t.Fatal("the in-flight query has not completed")
+	}
+	<-informersStopped
+
+	// the new connections are refused
+	_, err = get(agt.listener, "/-/healthy", "")
+	require.Error(t, err)
+	_, err = get(agt.adminListener, "/_/healthz", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/caas-team/prometheus-auth/pkg/agent"
+	// tracerShutdownTimeout bounds flushing the pending spans on shutdown.
+	tracerShutdownTimeout = 5 * time.Second
+)
+
+// tracePropagator carries the W3C trace context from the clients through to the upstreams.
+var tracePropagator = propagation.TraceContext{} //nolint:gochecknoglobals // stateless propagator
+
+// newTracerProvider creates the provider of the spans, which are batched to the OTLP/HTTP endpoint if it is set.
+// Otherwise the spans are not sampled, but they still carry the trace IDs which tag and propagate the requests.
+func newTracerProvider(ctx context.Context, cfg *agentConfig) (*sdktrace.TracerProvider, error) {
+	if len(cfg.tracingEndpoint) == 0 {
+		return sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())), nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.tracingEndpoint))
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to create trace exporter to %s", cfg.tracingEndpoint)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "prometheus-auth"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.tracingSampleRatio))),
+	), nil
+}
+
+// startRequestSpan starts the span of a tenant request, as a child of the trace context of the client if any.
+func (a *agent) startRequestSpan(r *http.Request, route string) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return a.tracerProvider.Tracer(tracerName).Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+}
+
+// startSpan starts a span within the trace of the context, by the provider of its current span.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_accessControlTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	// the collector stub receives the exported spans
+	var mu sync.Mutex
+	spans := make(map[string]string)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				for _, span := range ss.GetSpans() {
+					spans[span.GetName()] = hex.EncodeToString(span.GetTraceId())
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(collector.Close)
+
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	agt := mockAgentWithUpstream(t, upstream.URL)
+	agt.cfg.tracingEndpoint = collector.URL + "/v1/traces"
+	agt.cfg.tracingSampleRatio = 0
+	tracerProvider, err := newTracerProvider(context.Background(), agt.cfg)
+	require.NoError(t, err)
+	agt.tracerProvider = tracerProvider
+
+	// the sampling decision of the client is followed
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/query?"+url.Values{"query": {"sum(up)"}}.Encode(), nil)
+	req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	agt.httpBackend().ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.NoError(t, tracerProvider.Shutdown(context.Background()))
+
+	require.Regexp(t, "^00-"+traceID+"-[0-9a-f]{16}-01$", traceparent)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"GET /api/v1/query", "authenticate", "resolve namespaces", "hijack", "rewrite", "upstream"} {
+		require.Contains(t, spans, name)
+		require.Equal(t, traceID, spans[name])
+	}
+}
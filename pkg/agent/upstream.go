@@ -0,0 +1,403 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/juju/errors"
+	promapi "github.com/prometheus/client_golang/api"
+	promapiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	routeKindProject   = "project"
+	routeKindNamespace = "namespace"
+	routeKindPath      = "path"
+)
+
+// upstream is a Prometheus instance which the requests are proxied to,
+// the requests fail over between its endpoints if it has several ones.
+type upstream struct {
+	name      string
+	url       *url.URL
+	proxy     http.Handler
+	api       promapiv1.API
+	transport *failoverTransport
+	// replicas are the HA peers of the upstream, which scrape the same targets
+	replicas []*upstream
+}
+
+// members returns the upstream followed by its HA replicas.
+func (u *upstream) members() []*upstream {
+	return append([]*upstream{u}, u.replicas...)
+}
+
+// fetch sends the given request to the upstream and reads the whole response,
+// responses with an unsuccessful status code are returned together with an error.
+func (u *upstream) fetch(request *http.Request, body []byte) (*http.Response, []byte, error) {
+	reqURL := *request.URL
+	reqURL.Scheme = u.url.Scheme
+	reqURL.Host = u.url.Host
+	reqURL.Path = singleJoiningSlash(u.url.Path, request.URL.Path)
+	reqURL.RawPath = ""
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(request.Context(), request.Method, reqURL.String(), reqBody)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "unable to create request for upstream %s", u.name)
+	}
+	req.Header = request.Header.Clone()
+
+	resp, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "failed to request upstream %s", u.name)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "failed to read response of upstream %s", u.name)
+	}
+
+	if resp.StatusCode/100 != 2 { //nolint:mnd // 2xx status codes
+		return resp, respBody, errors.Errorf("upstream %s responded with %s", u.name, resp.Status)
+	}
+
+	return resp, respBody, nil
+}
+
+// route maps the requests of a project, of namespaces or of a path prefix to an upstream.
+type route struct {
+	kind            string
+	value           string
+	namespaceRegexp *regexp.Regexp
+	upstream        *upstream
+}
+
+func (r *route) matches(projectID string, namespaceSet data.Set, path string) bool {
+	switch r.kind {
+	case routeKindProject:
+		return len(projectID) != 0 && projectID == r.value
+	case routeKindNamespace:
+		for ns := range namespaceSet {
+			if r.namespaceRegexp.MatchString(ns) {
+				return true
+			}
+		}
+		return false
+	case routeKindPath:
+		return strings.HasPrefix(path, r.value)
+	default:
+		return false
+	}
+}
+
+// upstreams is the routing table of the upstreams,
+// the first matching route wins, otherwise the default upstream is used.
+type upstreams struct {
+	defaultUpstream *upstream
+	routes          []*route
+	all             []*upstream
+}
+
+func (u *upstreams) lookup(projectID string, namespaceSet data.Set, path string) *upstream {
+	for _, r := range u.routes {
+		if r.matches(projectID, namespaceSet, path) {
+			return r.upstream
+		}
+	}
+
+	return u.defaultUpstream
+}
+
+// lookupAll returns the upstreams of all matching routes, which the requests are fanned out to,
+// otherwise the default upstream is used.
+func (u *upstreams) lookupAll(projectID string, namespaceSet data.Set, path string) []*upstream {
+	ret := make([]*upstream, 0, 1)
+	seen := make(map[*upstream]struct{})
+	for _, r := range u.routes {
+		if _, exist := seen[r.upstream]; exist || !r.matches(projectID, namespaceSet, path) {
+			continue
+		}
+
+		seen[r.upstream] = struct{}{}
+		ret = append(ret, r.upstream)
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, u.defaultUpstream)
+	}
+
+	return ret
+}
+
+// newUpstreams creates the routing table from the default upstream URLs,
+// the route definitions in the form of '<kind>:<value>=<urls>'
+// and the replica definitions in the form of '<upstream urls>=<replica urls>',
+// where the URLs of an upstream are a comma-separated list of endpoints to fail over between.
+func newUpstreams(cfg *agentConfig, reg prometheus.Registerer) (*upstreams, error) {
+	metrics := &upstreamMetrics{
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "prometheus_auth_upstream_up",
+				Help: "Whether the upstream endpoint is considered healthy.",
+			},
+			[]string{"upstream"},
+		),
+		failovers: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_upstream_failovers_total",
+				Help: "The total number of requests failed over to another endpoint of the upstream.",
+			},
+			[]string{"upstream"},
+		),
+		requestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "prometheus_auth_upstream_request_duration_seconds",
+				Help:    "The duration until the upstream responded with the headers.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"upstream"},
+		),
+		requestErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_upstream_request_errors_total",
+				Help: "The total number of requests the upstream failed with a connection error or a 5xx status code.",
+			},
+			[]string{"upstream"},
+		),
+	}
+	reg.MustRegister(metrics.up, metrics.failovers, metrics.requestDuration, metrics.requestErrors)
+
+	rt, err := newUpstreamRoundTripper(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	byURLs := make(map[string]*upstream)
+	all := make([]*upstream, 0, 1)
+	newUpstreamOf := func(urls []*url.URL) (*upstream, error) {
+		up, err := newUpstream(urls, rt, metrics)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, up)
+		return up, nil
+	}
+	getUpstream := func(urls []*url.URL) (*upstream, error) {
+		if up, exist := byURLs[joinURLs(urls)]; exist {
+			return up, nil
+		}
+
+		up, err := newUpstreamOf(urls)
+		if err != nil {
+			return nil, err
+		}
+
+		byURLs[joinURLs(urls)] = up
+		return up, nil
+	}
+
+	defaultUpstream, err := getUpstream(cfg.proxyURLs)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]*route, 0, len(cfg.upstreamRoutes))
+	for _, routeDef := range cfg.upstreamRoutes {
+		selector, rawURLs, found := cutUpstreamRoute(routeDef)
+		if !found {
+			return nil, errors.Errorf("invalid upstream route %q, expected '<kind>:<value>=<url>'", routeDef)
+		}
+
+		kind, value, found := strings.Cut(selector, ":")
+		if !found || len(value) == 0 {
+			return nil, errors.Errorf("invalid upstream route selector %q, expected '<kind>:<value>'", selector)
+		}
+
+		r := &route{
+			kind:  kind,
+			value: value,
+		}
+
+		switch kind {
+		case routeKindProject, routeKindPath:
+		case routeKindNamespace:
+			if r.namespaceRegexp, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, errors.Annotatef(err, "invalid namespace selector of upstream route %q", routeDef)
+			}
+		default:
+			return nil, errors.Errorf("unknown kind %q of upstream route %q", kind, routeDef)
+		}
+
+		routeURLs, pErr := parseURLs(rawURLs)
+		if pErr != nil {
+			return nil, errors.Annotatef(pErr, "invalid URL of upstream route %q", routeDef)
+		}
+
+		if r.upstream, err = getUpstream(routeURLs); err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, r)
+	}
+
+	for _, replicaDef := range cfg.upstreamReplicas {
+		rawURLs, rawReplicaURLs, found := strings.Cut(replicaDef, "=")
+		if !found {
+			return nil, errors.Errorf("invalid upstream replica %q, expected '<upstream url>=<replica url>'", replicaDef)
+		}
+
+		upstreamURLs, pErr := parseURLs(rawURLs)
+		if pErr != nil {
+			return nil, errors.Annotatef(pErr, "invalid upstream URL of upstream replica %q", replicaDef)
+		}
+		up, exist := byURLs[joinURLs(upstreamURLs)]
+		if !exist {
+			return nil, errors.Errorf("unknown upstream %q of upstream replica %q", rawURLs, replicaDef)
+		}
+
+		replicaURLs, pErr := parseURLs(rawReplicaURLs)
+		if pErr != nil {
+			return nil, errors.Annotatef(pErr, "invalid replica URL of upstream replica %q", replicaDef)
+		}
+		if _, exist = byURLs[joinURLs(replicaURLs)]; exist {
+			return nil, errors.Errorf("replica %q of upstream replica %q is already an upstream", rawReplicaURLs, replicaDef)
+		}
+
+		replica, rErr := newUpstreamOf(replicaURLs)
+		if rErr != nil {
+			return nil, rErr
+		}
+		up.replicas = append(up.replicas, replica)
+	}
+
+	return &upstreams{
+		defaultUpstream: defaultUpstream,
+		routes:          routes,
+		all:             all,
+	}, nil
+}
+
+// startHealthChecks probes the endpoints of the upstreams which have several ones,
+// so that the requests fail back to a recovered endpoint.
+func (u *upstreams) startHealthChecks(ctx context.Context, interval time.Duration) {
+	for _, up := range u.all {
+		if len(up.transport.endpoints) > 1 {
+			go up.transport.checkHealth(ctx, interval)
+		}
+	}
+}
+
+// ready checks that the default upstream and the upstreams of the routes are reachable,
+// the HA replicas are optional.
+func (u *upstreams) ready(ctx context.Context) error {
+	ups := []*upstream{u.defaultUpstream}
+	for _, r := range u.routes {
+		ups = append(ups, r.upstream)
+	}
+
+	checked := make(map[*upstream]struct{})
+	for _, up := range ups {
+		if _, exist := checked[up]; exist {
+			continue
+		}
+		checked[up] = struct{}{}
+
+		if err := up.transport.ready(ctx); err != nil {
+			return errors.Annotatef(err, "upstream %s is not ready", up.name)
+		}
+	}
+
+	return nil
+}
+
+// cutUpstreamRoute splits the route into its selector and its URLs,
+// on the last '=' before the scheme of the first URL so that the selector may contain '='.
+func cutUpstreamRoute(routeDef string) (string, string, bool) {
+	selector := routeDef
+	if idx := strings.Index(routeDef, "://"); idx >= 0 {
+		selector = routeDef[:idx]
+	}
+
+	idx := strings.LastIndex(selector, "=")
+	if idx < 0 {
+		return routeDef, "", false
+	}
+
+	return routeDef[:idx], routeDef[idx+1:], true
+}
+
+type upstreamMetrics struct {
+	up              *prometheus.GaugeVec
+	failovers       *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	requestErrors   *prometheus.CounterVec
+}
+
+func newUpstream(urls []*url.URL, rt http.RoundTripper, metrics *upstreamMetrics) (*upstream, error) {
+	names := make([]string, 0, len(urls))
+	endpoints := make([]*endpoint, 0, len(urls))
+	for _, u := range urls {
+		names = append(names, u.Host)
+		endpoints = append(endpoints, &endpoint{
+			url: u,
+			up:  metrics.up.WithLabelValues(redactURLs(u.String())),
+		})
+	}
+	name := strings.Join(names, ",")
+
+	transport := &failoverTransport{
+		next:      rt,
+		endpoints: endpoints,
+		failovers: metrics.failovers.WithLabelValues(name),
+		duration:  metrics.requestDuration.WithLabelValues(name),
+		errors:    metrics.requestErrors.WithLabelValues(name),
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(urls[0])
+	proxy.Transport = transport
+
+	promClient, err := promapi.NewClient(promapi.Config{
+		Address:      urls[0].String(),
+		RoundTripper: transport,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to new Prometheus client for %s", urls[0])
+	}
+
+	return &upstream{
+		name:      name,
+		url:       urls[0],
+		proxy:     proxy,
+		api:       promapiv1.NewAPI(promClient),
+		transport: transport,
+	}, nil
+}
+
+// singleJoiningSlash joins the URL paths like the httputil.ReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
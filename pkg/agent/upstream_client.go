@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/common/config"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const upstreamTCPKeepAlive = 30 * time.Second
+
+// loadUpstreamClientConfig loads the HTTP client config of the upstreams,
+// in the format of Prometheus' 'http_config', relative paths are resolved against the directory of the file.
+func loadUpstreamClientConfig(path string) (config.HTTPClientConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config.HTTPClientConfig{}, errors.Annotatef(err, "unable to read upstream client config %q", path)
+	}
+
+	clientCfg, err := config.LoadHTTPConfig(string(content))
+	if err != nil {
+		return config.HTTPClientConfig{}, errors.Annotatef(err, "invalid upstream client config %q", path)
+	}
+	clientCfg.SetDirectory(filepath.Dir(path))
+
+	return *clientCfg, nil
+}
+
+// newUpstreamRoundTripper creates the transport to the upstreams from the HTTP client config,
+// it is shared by the reverse proxies, the API clients and the health checks.
+func newUpstreamRoundTripper(cfg *agentConfig) (http.RoundTripper, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.upstreamDialTimeout,
+		KeepAlive: upstreamTCPKeepAlive,
+	}
+	opts := []config.HTTPClientOption{
+		config.WithDialContextFunc(dialer.DialContext),
+		config.WithUserAgent("prometheus-auth"),
+	}
+	if cfg.upstreamIdleConnTimeout > 0 {
+		opts = append(opts, config.WithIdleConnTimeout(cfg.upstreamIdleConnTimeout))
+	}
+	if cfg.upstreamKeepAlivesDisabled {
+		opts = append(opts, config.WithKeepAlivesDisabled())
+	}
+	if !cfg.upstreamClientConfig.EnableHTTP2 {
+		opts = append(opts, config.WithHTTP2Disabled())
+	}
+
+	rt, err := config.NewRoundTripperFromConfig(cfg.upstreamClientConfig, "upstream", opts...)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to create upstream transport")
+	}
+
+	if !hasUpstreamCredentials(&cfg.upstreamClientConfig) {
+		return rt, nil
+	}
+
+	return &stripAuthorizationTransport{next: rt}, nil
+}
+
+func hasUpstreamCredentials(clientCfg *config.HTTPClientConfig) bool {
+	return clientCfg.BasicAuth != nil || clientCfg.Authorization != nil || clientCfg.OAuth2 != nil ||
+		len(clientCfg.BearerToken) != 0 || len(clientCfg.BearerTokenFile) != 0
+}
+
+// stripAuthorizationTransport drops the token of the tenant,
+// so that the configured upstream credentials are used instead.
+type stripAuthorizationTransport struct {
+	next http.RoundTripper
+}
+
+func (t *stripAuthorizationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get(authorizationHeaderKey)) == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Del(authorizationHeaderKey)
+	return t.next.RoundTrip(req)
+}
+
+// newGRPCDialOptions creates the options to dial the gRPC upstream with the TLS and credentials of the HTTP client config.
+func newGRPCDialOptions(cfg *agentConfig) ([]grpc.DialOption, error) {
+	clientCfg := &cfg.upstreamClientConfig
+
+	opts := make([]grpc.DialOption, 0, 2) //nolint:mnd // transport and per-RPC credentials
+	if cfg.proxyURLs[0].Scheme == "https" {
+		tlsCfg, err := config.NewTLSConfig(&clientCfg.TLSConfig)
+		if err != nil {
+			return nil, errors.Annotate(err, "unable to create upstream TLS config")
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	switch {
+	case clientCfg.Authorization != nil:
+		opts = append(opts, grpc.WithPerRPCCredentials(&grpcCredentials{
+			authType:        clientCfg.Authorization.Type,
+			credentials:     string(clientCfg.Authorization.Credentials),
+			credentialsFile: clientCfg.Authorization.CredentialsFile,
+		}))
+	case len(clientCfg.BearerToken) != 0 || len(clientCfg.BearerTokenFile) != 0:
+		opts = append(opts, grpc.WithPerRPCCredentials(&grpcCredentials{
+			authType:        "Bearer",
+			credentials:     string(clientCfg.BearerToken),
+			credentialsFile: clientCfg.BearerTokenFile,
+		}))
+	case clientCfg.BasicAuth != nil:
+		opts = append(opts, grpc.WithPerRPCCredentials(&grpcCredentials{
+			authType:        "Basic",
+			basicUsername:   string(clientCfg.BasicAuth.Username),
+			credentials:     string(clientCfg.BasicAuth.Password),
+			credentialsFile: clientCfg.BasicAuth.PasswordFile,
+		}))
+	case clientCfg.OAuth2 != nil:
+		log.Warn("The oauth2 credentials of the upstream client config are not supported by the gRPC upstream")
+	}
+
+	return opts, nil
+}
+
+// grpcCredentials sets the authorization metadata of the gRPC requests,
+// the credentials file is read on each request to follow rotations.
+type grpcCredentials struct {
+	authType        string
+	basicUsername   string
+	credentials     string
+	credentialsFile string
+}
+
+func (c *grpcCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	secret := c.credentials
+	if len(c.credentialsFile) != 0 {
+		content, err := os.ReadFile(c.credentialsFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read credentials file %q", c.credentialsFile)
+		}
+		secret = strings.TrimSpace(string(content))
+	}
+
+	if c.authType == "Basic" {
+		secret = base64.StdEncoding.EncodeToString([]byte(c.basicUsername + ":" + secret))
+	}
+
+	return map[string]string{"authorization": c.authType + " " + secret}, nil
+}
+
+func (c *grpcCredentials) RequireTransportSecurity() bool {
+	return false
+}
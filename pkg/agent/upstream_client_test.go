@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_upstreamClientConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.Header.Get(authorizationHeaderKey))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("upstream-token\n"), 0o600))
+	configPath := filepath.Join(dir, "client.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+tls_config:
+  ca_file: ca.crt
+authorization:
+  credentials_file: token
+`), 0o600))
+
+	clientCfg, err := loadUpstreamClientConfig(configPath)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "ca.crt"), clientCfg.TLSConfig.CAFile)
+
+	proxyURLs, err := parseURLs(srv.URL)
+	require.NoError(t, err)
+	cfg := &agentConfig{proxyURLs: proxyURLs, upstreamClientConfig: clientCfg}
+	ups, err := newUpstreams(cfg, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// the token of the tenant is replaced by the upstream credentials
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/label/foo/values", nil)
+	req.Header.Set(authorizationHeaderKey, "Bearer someNamespacesToken")
+	res := httptest.NewRecorder()
+	ups.defaultUpstream.proxy.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, "Bearer upstream-token", res.Body.String())
+
+	grpcOpts, err := newGRPCDialOptions(cfg)
+	require.NoError(t, err)
+	require.Len(t, grpcOpts, 2)
+
+	_, err = loadUpstreamClientConfig(filepath.Join(dir, "missing.yaml"))
+	require.ErrorContains(t, err, "unable to read upstream client config")
+}
+
+func Test_grpcCredentials(t *testing.T) {
+	creds := &grpcCredentials{authType: "Basic", basicUsername: "user", credentials: "pass"}
+	md, err := creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"authorization": "Basic dXNlcjpwYXNz"}, md)
+}
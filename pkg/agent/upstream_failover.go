@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// endpointEjectionPeriod is how long a failing endpoint is skipped,
+	// unless an active health check finds it ready again before.
+	endpointEjectionPeriod = 30 * time.Second
+	endpointReadyPath      = "/-/ready"
+)
+
+// endpoint is one of the URLs of an upstream, which the requests fail over between.
+type endpoint struct {
+	url          *url.URL
+	ejectedUntil atomic.Int64
+	up           prometheus.Gauge
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	return now.UnixNano() >= e.ejectedUntil.Load()
+}
+
+func (e *endpoint) markHealthy() {
+	e.ejectedUntil.Store(0)
+	e.up.Set(1)
+}
+
+func (e *endpoint) eject(now time.Time) {
+	e.ejectedUntil.Store(now.Add(endpointEjectionPeriod).UnixNano())
+	e.up.Set(0)
+}
+
+// failoverTransport sends the requests to the first healthy endpoint of an upstream,
+// ejecting the endpoints which fail with connection errors or 5xx status codes,
+// and retrying the request on the next endpoint if its body can be replayed.
+type failoverTransport struct {
+	next      http.RoundTripper
+	endpoints []*endpoint
+	failovers prometheus.Counter
+	duration  prometheus.Observer
+	errors    prometheus.Counter
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), "upstream",
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.path", req.URL.Path),
+	)
+	req = req.Clone(ctx)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := t.roundTrip(req)
+	t.duration.Observe(time.Since(start).Seconds())
+	// the requests which the client gave up are not failures of the upstream
+	if (err != nil || resp.StatusCode >= http.StatusInternalServerError) && req.Context().Err() == nil {
+		t.errors.Inc()
+	}
+
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+
+	return resp, err
+}
+
+func (t *failoverTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(t.endpoints))
+	for _, ep := range t.endpoints {
+		if ep.healthy(now) {
+			candidates = append(candidates, ep)
+		}
+	}
+	// give all endpoints a chance if none is healthy
+	if len(candidates) == 0 {
+		candidates = t.endpoints
+	}
+
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var resp *http.Response
+	var err error
+	for idx, ep := range candidates {
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme = ep.url.Scheme
+		attempt.URL.Host = ep.url.Host
+		if idx > 0 && req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, errors.Annotate(err, "unable to replay request body")
+			}
+		}
+
+		resp, err = t.next.RoundTrip(attempt)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			ep.markHealthy()
+			return resp, nil
+		}
+
+		ep.eject(time.Now())
+		if idx == len(candidates)-1 || !replayable || req.Context().Err() != nil {
+			break
+		}
+
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		log.Debugf("failing over from upstream endpoint %s: %v", ep.url.Host, err)
+		t.failovers.Inc()
+	}
+
+	return resp, err
+}
+
+// checkHealth probes the readiness of all endpoints periodically, until the context is done.
+func (t *failoverTransport) checkHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, ep := range t.endpoints {
+			t.probe(ctx, ep, interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *failoverTransport) probe(ctx context.Context, ep *endpoint, timeout time.Duration) {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := t.checkReady(probeCtx, ep); err != nil {
+		log.Debugf("health check of upstream endpoint %s failed: %v", ep.url.Host, err)
+		ep.eject(time.Now())
+		return
+	}
+
+	ep.markHealthy()
+}
+
+// ready returns nil if any endpoint is ready, otherwise the failure of the last one.
+func (t *failoverTransport) ready(ctx context.Context) error {
+	var err error
+	for _, ep := range t.endpoints {
+		if err = t.checkReady(ctx, ep); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// checkReady asks the endpoint whether it is ready to serve queries.
+func (t *failoverTransport) checkReady(ctx context.Context, ep *endpoint) error {
+	readyURL := *ep.url
+	readyURL.Path = singleJoiningSlash(ep.url.Path, endpointReadyPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyURL.String(), http.NoBody)
+	if err != nil {
+		return errors.Annotatef(err, "unable to create health check of upstream endpoint %s", ep.url.Host)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// parseURLs parses a comma-separated list of URLs,
+// which must only differ in their schemes and hosts.
+func parseURLs(raw string) ([]*url.URL, error) {
+	rawURLs := strings.Split(raw, ",")
+	ret := make([]*url.URL, 0, len(rawURLs))
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to parse URL %q", rawURL)
+		}
+		if len(u.Host) == 0 {
+			return nil, errors.Errorf("missing host of URL %q", rawURL)
+		}
+		if len(ret) != 0 && u.Path != ret[0].Path {
+			return nil, errors.Errorf("path of URL %q differs from %q", rawURL, ret[0])
+		}
+
+		ret = append(ret, u)
+	}
+
+	return ret, nil
+}
+
+func joinURLs(urls []*url.URL) string {
+	rawURLs := make([]string, 0, len(urls))
+	for _, u := range urls {
+		rawURLs = append(rawURLs, u.String())
+	}
+
+	return strings.Join(rawURLs, ",")
+}
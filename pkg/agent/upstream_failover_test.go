@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseURLs(t *testing.T) {
+	urls, err := parseURLs("http://a:9090, http://b:9090")
+	require.NoError(t, err)
+	require.Equal(t, "http://a:9090,http://b:9090", joinURLs(urls))
+
+	_, err = parseURLs("http://a:9090,b")
+	require.ErrorContains(t, err, "missing host")
+
+	_, err = parseURLs("http://a:9090/prom,http://b:9090")
+	require.ErrorContains(t, err, "differs from")
+}
+
+func Test_failoverTransport(t *testing.T) {
+	var readyB atomic.Bool
+	newEndpointServer := func(name string, status func() int) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(status())
+			_, _ = fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, body)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	failing := newEndpointServer("failing", func() int { return http.StatusServiceUnavailable })
+	healthy := newEndpointServer("healthy", func() int {
+		if readyB.Load() {
+			return http.StatusOK
+		}
+		return http.StatusServiceUnavailable
+	})
+	readyB.Store(true)
+
+	urls, err := parseURLs(failing.URL + "," + healthy.URL)
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	ups, err := newUpstreams(&agentConfig{proxyURLs: urls}, registry)
+	require.NoError(t, err)
+	up := ups.defaultUpstream
+
+	doRequest := func(method, body string) (int, string) {
+		req := httptest.NewRequest(method, "http://localhost:9090/api/v1/query", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		up.proxy.ServeHTTP(res, req)
+		return res.Code, res.Body.String()
+	}
+
+	t.Run("fail over", func(t *testing.T) {
+		code, body := doRequest(http.MethodGet, "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "healthy /api/v1/query ", body)
+		require.InDelta(t, 1, testutil.ToFloat64(up.transport.failovers), 0)
+	})
+
+	t.Run("ejected endpoint is skipped", func(t *testing.T) {
+		code, _ := doRequest(http.MethodGet, "")
+		require.Equal(t, http.StatusOK, code)
+		require.InDelta(t, 1, testutil.ToFloat64(up.transport.failovers), 0)
+		require.False(t, up.transport.endpoints[0].healthy(time.Now()))
+	})
+
+	t.Run("replay body", func(t *testing.T) {
+		up.transport.endpoints[0].markHealthy()
+
+		resp, body, fErr := up.fetch(httptest.NewRequest(http.MethodPost, "http://localhost:9090/api/v1/query", nil), []byte("query=up"))
+		require.NoError(t, fErr)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "healthy /api/v1/query query=up", string(body))
+	})
+
+	t.Run("all endpoints fail", func(t *testing.T) {
+		readyB.Store(false)
+		defer readyB.Store(true)
+
+		code, body := doRequest(http.MethodGet, "")
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, "healthy /api/v1/query ", body)
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ups.startHealthChecks(ctx, 10*time.Millisecond)
+
+		require.Eventually(t, func() bool {
+			return !up.transport.endpoints[0].healthy(time.Now()) && up.transport.endpoints[1].healthy(time.Now())
+		}, time.Second, 10*time.Millisecond)
+
+		upLines := []string{
+			fmt.Sprintf("prometheus_auth_upstream_up{upstream=%q} 0", failing.URL),
+			fmt.Sprintf("prometheus_auth_upstream_up{upstream=%q} 1", healthy.URL),
+		}
+		sort.Strings(upLines)
+		expected := `
+			# HELP prometheus_auth_upstream_up Whether the upstream endpoint is considered healthy.
+			# TYPE prometheus_auth_upstream_up gauge
+		` + strings.Join(upLines, "\n") + "\n"
+		require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "prometheus_auth_upstream_up"))
+	})
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/caas-team/prometheus-auth/pkg/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newUpstreams(t *testing.T) {
+	defaultURL, _ := url.Parse("http://default:9090")
+
+	cases := []struct {
+		name     string
+		routes   []string
+		replicas []string
+		wantErr  string
+	}{
+		{
+			name:   "valid routes",
+			routes: []string{"project:p-a=http://a:9090", "namespace:ns-.*=http://b:9090", "path:/federate=http://a:9090"},
+		},
+		{
+			name:    "missing url",
+			routes:  []string{"project:p-a"},
+			wantErr: "invalid upstream route",
+		},
+		{
+			name:    "missing value",
+			routes:  []string{"project=http://a:9090"},
+			wantErr: "invalid upstream route selector",
+		},
+		{
+			name:    "unknown kind",
+			routes:  []string{"cluster:c-a=http://a:9090"},
+			wantErr: "unknown kind",
+		},
+		{
+			name:    "invalid namespace regex",
+			routes:  []string{"namespace:ns-(=http://a:9090"},
+			wantErr: "invalid namespace selector",
+		},
+		{
+			name:     "valid replicas",
+			routes:   []string{"project:p-a=http://a:9090"},
+			replicas: []string{"http://default:9090=http://default-1:9090", "http://a:9090=http://a-1:9090"},
+		},
+		{
+			name:     "missing replica url",
+			replicas: []string{"http://default:9090"},
+			wantErr:  "invalid upstream replica",
+		},
+		{
+			name:     "unknown upstream of replica",
+			replicas: []string{"http://x:9090=http://x-1:9090"},
+			wantErr:  "unknown upstream",
+		},
+		{
+			name:     "replica is an upstream",
+			routes:   []string{"project:p-a=http://a:9090"},
+			replicas: []string{"http://default:9090=http://a:9090"},
+			wantErr:  "is already an upstream",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &agentConfig{proxyURLs: []*url.URL{defaultURL}, upstreamRoutes: c.routes, upstreamReplicas: c.replicas}
+			_, err := newUpstreams(cfg, prometheus.NewRegistry())
+			if len(c.wantErr) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorContains(t, err, c.wantErr)
+		})
+	}
+}
+
+func Test_upstreamHealthLabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := newUpstreams(&agentConfig{proxyURLs: []*url.URL{
+		mustParseURL(t, "http://user:pass@a:9090/prometheus"),
+		mustParseURL(t, "http://b:9090/prometheus"),
+	}}, registry)
+	require.NoError(t, err)
+
+	expected := `
+		# HELP prometheus_auth_upstream_up Whether the upstream endpoint is considered healthy.
+		# TYPE prometheus_auth_upstream_up gauge
+		prometheus_auth_upstream_up{upstream="http://b:9090/prometheus"} 0
+		prometheus_auth_upstream_up{upstream="http://user:<secret>@a:9090/prometheus"} 0
+	`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "prometheus_auth_upstream_up"))
+}
+
+func Test_upstreamsLookup(t *testing.T) {
+	defaultURL, _ := url.Parse("http://default:9090")
+	ups, err := newUpstreams(&agentConfig{proxyURLs: []*url.URL{defaultURL}, upstreamRoutes: []string{
+		"path:/federate=http://federate:9090",
+		"project:p-a=http://a:9090",
+		"namespace:ns-b.*=http://b:9090",
+		"project:p-c=http://a:9090",
+		"namespace:ns-d(?:=x)?=http://d:9090",
+	}}, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		projectID string
+		ns        data.Set
+		path      string
+		want      string
+	}{
+		{"project route", "p-a", data.NewSet("ns-a"), "/api/v1/query", "a:9090"},
+		{"namespace route", "p-b", data.NewSet("ns-a", "ns-b1"), "/api/v1/query", "b:9090"},
+		{"shared upstream", "p-c", data.NewSet("ns-c"), "/api/v1/query", "a:9090"},
+		{"namespace regex with '='", "p-d", data.NewSet("ns-d"), "/api/v1/query", "d:9090"},
+		{"path route wins", "p-a", data.NewSet("ns-a"), "/federate", "federate:9090"},
+		{"default", "p-x", data.NewSet("ns-x"), "/api/v1/query", "default:9090"},
+		{"agent token", "", nil, "/api/v1/query", "default:9090"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.want, ups.lookup(c.projectID, c.ns, c.path).name)
+		})
+	}
+
+	require.Same(t, ups.lookup("p-a", nil, "/"), ups.lookup("p-c", nil, "/"))
+}
+
+func Test_accessControlRouting(t *testing.T) {
+	newEchoServer := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/failing" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_, _ = fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	defaultSrv := newEchoServer("default")
+	projectSrv := newEchoServer("project")
+
+	agt := mockAgentWithUpstream(t, defaultSrv.URL)
+	agt.registry = prometheus.NewRegistry()
+	agt.cfg.upstreamRoutes = []string{"project:p-some=" + projectSrv.URL}
+	ups, err := newUpstreams(agt.cfg, agt.registry)
+	require.NoError(t, err)
+	agt.upstreams = ups
+	httpBackend := agt.httpBackend()
+
+	cases := []struct {
+		token string
+		want  string
+	}{
+		{"someNamespacesToken", "project /api/v1/label/foo/values"},
+		{"noneNamespacesToken", "default /api/v1/label/foo/values"},
+		{"myToken", "default /api/v1/label/foo/values"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/api/v1/label/foo/values", nil)
+		req.Header.Set(authorizationHeaderKey, "Bearer "+c.token)
+		res := httptest.NewRecorder()
+		httpBackend.ServeHTTP(res, req)
+
+		require.Equal(t, http.StatusOK, res.Code, c.token)
+		require.Equal(t, c.want, res.Body.String(), c.token)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:9090/failing", nil)
+	req.Header.Set(authorizationHeaderKey, "Bearer myToken")
+	httpBackend.ServeHTTP(httptest.NewRecorder(), req)
+
+	upLines := []string{
+		fmt.Sprintf("prometheus_auth_upstream_up{upstream=%q} 0", defaultSrv.URL),
+		fmt.Sprintf("prometheus_auth_upstream_up{upstream=%q} 1", projectSrv.URL),
+	}
+	sort.Strings(upLines)
+	expected := `
+		# HELP prometheus_auth_upstream_up Whether the upstream endpoint is considered healthy.
+		# TYPE prometheus_auth_upstream_up gauge
+	` + strings.Join(upLines, "\n") + "\n"
+	require.NoError(t, testutil.GatherAndCompare(agt.registry, strings.NewReader(expected), "prometheus_auth_upstream_up"))
+}
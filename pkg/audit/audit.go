@@ -0,0 +1,206 @@
+// Package audit records who queried what through the proxy.
+package audit
+
+import (
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SinkStdout writes the events as JSON lines to the standard output.
+	SinkStdout = "stdout"
+	// SinkFilePrefix prefixes the path of a rotating file to write the events as JSON lines to.
+	SinkFilePrefix = "file:"
+
+	// RedactUser drops the user name and UID.
+	RedactUser = "user"
+	// RedactClientIP drops the client IP and the forwarded addresses.
+	RedactClientIP = "client_ip"
+	// RedactQueries drops the queries.
+	RedactQueries = "queries"
+	// RedactLabelPrefix prefixes a label whose values are masked in the queries.
+	RedactLabelPrefix = "label:"
+
+	redacted = "<redacted>"
+)
+
+// Config configures the audit log.
+type Config struct {
+	// Sinks are either 'stdout', 'file:<path>' or the HTTP(S) URL of a webhook.
+	Sinks []string
+	// FileMaxSize is the size in bytes the files are rotated at, 0 disables the rotation.
+	FileMaxSize int64
+	// FileMaxBackups is the number of rotated files to keep.
+	FileMaxBackups int
+	// SampleRate is the ratio of the successful requests to record,
+	// the failed requests and the ones with shadow denials are always recorded.
+	SampleRate float64
+	// Redact lists what to hide in the events, see the Redact* constants.
+	Redact []string
+}
+
+// Logger samples, redacts and writes the audit events to the sinks.
+type Logger struct {
+	sinks      []namedSink
+	sampleRate float64
+
+	redactUser     bool
+	redactClientIP bool
+	redactQueries  bool
+	labelPatterns  []*regexp.Regexp
+
+	recorded prometheus.Counter
+	dropped  *prometheus.CounterVec
+}
+
+type namedSink struct {
+	name string
+	Sink
+}
+
+// New creates the sinks of the audit log.
+func New(cfg Config, reg prometheus.Registerer) (*Logger, error) {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, errors.Errorf("audit sample rate %v is not between 0 and 1", cfg.SampleRate)
+	}
+
+	l := &Logger{
+		sampleRate: cfg.SampleRate,
+		recorded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_auth_audit_events_total",
+			Help: "The number of recorded audit events.",
+		}),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_audit_dropped_events_total",
+				Help: "The number of audit events which could not be written by sink.",
+			},
+			[]string{"sink"},
+		),
+	}
+
+	for _, field := range cfg.Redact {
+		switch {
+		case field == RedactUser:
+			l.redactUser = true
+		case field == RedactClientIP:
+			l.redactClientIP = true
+		case field == RedactQueries:
+			l.redactQueries = true
+		case strings.HasPrefix(field, RedactLabelPrefix):
+			l.labelPatterns = append(l.labelPatterns, labelValuePatterns(strings.TrimPrefix(field, RedactLabelPrefix))...)
+		default:
+			return nil, errors.Errorf("unknown audit redaction %q", field)
+		}
+	}
+
+	for _, sink := range cfg.Sinks {
+		s, err := l.newSink(sink, cfg)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l.sinks = append(l.sinks, s)
+	}
+
+	reg.MustRegister(l.recorded, l.dropped)
+
+	return l, nil
+}
+
+func (l *Logger) newSink(sink string, cfg Config) (namedSink, error) {
+	switch {
+	case sink == SinkStdout:
+		return namedSink{name: "stdout", Sink: NewWriterSink(os.Stdout)}, nil
+	case strings.HasPrefix(sink, SinkFilePrefix):
+		s, err := NewFileSink(strings.TrimPrefix(sink, SinkFilePrefix), cfg.FileMaxSize, cfg.FileMaxBackups)
+		return namedSink{name: "file", Sink: s}, err
+	}
+
+	u, err := url.Parse(sink)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return namedSink{}, errors.Errorf("audit sink %q is neither 'stdout', 'file:<path>' nor an HTTP(S) URL", sink)
+	}
+
+	return namedSink{name: "webhook", Sink: NewWebhookSink(u.String(), l.dropped.WithLabelValues("webhook"))}, nil
+}
+
+// Log writes the event to the sinks, unless it is sampled out.
+func (l *Logger) Log(e *Event) {
+	if !l.sampled(e) {
+		return
+	}
+
+	l.redact(e)
+	l.recorded.Inc()
+	for _, s := range l.sinks {
+		if err := s.Write(e); err != nil {
+			log.WithError(err).Warnf("Failed to write audit event to %s", s.name)
+			l.dropped.WithLabelValues(s.name).Inc()
+		}
+	}
+}
+
+// Close flushes and closes the sinks.
+func (l *Logger) Close() error {
+	var firstErr error
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (l *Logger) sampled(e *Event) bool {
+	if e.Status >= 400 || len(e.ShadowDenials) != 0 || l.sampleRate >= 1 {
+		return true
+	}
+
+	return rand.Float64() < l.sampleRate //nolint:gosec // sampling needs no secure randomness
+}
+
+func (l *Logger) redact(e *Event) {
+	if l.redactUser {
+		e.User, e.UID = "", ""
+	}
+	if l.redactClientIP {
+		e.ClientIP, e.ForwardedFor = "", ""
+	}
+	if l.redactQueries {
+		e.Queries = nil
+	}
+
+	for idx := range e.Queries {
+		e.Queries[idx].Raw = l.redactLabels(e.Queries[idx].Raw)
+		e.Queries[idx].Hijacked = l.redactLabels(e.Queries[idx].Hijacked)
+	}
+}
+
+func (l *Logger) redactLabels(query string) string {
+	for _, pattern := range l.labelPatterns {
+		query = pattern.ReplaceAllString(query, `${1}"`+redacted+`"`)
+	}
+
+	return query
+}
+
+// labelValuePatterns match the values of a label,
+// in the matchers of PromQL like 'name=~"value"' and of the remote read queries like 'name:"name" value:"value"'.
+func labelValuePatterns(name string) []*regexp.Regexp {
+	const quoted = `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`[^`]*`)"
+	name = regexp.QuoteMeta(name)
+
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(\b` + name + `\s*(?:=~|!~|!=|=)\s*)` + quoted),
+		regexp.MustCompile(`(name:"` + name + `"\s+value:)` + quoted),
+	}
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, path string) []*Event {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []*Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, &e)
+	}
+	require.NoError(t, scanner.Err())
+
+	return events
+}
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(Config{
+		Sinks:      []string{SinkFilePrefix + path},
+		SampleRate: 0,
+		Redact:     []string{RedactClientIP, RedactLabelPrefix + "namespace"},
+	}, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// the successful requests are sampled out
+	l.Log(&Event{Endpoint: "/api/v1/query", Status: http.StatusOK})
+
+	e := &Event{Endpoint: "/api/v1/query", Status: http.StatusBadRequest, User: "alice", ClientIP: "10.0.0.1"}
+	e.AddQuery(`up{namespace="secret"}`, `up{namespace="secret",namespace=~"ns-a|ns-b"}`)
+	e.AddQuery("", `start_timestamp_ms:1 matchers:<type:RE name:"namespace" value:"ns-a|ns-b" > `)
+	l.Log(e)
+	require.NoError(t, l.Close())
+
+	events := readEvents(t, path)
+	require.Len(t, events, 1)
+	require.Equal(t, "alice", events[0].User)
+	require.Empty(t, events[0].ClientIP)
+	require.Equal(t, []Query{
+		{Raw: `up{namespace="<redacted>"}`, Hijacked: `up{namespace="<redacted>",namespace=~"<redacted>"}`},
+		{Hijacked: `start_timestamp_ms:1 matchers:<type:RE name:"namespace" value:"<redacted>" > `},
+	}, events[0].Queries)
+
+	_, err = New(Config{Sinks: []string{"ftp://example.com"}, SampleRate: 1}, prometheus.NewRegistry())
+	require.ErrorContains(t, err, "neither")
+	_, err = New(Config{Redact: []string{"password"}, SampleRate: 1}, prometheus.NewRegistry())
+	require.ErrorContains(t, err, "unknown audit redaction")
+	_, err = New(Config{SampleRate: 2}, prometheus.NewRegistry())
+	require.ErrorContains(t, err, "not between 0 and 1")
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path, 200, 2)
+	require.NoError(t, err)
+
+	for _, user := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, s.Write(&Event{User: strings.Repeat(user, 100)}))
+	}
+	require.NoError(t, s.Close())
+
+	// one event per file, the oldest one is dropped
+	for suffix, user := range map[string]string{"": "d", ".1": "c", ".2": "b"} {
+		events := readEvents(t, path+suffix)
+		require.Len(t, events, 1)
+		require.Equal(t, strings.Repeat(user, 100), events[0].User)
+	}
+	require.NoFileExists(t, path+".3")
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []*Event
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []*Event
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+
+	l, err := New(Config{Sinks: []string{webhook.URL}, SampleRate: 1}, prometheus.NewRegistry())
+	require.NoError(t, err)
+	for range 150 {
+		l.Log(&Event{Endpoint: "/api/v1/series", Status: http.StatusOK})
+	}
+	// the buffered events are flushed when closing
+	require.NoError(t, l.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 150)
+	require.Equal(t, "/api/v1/series", received[0].Endpoint)
+}
+
+func TestWebhookSinkWriteAfterClose(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(webhook.Close)
+
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+	s := NewWebhookSink(webhook.URL, dropped)
+	require.NoError(t, s.Write(&Event{Endpoint: "/api/v1/query"}))
+	require.NoError(t, s.Close())
+
+	// the events written after closing are dropped instead of panicking
+	require.ErrorIs(t, s.Write(&Event{Endpoint: "/api/v1/query"}), errSinkClosed)
+	require.NoError(t, s.Close())
+
+	l, err := New(Config{Sinks: []string{webhook.URL}, SampleRate: 1}, prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	require.NotPanics(t, func() {
+		l.Log(&Event{Endpoint: "/api/v1/query", Status: http.StatusOK})
+	})
+}
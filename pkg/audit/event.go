@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"time"
+)
+
+// Event records a single request of a tenant.
+type Event struct {
+	Time time.Time `json:"time"`
+	ID   string    `json:"id,omitempty"`
+	// User and UID identify the authenticated user, they are empty if the authentication failed.
+	User       string   `json:"user,omitempty"`
+	UID        string   `json:"uid,omitempty"`
+	ProjectID  string   `json:"project_id,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Method     string   `json:"method"`
+	Endpoint   string   `json:"endpoint"`
+	// Queries are the queries as sent by the client and as forwarded to the upstreams.
+	Queries      []Query `json:"queries,omitempty"`
+	ClientIP     string  `json:"client_ip,omitempty"`
+	ForwardedFor string  `json:"forwarded_for,omitempty"`
+	Status       int     `json:"status"`
+	Error        string  `json:"error,omitempty"`
+	Latency      float64 `json:"latency_seconds"`
+	Bytes        int64   `json:"bytes"`
+	// ShadowDenials are the denials of the shadowed rules, which let the request proceed.
+	ShadowDenials []ShadowDenial `json:"shadow_denials,omitempty"`
+}
+
+// Query is a query of a request, before and after injecting the namespaces.
+type Query struct {
+	Raw      string `json:"raw"`
+	Hijacked string `json:"hijacked,omitempty"`
+}
+
+// ShadowDenial is the denial of a request by a shadowed rule.
+type ShadowDenial struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// SetUser records the authenticated user.
+func (e *Event) SetUser(name, uid string) {
+	if e == nil {
+		return
+	}
+
+	e.User, e.UID = name, uid
+}
+
+// SetTenant records the project and the namespaces the user has access to.
+func (e *Event) SetTenant(projectID string, namespaces []string) {
+	if e == nil {
+		return
+	}
+
+	e.ProjectID, e.Namespaces = projectID, namespaces
+}
+
+// AddQuery records a query of the request.
+func (e *Event) AddQuery(raw, hijacked string) {
+	if e == nil {
+		return
+	}
+
+	e.Queries = append(e.Queries, Query{Raw: raw, Hijacked: hijacked})
+}
+
+// SetError records the error the request failed with.
+func (e *Event) SetError(msg string) {
+	if e == nil {
+		return
+	}
+
+	e.Error = msg
+}
+
+// AddShadowDenial records that the shadowed rule would have denied the request.
+func (e *Event) AddShadowDenial(rule, reason string) {
+	if e == nil {
+		return
+	}
+
+	e.ShadowDenials = append(e.ShadowDenials, ShadowDenial{Rule: rule, Reason: reason})
+}
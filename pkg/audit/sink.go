@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Sink writes the audit events somewhere.
+type Sink interface {
+	Write(e *Event) error
+	Close() error
+}
+
+// writerSink writes the events as JSON lines.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink writes the events as JSON lines into w, like the standard output.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(e *Event) error {
+	line, err := marshalLine(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(line)
+	return errors.Trace(err)
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// fileSink writes the events as JSON lines into a file,
+// which is rotated to '<path>.1' ... '<path>.<maxBackups>' when it exceeds maxSize.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink writes the events as JSON lines into the file at path, rotating it by size.
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	s := &fileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Annotatef(err, "unable to open audit log %s", s.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Annotatef(err, "unable to stat audit log %s", s.path)
+	}
+
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileSink) Write(e *Event) error {
+	line, err := marshalLine(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size != 0 && s.size+int64(len(line)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return errors.Trace(err)
+}
+
+// rotate shifts the backups, dropping the oldest one, and reopens the file.
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return errors.Annotatef(err, "unable to close audit log %s", s.path)
+	}
+
+	if s.maxBackups > 0 {
+		for idx := s.maxBackups - 1; idx > 0; idx-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, idx), fmt.Sprintf("%s.%d", s.path, idx+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return errors.Annotatef(err, "unable to rotate audit log %s", s.path)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return errors.Annotatef(err, "unable to rotate audit log %s", s.path)
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Trace(s.file.Close())
+}
+
+func marshalLine(e *Event) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Annotate(err, "unable to marshal audit event")
+	}
+
+	return append(line, '\n'), nil
+}
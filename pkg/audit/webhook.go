@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookBufferSize    = 4096
+	webhookBatchSize     = 100
+	webhookFlushInterval = time.Second
+	webhookTimeout       = 10 * time.Second
+)
+
+var (
+	errBufferFull = errors.New("audit webhook buffer is full")
+	errSinkClosed = errors.New("audit webhook is closed")
+)
+
+// webhookSink posts the events in batches as JSON arrays,
+// the events are buffered so that a slow webhook does not delay the requests,
+// they are dropped if the buffer is full or the webhook fails.
+type webhookSink struct {
+	endpoint string
+	client   *http.Client
+	dropped  prometheus.Counter
+
+	// mu guards sending on events against closing it
+	mu     sync.Mutex
+	closed bool
+	events chan *Event
+	done   chan struct{}
+}
+
+// NewWebhookSink posts the events to the endpoint, counting the dropped events.
+func NewWebhookSink(endpoint string, dropped prometheus.Counter) Sink {
+	s := &webhookSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: webhookTimeout},
+		dropped:  dropped,
+		events:   make(chan *Event, webhookBufferSize),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+
+	return s
+}
+
+func (s *webhookSink) Write(e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSinkClosed
+	}
+
+	select {
+	case s.events <- e:
+		return nil
+	default:
+		return errBufferFull
+	}
+}
+
+// Close flushes the buffered events, the events written afterwards are dropped.
+func (s *webhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	<-s.done
+
+	return nil
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(webhookFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, webhookBatchSize)
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.post(batch)
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		s.post(batch)
+		batch = batch[:0]
+	}
+}
+
+func (s *webhookSink) post(batch []*Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := s.send(batch); err != nil {
+		log.WithError(err).Warnf("Dropped %d audit events", len(batch))
+		s.dropped.Add(float64(len(batch)))
+	}
+}
+
+func (s *webhookSink) send(batch []*Event) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Annotate(err, "unable to marshal audit events")
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Annotate(err, "unable to create audit webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Annotatef(err, "unable to post to audit webhook %s", s.endpoint)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("audit webhook %s responded %s", s.endpoint, resp.Status)
+	}
+
+	return nil
+}
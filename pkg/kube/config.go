@@ -0,0 +1,34 @@
+package kube
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Config tunes the caches of the reviews and the informers of the secrets and namespaces.
+type Config struct {
+	// ReviewCacheTTL is how long the results of the token and access reviews are cached.
+	ReviewCacheTTL time.Duration
+	// ReviewCacheSize is the maximum number of cached results, per kind of review.
+	ReviewCacheSize int
+	// SecretResyncPeriod is the interval of resyncing the secrets, 0 disables the resync.
+	SecretResyncPeriod time.Duration
+	// NamespaceResyncPeriod is the interval of resyncing the namespaces, 0 disables the resync.
+	NamespaceResyncPeriod time.Duration
+}
+
+// Validate checks that the caches are enabled and the resync periods are not negative.
+func (c Config) Validate() error {
+	if c.ReviewCacheTTL <= 0 {
+		return errors.Errorf("review cache TTL %v must be positive", c.ReviewCacheTTL)
+	}
+	if c.ReviewCacheSize <= 0 {
+		return errors.Errorf("review cache size %d must be positive", c.ReviewCacheSize)
+	}
+	if c.SecretResyncPeriod < 0 || c.NamespaceResyncPeriod < 0 {
+		return errors.New("resync periods must not be negative")
+	}
+
+	return nil
+}
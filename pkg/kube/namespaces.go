@@ -26,26 +26,32 @@ import (
 )
 
 const (
-	byTokenIndex               = "byToken"
-	byProjectIDIndex           = "byProjectID"
-	defaultk3s                 = "https://kubernetes.default.svc.cluster.local"
-	defaultRKE                 = "rke"
-	defaultLegacy              = "kubernetes/serviceaccount"
-	cacheTTL                   = 5 * time.Minute
-	secretResyncPeriod         = 2 * time.Hour
-	nsResyncPeriod             = 10 * time.Minute
-	reviewResultCacheSizeBytes = 1024
+	byTokenIndex     = "byToken"
+	byProjectIDIndex = "byProjectID"
+	defaultk3s       = "https://kubernetes.default.svc.cluster.local"
+	defaultRKE       = "rke"
+	defaultLegacy    = "kubernetes/serviceaccount"
+	reviewCacheHit   = "hit"
+	reviewCacheMiss  = "miss"
 )
 
 type Namespaces interface {
 	Query(token string) data.Set
+	ProjectID(token string) string
+	// Resolve returns both the project ID and the namespaces of the token, validating it only once.
+	Resolve(token string) (string, data.Set)
+	// HasSynced returns whether the caches of the secrets and namespaces are synced,
+	// until then the queries return no namespaces.
+	HasSynced() bool
 }
 
 type namespaces struct {
 	subjectAccessReviewsClient clientAuthorization.SubjectAccessReviewInterface
 	reviewResultTTLCache       *cache.LRUExpireCache
+	reviewResultTTL            time.Duration
 	secretIndexer              clientCache.Indexer
 	namespaceIndexer           clientCache.Indexer
+	synced                     []clientCache.InformerSynced
 	metrics                    *metrics
 	oidc                       oidc
 }
@@ -57,6 +63,7 @@ type oidc struct {
 type metrics struct {
 	successfulValidations *prometheus.CounterVec
 	failedValdations      *prometheus.CounterVec
+	reviewCacheRequests   *prometheus.CounterVec
 	mu                    sync.Mutex
 }
 
@@ -77,6 +84,13 @@ func NewMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"namespace"},
 		),
+		reviewCacheRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_auth_access_review_cache_requests_total",
+				Help: "Total number of lookups of the cached subject access reviews by result.",
+			},
+			[]string{"result"},
+		),
 		mu: sync.Mutex{},
 	}
 
@@ -98,12 +112,68 @@ func (m *metrics) IncFailedRequests(namespace string) {
 	m.failedValdations.WithLabelValues(namespace).Inc()
 }
 
+// IncReviewCacheRequests increments the lookups of the cached subject access reviews by whether they hit.
+func (m *metrics) IncReviewCacheRequests(hit bool) {
+	m.reviewCacheRequests.WithLabelValues(cacheResult(hit)).Inc()
+}
+
 // GetCollectors returns all metric collectors.
 func (m *metrics) GetCollectors() []prometheus.Collector {
 	return []prometheus.Collector{
 		m.successfulValidations,
 		m.failedValdations,
+		m.reviewCacheRequests,
+	}
+}
+
+func cacheResult(hit bool) string {
+	if hit {
+		return reviewCacheHit
+	}
+
+	return reviewCacheMiss
+}
+
+// newInformerCollectors reports whether the informer has synced and how many objects it holds.
+func newInformerCollectors(name string, informer clientCache.SharedIndexInformer) []prometheus.Collector {
+	labels := prometheus.Labels{"informer": name}
+
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "prometheus_auth_informer_synced",
+				Help:        "Whether the informer has synced its cache with the Kubernetes API.",
+				ConstLabels: labels,
+			},
+			func() float64 {
+				if informer.HasSynced() {
+					return 1
+				}
+				return 0
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "prometheus_auth_informer_objects",
+				Help:        "The number of objects in the cache of the informer.",
+				ConstLabels: labels,
+			},
+			func() float64 {
+				return float64(len(informer.GetIndexer().ListKeys()))
+			},
+		),
+	}
+}
+
+// HasSynced returns whether all informers have synced.
+func (n *namespaces) HasSynced() bool {
+	for _, synced := range n.synced {
+		if !synced() {
+			return false
+		}
 	}
+
+	return true
 }
 
 // Query returns the namespaces associated with the given token.
@@ -115,46 +185,85 @@ func (n *namespaces) Query(token string) data.Set {
 	return ret
 }
 
+// ProjectID returns the project ID of the namespace the given token belongs to.
+func (n *namespaces) ProjectID(token string) string {
+	ret, err := n.projectID(token)
+	if err != nil {
+		log.Warnf("failed to query project: %v", err)
+	}
+	return ret
+}
+
+// Resolve returns the project ID of the namespace the given token belongs to, and the namespaces of that project.
+func (n *namespaces) Resolve(token string) (string, data.Set) {
+	projectID, err := n.projectID(token)
+	if err != nil {
+		log.Warnf("failed to query project: %v", err)
+		return "", data.Set{}
+	}
+
+	ret, err := n.projectNamespaces(projectID)
+	if err != nil {
+		log.Warnf("failed to query Namespaces: %v", err)
+	}
+	return projectID, ret
+}
+
 // query retrieves the namespaces associated with the given token,
 // which match the project ID of the namespace the token belongs to.
 func (n *namespaces) query(token string) (data.Set, error) {
+	projectID, err := n.projectID(token)
+	if err != nil {
+		return data.Set{}, err
+	}
+
+	return n.projectNamespaces(projectID)
+}
+
+// projectNamespaces retrieves the namespaces of the project.
+func (n *namespaces) projectNamespaces(projectID string) (data.Set, error) {
 	ret := data.Set{}
 
+	nsList, err := n.namespaceIndexer.ByIndex(byProjectIDIndex, projectID)
+	if err != nil {
+		return ret, errors.Annotatef(err, "invalid project")
+	}
+
+	for _, nsObj := range nsList {
+		ns := toNamespace(nsObj)
+		ret[ns.Name] = struct{}{}
+	}
+	return ret, nil
+}
+
+// projectID retrieves the project ID of the namespace the given token belongs to.
+func (n *namespaces) projectID(token string) (string, error) {
 	tokenNamespace, err := n.validate(token)
 	if err != nil {
-		return ret, errors.Annotatef(err, "failed validation")
+		return "", errors.Annotatef(err, "failed validation")
 	}
 
 	log.Debugf("searching for namespace %q in cache", tokenNamespace)
 	nsObj, exist, err := n.namespaceIndexer.GetByKey(tokenNamespace)
 	if err != nil {
-		return ret, errors.Annotatef(err, "failed to get namespace")
+		return "", errors.Annotatef(err, "failed to get namespace")
 	}
 
 	if !exist {
-		return ret, errors.New("unknown namespace of token " + tokenNamespace)
+		return "", errors.New("unknown namespace of token " + tokenNamespace)
 	}
 
 	ns := toNamespace(nsObj)
 	if ns.DeletionTimestamp != nil {
-		return ret, errors.New("deleting namespace of token")
+		return "", errors.New("deleting namespace of token")
 	}
 
 	projectID, exist := getProjectID(ns)
 	if !exist {
-		return ret, errors.New("unknown project of token")
-	}
-
-	nsList, err := n.namespaceIndexer.ByIndex(byProjectIDIndex, projectID)
-	if err != nil {
-		return ret, errors.Annotatef(err, "invalid project")
+		return "", errors.New("unknown project of token")
 	}
 
-	for _, nsObj := range nsList {
-		ns = toNamespace(nsObj)
-		ret[ns.Name] = struct{}{}
-	}
-	return ret, nil
+	return projectID, nil
 }
 
 // validate checks the token and returns the namespace it is associated with,
@@ -183,6 +292,7 @@ func (n *namespaces) validate(token string) (string, error) {
 	}
 
 	_, exist := n.reviewResultTTLCache.Get(token)
+	n.metrics.IncReviewCacheRequests(exist)
 	if exist {
 		log.Debugf("token for ns %q is cached", claimNamespace)
 		n.metrics.IncSuccessfulRequests(claimNamespace)
@@ -216,7 +326,7 @@ func (n *namespaces) validate(token string) (string, error) {
 	}
 
 	if reviewResult.Status.Allowed {
-		n.reviewResultTTLCache.Add(token, struct{}{}, cacheTTL)
+		n.reviewResultTTLCache.Add(token, struct{}{}, n.reviewResultTTL)
 		log.Debugf("token is allowed to access namespace %q, accepted", claimNamespace)
 		n.metrics.IncSuccessfulRequests(claimNamespace)
 		return claimNamespace, nil
@@ -227,7 +337,7 @@ func (n *namespaces) validate(token string) (string, error) {
 	return claimNamespace, nil
 }
 
-func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, oidcIssuer string, reg *prometheus.Registry) Namespaces {
+func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, oidcIssuer string, cfg Config, reg *prometheus.Registry) Namespaces {
 	// secrets
 	sec := k8sClient.CoreV1().Secrets(meta.NamespaceAll)
 	secListWatch := &clientCache.ListWatch{
@@ -238,7 +348,7 @@ func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, oidcIssu
 			return sec.Watch(ctx, options)
 		},
 	}
-	secInformer := clientCache.NewSharedIndexInformer(secListWatch, &core.Secret{}, secretResyncPeriod, clientCache.Indexers{byTokenIndex: secretByToken})
+	secInformer := clientCache.NewSharedIndexInformer(secListWatch, &core.Secret{}, cfg.SecretResyncPeriod, clientCache.Indexers{byTokenIndex: secretByToken})
 
 	// namespaces
 	ns := k8sClient.CoreV1().Namespaces()
@@ -250,7 +360,10 @@ func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, oidcIssu
 			return ns.Watch(ctx, options)
 		},
 	}
-	nsInformer := clientCache.NewSharedIndexInformer(nsListWatch, &core.Namespace{}, nsResyncPeriod, clientCache.Indexers{byProjectIDIndex: namespaceByProjectID})
+	nsInformer := clientCache.NewSharedIndexInformer(nsListWatch, &core.Namespace{}, cfg.NamespaceResyncPeriod, clientCache.Indexers{byProjectIDIndex: namespaceByProjectID})
+
+	reg.MustRegister(newInformerCollectors("secrets", secInformer)...)
+	reg.MustRegister(newInformerCollectors("namespaces", nsInformer)...)
 
 	// run
 	go secInformer.Run(ctx.Done())
@@ -258,9 +371,11 @@ func NewNamespaces(ctx context.Context, k8sClient kubernetes.Interface, oidcIssu
 
 	return &namespaces{
 		subjectAccessReviewsClient: k8sClient.AuthorizationV1().SubjectAccessReviews(),
-		reviewResultTTLCache:       cache.NewLRUExpireCache(reviewResultCacheSizeBytes),
+		reviewResultTTLCache:       cache.NewLRUExpireCache(cfg.ReviewCacheSize),
+		reviewResultTTL:            cfg.ReviewCacheTTL,
 		secretIndexer:              secInformer.GetIndexer(),
 		namespaceIndexer:           nsInformer.GetIndexer(),
+		synced:                     []clientCache.InformerSynced{secInformer.HasSynced, nsInformer.HasSynced},
 		oidc: oidc{
 			active: len(oidcIssuer) > 0,
 			issuer: oidcIssuer,
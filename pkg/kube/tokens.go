@@ -3,7 +3,9 @@ package kube
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	authentication "k8s.io/api/authentication/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/cache"
@@ -18,12 +20,15 @@ type Tokens interface {
 type tokens struct {
 	tokenReviewClient    clientAuthentication.TokenReviewInterface
 	reviewResultTTLCache *cache.LRUExpireCache
+	reviewResultTTL      time.Duration
+	cacheRequests        *prometheus.CounterVec
 }
 
 func (t *tokens) Authenticate(token string) (authentication.UserInfo, error) {
 	var userInfo authentication.UserInfo
 
 	userInfoInterface, exist := t.reviewResultTTLCache.Get(token)
+	t.cacheRequests.WithLabelValues(cacheResult(exist)).Inc()
 	if exist {
 		userInfo, _ = userInfoInterface.(authentication.UserInfo)
 		return userInfo, nil
@@ -37,7 +42,7 @@ func (t *tokens) Authenticate(token string) (authentication.UserInfo, error) {
 	if !tokenReview.Status.Authenticated {
 		return userInfo, fmt.Errorf("user is not authenticated: %s", tokenReview.Status.Error)
 	}
-	t.reviewResultTTLCache.Add(token, userInfo, cacheTTL)
+	t.reviewResultTTLCache.Add(token, userInfo, t.reviewResultTTL)
 	return userInfo, nil
 }
 
@@ -49,10 +54,21 @@ func toTokenReview(token string) *authentication.TokenReview {
 	}
 }
 
-func NewTokens(_ context.Context, k8sClient kubernetes.Interface) Tokens {
+func NewTokens(_ context.Context, k8sClient kubernetes.Interface, cfg Config, reg prometheus.Registerer) Tokens {
+	cacheRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_auth_token_review_cache_requests_total",
+			Help: "Total number of lookups of the cached token reviews by result.",
+		},
+		[]string{"result"},
+	)
+	reg.MustRegister(cacheRequests)
+
 	return &tokens{
 		tokenReviewClient:    k8sClient.AuthenticationV1().TokenReviews(),
-		reviewResultTTLCache: cache.NewLRUExpireCache(reviewResultCacheSizeBytes),
+		reviewResultTTLCache: cache.NewLRUExpireCache(cfg.ReviewCacheSize),
+		reviewResultTTL:      cfg.ReviewCacheTTL,
+		cacheRequests:        cacheRequests,
 	}
 }
 
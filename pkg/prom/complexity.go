@@ -0,0 +1,138 @@
+package prom
+
+import (
+	"strings"
+
+	promlb "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ComplexityWeights weigh the features of a query expression in its cost.
+type ComplexityWeights struct {
+	// Selector is the cost of each series selector.
+	Selector float64
+	// NamelessSelector is the extra cost of a selector without metric name, which touches all metrics.
+	NamelessSelector float64
+	// RegexMatcher is the cost of a regex matcher, multiplied by its complexity.
+	RegexMatcher float64
+	// RangeHour is the cost of each hour of the range vector and subquery windows.
+	RangeHour float64
+	// SubqueryDepth is the cost of each level of nested subqueries.
+	SubqueryDepth float64
+	// HighCardinalityGrouping is the cost of grouping by a high-cardinality label.
+	HighCardinalityGrouping float64
+}
+
+// DefaultComplexityWeights are the weights of a plain selector like 'up{job="x"}' costing 1.
+func DefaultComplexityWeights() ComplexityWeights {
+	return ComplexityWeights{
+		Selector:                1,
+		NamelessSelector:        50,
+		RegexMatcher:            0.5,
+		RangeHour:               0.5,
+		SubqueryDepth:           5,
+		HighCardinalityGrouping: 5,
+	}
+}
+
+// DefaultHighCardinalityLabels are the labels which usually have a value per workload instance.
+func DefaultHighCardinalityLabels() []string {
+	return []string{"pod", "container", "instance", "id", "uid", "container_id", "pod_uid"}
+}
+
+// Complexity is the result of the static analysis of a query expression.
+type Complexity struct {
+	Selectors                int
+	NamelessSelectors        int
+	RegexMatchers            int
+	RangeHours               float64
+	MaxSubqueryDepth         int
+	HighCardinalityGroupings int
+	Score                    float64
+}
+
+// AnalyzeComplexity walks the expression and scores it by the given weights,
+// without knowing how many series it touches.
+func AnalyzeComplexity(expr parser.Expr, weights ComplexityWeights, highCardinalityLabels []string) Complexity {
+	var c Complexity
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			c.Selectors++
+			c.Score += weights.Selector
+			if !hasMetricName(n.LabelMatchers) {
+				c.NamelessSelectors++
+				c.Score += weights.NamelessSelector
+			}
+			for _, m := range n.LabelMatchers {
+				if m.Type == promlb.MatchRegexp || m.Type == promlb.MatchNotRegexp {
+					c.RegexMatchers++
+					c.Score += weights.RegexMatcher * regexComplexity(m.Value)
+				}
+			}
+		case *parser.MatrixSelector:
+			hours := n.Range.Hours()
+			c.RangeHours += hours
+			c.Score += weights.RangeHour * hours
+		case *parser.SubqueryExpr:
+			hours := n.Range.Hours()
+			c.RangeHours += hours
+			c.Score += weights.RangeHour * hours
+
+			depth := 1
+			for _, parent := range path {
+				if _, ok := parent.(*parser.SubqueryExpr); ok {
+					depth++
+				}
+			}
+			if depth > c.MaxSubqueryDepth {
+				c.MaxSubqueryDepth = depth
+			}
+			c.Score += weights.SubqueryDepth * float64(depth)
+		case *parser.AggregateExpr:
+			if n.Without {
+				break
+			}
+			for _, label := range n.Grouping {
+				for _, highCardinality := range highCardinalityLabels {
+					if label == highCardinality {
+						c.HighCardinalityGroupings++
+						c.Score += weights.HighCardinalityGrouping
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	return c
+}
+
+// hasMetricName tells whether the selector matches a restricted set of metric names.
+func hasMetricName(matchers []*promlb.Matcher) bool {
+	for _, m := range matchers {
+		if m.Name != promlb.MetricName {
+			continue
+		}
+		if m.Type == promlb.MatchEqual && len(m.Value) != 0 {
+			return true
+		}
+		if m.Type == promlb.MatchRegexp && !m.Matches("") && !isWildcardRegex(m.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// regexComplexity grows with the alternatives and the wildcards of a regex.
+func regexComplexity(value string) float64 {
+	complexity := 1 + float64(strings.Count(value, "|"))
+	complexity += 2 * float64(strings.Count(value, ".*")+strings.Count(value, ".+"))
+
+	return complexity
+}
+
+func isWildcardRegex(value string) bool {
+	return value == ".*" || value == ".+"
+}
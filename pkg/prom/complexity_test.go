@@ -0,0 +1,38 @@
+package prom
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeComplexity(t *testing.T) {
+	analyze := func(query string) Complexity {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+		return AnalyzeComplexity(expr, DefaultComplexityWeights(), DefaultHighCardinalityLabels())
+	}
+
+	require.Equal(t, Complexity{Selectors: 1, Score: 1}, analyze(`up{job="x"}`))
+
+	require.Equal(t, Complexity{
+		Selectors: 1, NamelessSelectors: 1, RegexMatchers: 1, Score: 1 + 50 + 0.5*3,
+	}, analyze(`{__name__=~".+"}`))
+
+	require.Equal(t, Complexity{
+		Selectors: 1, RegexMatchers: 1, Score: 1 + 0.5*3,
+	}, analyze(`{__name__=~"up|down|left"}`))
+
+	require.Equal(t, Complexity{
+		Selectors: 1, RangeHours: 720, HighCardinalityGroupings: 1, Score: 1 + 0.5*720 + 5,
+	}, analyze(`count by (pod) (rate(x[30d]))`))
+
+	// grouping without the high-cardinality labels keeps them, but is not scored
+	require.InDelta(t, 1, analyze(`sum without (pod) (x)`).Score, 0)
+
+	nested := analyze(`max_over_time(max_over_time(x[1h:1m])[2h:1m])`)
+	require.Equal(t, 2, nested.MaxSubqueryDepth)
+	require.InDelta(t, 3, nested.RangeHours, 0)
+	require.InDelta(t, 1+0.5*3+5*1+5*2, nested.Score, 0)
+}
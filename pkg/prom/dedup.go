@@ -0,0 +1,152 @@
+package prom
+
+import (
+	"math"
+
+	promgo "github.com/prometheus/client_model/go"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DedupVectors merges the instant vectors returned by HA replicas,
+// after dropping the replica label of their series.
+func DedupVectors(replicaLabel string, vectors ...prommodel.Vector) prommodel.Vector {
+	for _, vector := range vectors {
+		for _, sample := range vector {
+			delete(sample.Metric, prommodel.LabelName(replicaLabel))
+		}
+	}
+
+	return MergeVectors(vectors...)
+}
+
+// DedupMatrices merges the range vectors returned by HA replicas,
+// after dropping the replica label of their series.
+// The gaps in the series of one replica are filled with the samples of another replica.
+func DedupMatrices(replicaLabel string, matrices ...prommodel.Matrix) prommodel.Matrix {
+	for _, matrix := range matrices {
+		for _, stream := range matrix {
+			delete(stream.Metric, prommodel.LabelName(replicaLabel))
+		}
+	}
+
+	return mergeMatrices(matrices, func(a, b []prommodel.SamplePair) []prommodel.SamplePair {
+		return penaltyMerge(a, b, samplePairTimestamp)
+	})
+}
+
+// DedupLabelSets merges the series returned by HA replicas,
+// after dropping the replica label of them.
+func DedupLabelSets(replicaLabel string, labelSets ...[]prommodel.LabelSet) []prommodel.LabelSet {
+	for _, sets := range labelSets {
+		for _, set := range sets {
+			delete(set, prommodel.LabelName(replicaLabel))
+		}
+	}
+
+	return MergeLabelSets(labelSets...)
+}
+
+// DedupMetricFamilies merges the federated metric families returned by HA replicas,
+// after dropping the replica label of their metrics.
+func DedupMetricFamilies(replicaLabel string, families ...map[string]*promgo.MetricFamily) []*promgo.MetricFamily {
+	for _, familiesByName := range families {
+		for _, family := range familiesByName {
+			for _, metric := range family.GetMetric() {
+				lbs := make([]*promgo.LabelPair, 0, len(metric.GetLabel()))
+				for _, lb := range metric.GetLabel() {
+					if lb.GetName() != replicaLabel {
+						lbs = append(lbs, lb)
+					}
+				}
+				metric.Label = lbs
+			}
+		}
+	}
+
+	return MergeMetricFamilies(families...)
+}
+
+// DedupQueryResults merges the remote read results of the same query returned by HA replicas,
+// after dropping the replica label of their series.
+// The gaps in the series of one replica are filled with the samples of another replica.
+func DedupQueryResults(replicaLabel string, results ...*prompb.QueryResult) *prompb.QueryResult {
+	for _, result := range results {
+		for _, series := range result.GetTimeseries() {
+			lbs := make([]prompb.Label, 0, len(series.GetLabels()))
+			for _, lb := range series.GetLabels() {
+				if lb.GetName() != replicaLabel {
+					lbs = append(lbs, lb)
+				}
+			}
+			series.Labels = lbs
+		}
+	}
+
+	return mergeQueryResults(results, func(a, b []prompb.Sample) []prompb.Sample {
+		return penaltyMerge(a, b, sampleTimestamp)
+	})
+}
+
+// penaltyMerge joins the samples of the same series scraped by two replicas.
+//
+// The samples of one replica are used as long as they are continuous, in the style of Thanos' deduplication,
+// only if the gap to the next sample is bigger than twice the last seen scrape interval,
+// the samples of the other replica are used to fill it.
+func penaltyMerge[T any](a, b []T, timestamp func(T) int64) []T {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+
+	// start with the replica which has the earliest sample
+	cur, other := a, b
+	if timestamp(b[0]) < timestamp(a[0]) {
+		cur, other = b, a
+	}
+
+	ret := make([]T, 0, max(len(a), len(b)))
+	lastT, interval := int64(math.MinInt64), int64(0)
+	i, j := 0, 0
+	for i < len(cur) {
+		t := timestamp(cur[i])
+
+		// skip the samples of the other replica which are already covered
+		for j < len(other) && timestamp(other[j]) <= lastT {
+			j++
+		}
+
+		// switch to the other replica to fill the gap,
+		// skipping its samples which are too close to the last one to not duplicate it
+		if interval > 0 && t-lastT > 2*interval {
+			k := j
+			for k < len(other) && timestamp(other[k]) < lastT+interval/2 {
+				k++
+			}
+
+			if k < len(other) && timestamp(other[k]) < t {
+				cur, other = other, cur
+				i, j = k, i
+				continue
+			}
+		}
+
+		if lastT != math.MinInt64 {
+			interval = t - lastT
+		}
+		ret = append(ret, cur[i])
+		lastT = t
+		i++
+	}
+
+	// fill the tail with the other replica
+	for ; j < len(other); j++ {
+		if timestamp(other[j]) > lastT {
+			ret = append(ret, other[j])
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,72 @@
+package prom
+
+import (
+	"testing"
+
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupMatrices(t *testing.T) {
+	pairs := func(timestamps ...prommodel.Time) []prommodel.SamplePair {
+		ret := make([]prommodel.SamplePair, 0, len(timestamps))
+		for _, ts := range timestamps {
+			ret = append(ret, prommodel.SamplePair{Timestamp: ts, Value: 1})
+		}
+		return ret
+	}
+
+	a := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-a", "replica": "0"}, Values: pairs(10, 20, 60, 70)},
+	}
+	b := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-a", "replica": "1"}, Values: pairs(11, 21, 31, 41, 51, 61, 71, 81)},
+		{Metric: prommodel.Metric{"namespace": "ns-b", "replica": "1"}, Values: pairs(11)},
+	}
+
+	expected := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Values: pairs(10, 20, 31, 41, 51, 61, 71, 81)},
+		{Metric: prommodel.Metric{"namespace": "ns-b"}, Values: pairs(11)},
+	}
+
+	require.Equal(t, expected, DedupMatrices("replica", a, b))
+}
+
+func TestDedupLabelSets(t *testing.T) {
+	a := []prommodel.LabelSet{{"namespace": "ns-a", "replica": "0"}}
+	b := []prommodel.LabelSet{{"namespace": "ns-a", "replica": "1"}, {"namespace": "ns-b", "replica": "1"}}
+
+	require.Equal(t, []prommodel.LabelSet{{"namespace": "ns-a"}, {"namespace": "ns-b"}}, DedupLabelSets("replica", a, b))
+}
+
+func TestDedupQueryResults(t *testing.T) {
+	merged := DedupQueryResults("replica",
+		&prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "namespace", Value: "ns-a"}, {Name: "replica", Value: "0"}},
+			Samples: []prompb.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 50, Value: 5}},
+		}}},
+		&prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "namespace", Value: "ns-a"}, {Name: "replica", Value: "1"}},
+			Samples: []prompb.Sample{{Timestamp: 12, Value: 1}, {Timestamp: 22, Value: 2}, {Timestamp: 32, Value: 3}, {Timestamp: 42, Value: 4}},
+		}}},
+	)
+
+	expected := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "namespace", Value: "ns-a"}},
+		Samples: []prompb.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 32, Value: 3}, {Timestamp: 42, Value: 4}, {Timestamp: 50, Value: 5}},
+	}}}
+
+	require.Equal(t, expected, merged)
+}
+
+func TestPenaltyMerge(t *testing.T) {
+	identity := func(ts int64) int64 { return ts }
+
+	require.Equal(t, []int64{1, 2}, penaltyMerge(nil, []int64{1, 2}, identity))
+	require.Equal(t, []int64{1, 2}, penaltyMerge([]int64{1, 2}, nil, identity))
+	// continuous replicas are not interleaved
+	require.Equal(t, []int64{10, 20, 30, 40}, penaltyMerge([]int64{10, 20, 30, 40}, []int64{15, 25, 35}, identity))
+	// the tail is filled with the other replica
+	require.Equal(t, []int64{10, 20, 25, 35}, penaltyMerge([]int64{10, 20}, []int64{15, 25, 35}, identity))
+}
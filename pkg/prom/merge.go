@@ -0,0 +1,293 @@
+package prom
+
+import (
+	"sort"
+
+	promgo "github.com/prometheus/client_model/go"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// MergeVectors merges the instant vectors returned by several upstreams,
+// samples of the same series are only kept once.
+func MergeVectors(vectors ...prommodel.Vector) prommodel.Vector {
+	seen := make(map[prommodel.Fingerprint]struct{})
+	ret := make(prommodel.Vector, 0)
+	for _, vector := range vectors {
+		for _, sample := range vector {
+			fp := sample.Metric.Fingerprint()
+			if _, exist := seen[fp]; exist {
+				continue
+			}
+
+			seen[fp] = struct{}{}
+			ret = append(ret, sample)
+		}
+	}
+
+	return ret
+}
+
+// MergeMatrices merges the range vectors returned by several upstreams,
+// the samples of the same series are joined and ordered by their timestamps.
+func MergeMatrices(matrices ...prommodel.Matrix) prommodel.Matrix {
+	return mergeMatrices(matrices, func(a, b []prommodel.SamplePair) []prommodel.SamplePair {
+		return mergeByTimestamp(a, b, samplePairTimestamp)
+	})
+}
+
+// CombineVectors combines the instant vectors of an aggregation returned by several shards,
+// the values of the same series are combined.
+func CombineVectors(combine ShardCombiner, vectors ...prommodel.Vector) prommodel.Vector {
+	byFingerprint := make(map[prommodel.Fingerprint]*prommodel.Sample)
+	ret := make(prommodel.Vector, 0)
+	for _, vector := range vectors {
+		for _, sample := range vector {
+			fp := sample.Metric.Fingerprint()
+			combined, exist := byFingerprint[fp]
+			if !exist {
+				combined = &prommodel.Sample{Metric: sample.Metric, Value: sample.Value, Timestamp: sample.Timestamp, Histogram: sample.Histogram}
+				byFingerprint[fp] = combined
+				ret = append(ret, combined)
+				continue
+			}
+
+			combined.Value = combine(combined.Value, sample.Value)
+		}
+	}
+
+	return ret
+}
+
+// CombineMatrices combines the range vectors of an aggregation returned by several shards,
+// the values of the same series at the same timestamp are combined.
+func CombineMatrices(combine ShardCombiner, matrices ...prommodel.Matrix) prommodel.Matrix {
+	return mergeMatrices(matrices, func(a, b []prommodel.SamplePair) []prommodel.SamplePair {
+		return combineByTimestamp(a, b, combine)
+	})
+}
+
+func mergeMatrices(matrices []prommodel.Matrix, mergeValues func(a, b []prommodel.SamplePair) []prommodel.SamplePair) prommodel.Matrix {
+	byFingerprint := make(map[prommodel.Fingerprint]*prommodel.SampleStream)
+	ret := make(prommodel.Matrix, 0)
+	for _, matrix := range matrices {
+		for _, stream := range matrix {
+			fp := stream.Metric.Fingerprint()
+			merged, exist := byFingerprint[fp]
+			if !exist {
+				merged = &prommodel.SampleStream{Metric: stream.Metric}
+				byFingerprint[fp] = merged
+				ret = append(ret, merged)
+			}
+
+			merged.Values = mergeValues(merged.Values, stream.Values)
+			merged.Histograms = mergeByTimestamp(merged.Histograms, stream.Histograms, sampleHistogramPairTimestamp)
+		}
+	}
+
+	sort.Sort(ret)
+
+	return ret
+}
+
+// MergeLabelSets merges the series returned by several upstreams.
+func MergeLabelSets(labelSets ...[]prommodel.LabelSet) []prommodel.LabelSet {
+	seen := make(map[prommodel.Fingerprint]struct{})
+	ret := make([]prommodel.LabelSet, 0)
+	for _, sets := range labelSets {
+		for _, set := range sets {
+			fp := set.Fingerprint()
+			if _, exist := seen[fp]; exist {
+				continue
+			}
+
+			seen[fp] = struct{}{}
+			ret = append(ret, set)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Before(ret[j])
+	})
+
+	return ret
+}
+
+// MergeStrings merges the label names or values returned by several upstreams.
+func MergeStrings(values ...[]string) []string {
+	seen := make(map[string]struct{})
+	ret := make([]string, 0)
+	for _, vals := range values {
+		for _, val := range vals {
+			if _, exist := seen[val]; exist {
+				continue
+			}
+
+			seen[val] = struct{}{}
+			ret = append(ret, val)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// MergeMetricFamilies merges the federated metric families returned by several upstreams,
+// metrics with the same labels are only kept once.
+func MergeMetricFamilies(families ...map[string]*promgo.MetricFamily) []*promgo.MetricFamily {
+	byName := make(map[string]*promgo.MetricFamily)
+	seen := make(map[string]map[uint64]struct{})
+	for _, familiesByName := range families {
+		for name, family := range familiesByName {
+			merged, exist := byName[name]
+			if !exist {
+				merged = &promgo.MetricFamily{
+					Name: family.Name,
+					Help: family.Help,
+					Type: family.Type,
+					Unit: family.Unit,
+				}
+				byName[name] = merged
+				seen[name] = make(map[uint64]struct{})
+			}
+
+			for _, metric := range family.GetMetric() {
+				signature := metricSignature(metric)
+				if _, exist := seen[name][signature]; exist {
+					continue
+				}
+
+				seen[name][signature] = struct{}{}
+				merged.Metric = append(merged.Metric, metric)
+			}
+		}
+	}
+
+	ret := make([]*promgo.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		ret = append(ret, family)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetName() < ret[j].GetName()
+	})
+
+	return ret
+}
+
+// MergeQueryResults merges the remote read results of the same query returned by several upstreams,
+// the samples of the same series are joined and ordered by their timestamps.
+func MergeQueryResults(results ...*prompb.QueryResult) *prompb.QueryResult {
+	return mergeQueryResults(results, func(a, b []prompb.Sample) []prompb.Sample {
+		return mergeByTimestamp(a, b, sampleTimestamp)
+	})
+}
+
+func mergeQueryResults(results []*prompb.QueryResult, mergeSamples func(a, b []prompb.Sample) []prompb.Sample) *prompb.QueryResult {
+	ret := &prompb.QueryResult{}
+	byFingerprint := make(map[uint64]*prompb.TimeSeries)
+	for _, result := range results {
+		for _, series := range result.GetTimeseries() {
+			fp := labelsFingerprint(series.GetLabels())
+			merged, exist := byFingerprint[fp]
+			if !exist {
+				merged = &prompb.TimeSeries{Labels: series.GetLabels()}
+				byFingerprint[fp] = merged
+				ret.Timeseries = append(ret.Timeseries, merged)
+			}
+
+			merged.Samples = mergeSamples(merged.Samples, series.GetSamples())
+			merged.Histograms = append(merged.Histograms, series.GetHistograms()...)
+		}
+	}
+
+	return ret
+}
+
+// mergeByTimestamp joins two lists of samples which are ordered by their timestamps,
+// a sample of b is dropped if a has a sample with the same timestamp.
+func mergeByTimestamp[T any](a, b []T, timestamp func(T) int64) []T {
+	if len(a) == 0 {
+		return b
+	}
+
+	ret := make([]T, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch ta, tb := timestamp(a[i]), timestamp(b[j]); {
+		case ta < tb:
+			ret = append(ret, a[i])
+			i++
+		case ta > tb:
+			ret = append(ret, b[j])
+			j++
+		default:
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	ret = append(ret, b[j:]...)
+
+	return ret
+}
+
+// combineByTimestamp joins two lists of sample pairs which are ordered by their timestamps,
+// the values with the same timestamp are combined.
+func combineByTimestamp(a, b []prommodel.SamplePair, combine ShardCombiner) []prommodel.SamplePair {
+	if len(a) == 0 {
+		return b
+	}
+
+	ret := make([]prommodel.SamplePair, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Timestamp < b[j].Timestamp:
+			ret = append(ret, a[i])
+			i++
+		case a[i].Timestamp > b[j].Timestamp:
+			ret = append(ret, b[j])
+			j++
+		default:
+			ret = append(ret, prommodel.SamplePair{Timestamp: a[i].Timestamp, Value: combine(a[i].Value, b[j].Value)})
+			i++
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	ret = append(ret, b[j:]...)
+
+	return ret
+}
+
+func samplePairTimestamp(s prommodel.SamplePair) int64 {
+	return int64(s.Timestamp)
+}
+
+func sampleHistogramPairTimestamp(s prommodel.SampleHistogramPair) int64 {
+	return int64(s.Timestamp)
+}
+
+func sampleTimestamp(s prompb.Sample) int64 {
+	return s.GetTimestamp()
+}
+
+func labelsFingerprint(lbs []prompb.Label) uint64 {
+	set := make(prommodel.LabelSet, len(lbs))
+	for _, lb := range lbs {
+		set[prommodel.LabelName(lb.GetName())] = prommodel.LabelValue(lb.GetValue())
+	}
+
+	return uint64(set.Fingerprint())
+}
+
+func metricSignature(metric *promgo.Metric) uint64 {
+	lbs := make(map[string]string, len(metric.GetLabel()))
+	for _, lb := range metric.GetLabel() {
+		lbs[lb.GetName()] = lb.GetValue()
+	}
+
+	return prommodel.LabelsToSignature(lbs)
+}
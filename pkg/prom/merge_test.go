@@ -0,0 +1,100 @@
+package prom
+
+import (
+	"testing"
+
+	promgo "github.com/prometheus/client_model/go"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeVectors(t *testing.T) {
+	a := prommodel.Vector{
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Value: 1, Timestamp: 10},
+	}
+	b := prommodel.Vector{
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Value: 2, Timestamp: 10},
+		{Metric: prommodel.Metric{"namespace": "ns-b"}, Value: 3, Timestamp: 10},
+	}
+
+	require.Equal(t, prommodel.Vector{a[0], b[1]}, MergeVectors(a, b))
+}
+
+func TestMergeMatrices(t *testing.T) {
+	a := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-b"}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}}},
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 30, Value: 3}}},
+	}
+	b := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Values: []prommodel.SamplePair{{Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 4}}},
+	}
+
+	expected := prommodel.Matrix{
+		{Metric: prommodel.Metric{"namespace": "ns-a"}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}}},
+		{Metric: prommodel.Metric{"namespace": "ns-b"}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}}},
+	}
+
+	require.Equal(t, expected, MergeMatrices(a, b))
+}
+
+func TestMergeLabelSets(t *testing.T) {
+	a := []prommodel.LabelSet{{"namespace": "ns-b"}, {"namespace": "ns-a"}}
+	b := []prommodel.LabelSet{{"namespace": "ns-a"}, {"namespace": "ns-c"}}
+
+	require.Equal(t, []prommodel.LabelSet{{"namespace": "ns-a"}, {"namespace": "ns-b"}, {"namespace": "ns-c"}}, MergeLabelSets(a, b))
+}
+
+func TestMergeStrings(t *testing.T) {
+	require.Equal(t, []string{"a", "b", "c"}, MergeStrings([]string{"c", "a"}, []string{"b", "a"}))
+	require.Equal(t, []string{}, MergeStrings())
+}
+
+func TestMergeMetricFamilies(t *testing.T) {
+	newFamily := func(name string, namespaces ...string) *promgo.MetricFamily {
+		family := &promgo.MetricFamily{Name: &name, Type: promgo.MetricType_UNTYPED.Enum()}
+		for _, ns := range namespaces {
+			family.Metric = append(family.Metric, &promgo.Metric{
+				Label: []*promgo.LabelPair{{Name: stringPtr("namespace"), Value: stringPtr(ns)}},
+			})
+		}
+		return family
+	}
+
+	merged := MergeMetricFamilies(
+		map[string]*promgo.MetricFamily{"b": newFamily("b", "ns-a"), "a": newFamily("a", "ns-a")},
+		map[string]*promgo.MetricFamily{"a": newFamily("a", "ns-a", "ns-b")},
+	)
+
+	require.Len(t, merged, 2)
+	require.Equal(t, "a", merged[0].GetName())
+	require.Len(t, merged[0].GetMetric(), 2)
+	require.Equal(t, "b", merged[1].GetName())
+	require.Len(t, merged[1].GetMetric(), 1)
+}
+
+func TestMergeQueryResults(t *testing.T) {
+	lbsA := []prompb.Label{{Name: "namespace", Value: "ns-a"}}
+	lbsB := []prompb.Label{{Name: "namespace", Value: "ns-b"}}
+
+	merged := MergeQueryResults(
+		&prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+			{Labels: lbsA, Samples: []prompb.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 30, Value: 3}}},
+		}},
+		&prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+			{Labels: lbsA, Samples: []prompb.Sample{{Timestamp: 20, Value: 2}}},
+			{Labels: lbsB, Samples: []prompb.Sample{{Timestamp: 10, Value: 1}}},
+		}},
+	)
+
+	expected := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+		{Labels: lbsA, Samples: []prompb.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}}},
+		{Labels: lbsB, Samples: []prompb.Sample{{Timestamp: 10, Value: 1}}},
+	}}
+
+	require.Equal(t, expected, merged)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
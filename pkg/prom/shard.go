@@ -0,0 +1,69 @@
+package prom
+
+import (
+	"fmt"
+	"math"
+
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ShardCombiner combines the values of the same series returned by several shards, which hold disjoint series.
+type ShardCombiner func(a, b prommodel.SampleValue) prommodel.SampleValue
+
+// ShardCombinerOf returns how to combine the results of the expression evaluated on several shards,
+// nil if the results are disjoint series, or an error if the results of the shards cannot be combined,
+// like the partial averages, quantiles or top values of each shard.
+func ShardCombinerOf(expr parser.Expr) (ShardCombiner, error) {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+
+	aggr, ok := expr.(*parser.AggregateExpr)
+	if !ok {
+		// the series of the shards are disjoint, unless they are aggregated within
+		return nil, nestedAggregation(expr)
+	}
+
+	if err := nestedAggregation(aggr.Expr); err != nil {
+		return nil, err
+	}
+
+	switch aggr.Op { //nolint:exhaustive // the other aggregations cannot be combined
+	case parser.SUM, parser.COUNT, parser.COUNT_VALUES:
+		return func(a, b prommodel.SampleValue) prommodel.SampleValue { return a + b }, nil
+	case parser.MIN:
+		return func(a, b prommodel.SampleValue) prommodel.SampleValue {
+			return prommodel.SampleValue(math.Min(float64(a), float64(b)))
+		}, nil
+	case parser.MAX:
+		return func(a, b prommodel.SampleValue) prommodel.SampleValue {
+			return prommodel.SampleValue(math.Max(float64(a), float64(b)))
+		}, nil
+	case parser.GROUP:
+		return func(a, _ prommodel.SampleValue) prommodel.SampleValue { return a }, nil
+	}
+
+	return nil, fmt.Errorf("the %s aggregation cannot be combined across upstreams", aggr.Op)
+}
+
+// nestedAggregation returns an error if the expression contains an aggregation,
+// whose results cannot be combined across shards once they are processed further.
+func nestedAggregation(expr parser.Expr) error {
+	var aggr *parser.AggregateExpr
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if n, ok := node.(*parser.AggregateExpr); ok && aggr == nil {
+			aggr = n
+		}
+		return nil
+	})
+	if aggr == nil {
+		return nil
+	}
+
+	return fmt.Errorf("the %s aggregation cannot be combined across upstreams unless it is the outermost expression", aggr.Op)
+}
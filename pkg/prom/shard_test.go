@@ -0,0 +1,75 @@
+package prom
+
+import (
+	"testing"
+
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardCombinerOf(t *testing.T) {
+	for query, combined := range map[string]prommodel.SampleValue{
+		"sum(up)":                     3,
+		"(count by (pod) (up))":       3,
+		"count_values(\"v\", up)":     3,
+		"min(up)":                     1,
+		"max by (job) (rate(up[5m]))": 2,
+		"group(up)":                   1,
+	} {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+
+		combiner, err := ShardCombinerOf(expr)
+		require.NoError(t, err, query)
+		require.Equal(t, combined, combiner(1, 2), query)
+	}
+
+	for _, query := range []string{"up", "rate(up[5m]) > 1"} {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+
+		combiner, err := ShardCombinerOf(expr)
+		require.NoError(t, err, query)
+		require.Nil(t, combiner, query)
+	}
+
+	for _, query := range []string{"avg(up)", "topk(3, up)", "quantile(0.9, up)", "sum(avg(up))", "sum(up) / 2", "max_over_time(sum(up)[5m:])"} {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+
+		_, err = ShardCombinerOf(expr)
+		require.ErrorContains(t, err, "cannot be combined across upstreams", query)
+	}
+}
+
+func TestCombineVectors(t *testing.T) {
+	sum := func(a, b prommodel.SampleValue) prommodel.SampleValue { return a + b }
+	a := prommodel.Vector{
+		{Metric: prommodel.Metric{"job": "x"}, Value: 1, Timestamp: 10},
+	}
+	b := prommodel.Vector{
+		{Metric: prommodel.Metric{"job": "x"}, Value: 2, Timestamp: 10},
+		{Metric: prommodel.Metric{"job": "y"}, Value: 3, Timestamp: 10},
+	}
+
+	require.Equal(t, prommodel.Vector{
+		{Metric: prommodel.Metric{"job": "x"}, Value: 3, Timestamp: 10},
+		{Metric: prommodel.Metric{"job": "y"}, Value: 3, Timestamp: 10},
+	}, CombineVectors(sum, a, b))
+	require.Equal(t, prommodel.SampleValue(1), a[0].Value)
+}
+
+func TestCombineMatrices(t *testing.T) {
+	sum := func(a, b prommodel.SampleValue) prommodel.SampleValue { return a + b }
+	a := prommodel.Matrix{
+		{Metric: prommodel.Metric{}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 1}}},
+	}
+	b := prommodel.Matrix{
+		{Metric: prommodel.Metric{}, Values: []prommodel.SamplePair{{Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 2}}},
+	}
+
+	require.Equal(t, prommodel.Matrix{
+		{Metric: prommodel.Metric{}, Values: []prommodel.SamplePair{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 3}, {Timestamp: 30, Value: 2}}},
+	}, CombineMatrices(sum, a, b))
+}